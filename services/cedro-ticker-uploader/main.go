@@ -2,20 +2,45 @@ package main
 
 import (
 	"bufio"
+	"container/list"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 const defaultUploadDir = "/data/cedro-ticker-uploader"
 
+// csvSchemaLine precedes the header of new CSV minute files (raw files have
+// none). The scheme is described by csvSchemaVersion in the BFF.
+const csvSchemaLine = "#schema=1\n"
+
+// unknownSymbolConfig says what happens to messages parseSymbol can't read a
+// symbol from (CEDRO_UNKNOWN_SYMBOLS):
+//
+//	merge       file them under the UNKNOWN symbol (default)
+//	drop        discard them
+//	log         discard them, logging the first and every unknownLogEvery-th
+//	quarantine  append "<ts>|<raw>" lines to <dir>/<date>.log
+type unknownSymbolConfig struct {
+	policy string
+	dir    string
+}
+
+const unknownLogEvery = 100
+
 type cedroTick struct {
 	TimeMSC int64
 	Symbol  string
@@ -56,23 +81,125 @@ func main() {
 		uploadDir = defaultUploadDir
 	}
 
+	// CEDRO_FILE_FORMAT=raw keeps the original "<ts>|<raw message>" lines;
+	// the default writes a CSV header and parsed price columns.
+	rawFormat := false
+	switch format := strings.ToLower(strings.TrimSpace(os.Getenv("CEDRO_FILE_FORMAT"))); format {
+	case "", "csv":
+	case "raw":
+		rawFormat = true
+	default:
+		log.Fatalf("invalid CEDRO_FILE_FORMAT: %q", format)
+	}
+
+	// CEDRO_RAW_FIELDS lists the quote field indexes raw lines keep, e.g.
+	// "2,3,4,9"; unset keeps the whole message.
+	rawFields, err := parseRawFields(os.Getenv("CEDRO_RAW_FIELDS"))
+	if err != nil {
+		log.Fatalf("invalid CEDRO_RAW_FIELDS: %v", err)
+	}
+
+	// CEDRO_DIR_LAYOUT=nested writes YYYY/MM/DD/<symbol>/ instead of the
+	// flat YYYY-MM-DD/<symbol>/ day directories.
+	layout, err := parseDateLayout(os.Getenv("CEDRO_DIR_LAYOUT"))
+	if err != nil {
+		log.Fatalf("invalid CEDRO_DIR_LAYOUT: %v", err)
+	}
+	if rawFields != nil && !rawFormat {
+		log.Printf("CEDRO_RAW_FIELDS only applies to CEDRO_FILE_FORMAT=raw; ignoring")
+	}
+
+	unknown := unknownSymbolConfig{
+		policy: strings.ToLower(strings.TrimSpace(os.Getenv("CEDRO_UNKNOWN_SYMBOLS"))),
+		dir:    strings.TrimSpace(os.Getenv("CEDRO_QUARANTINE_DIR")),
+	}
+	switch unknown.policy {
+	case "":
+		unknown.policy = "merge"
+	case "merge", "drop", "log", "quarantine":
+	default:
+		log.Fatalf("invalid CEDRO_UNKNOWN_SYMBOLS: %q", unknown.policy)
+	}
+	if unknown.dir == "" {
+		unknown.dir = filepath.Join(uploadDir, "_quarantine")
+	}
+
+	files := fileCacheConfig{
+		bufferSize:  envInt("CEDRO_WRITE_BUFFER_BYTES", 64<<10),
+		maxOpen:     envInt("CEDRO_MAX_OPEN_FILES", 32),
+		idleTimeout: 2 * time.Minute,
+	}
+
+	flushGrace := 10 * time.Second
+	if value := strings.TrimSpace(os.Getenv("CEDRO_FLUSH_GRACE_SECONDS")); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			log.Fatalf("invalid CEDRO_FLUSH_GRACE_SECONDS: %q", value)
+		}
+		flushGrace = time.Duration(seconds) * time.Second
+	}
+
+	// CEDRO_MAX_BUFFERED_TICKS bounds the ticks held between flushes; see
+	// bufferLimit.
+	limit := bufferLimit{}
+	if value := strings.TrimSpace(os.Getenv("CEDRO_MAX_BUFFERED_TICKS")); value != "" {
+		maxTicks, err := strconv.Atoi(value)
+		if err != nil || maxTicks < 0 {
+			log.Fatalf("invalid CEDRO_MAX_BUFFERED_TICKS: %q", value)
+		}
+		limit.maxTicks = maxTicks
+	}
+	switch overflow := strings.ToLower(strings.TrimSpace(os.Getenv("CEDRO_BUFFER_OVERFLOW"))); overflow {
+	case "", "flush":
+	case "drop":
+		limit.drop = true
+	default:
+		log.Fatalf("invalid CEDRO_BUFFER_OVERFLOW: %q", overflow)
+	}
+
+	// CEDRO_STATUS_ADDR defaults to :9091 so it doesn't collide with the
+	// massive uploader's metrics server on :9090 when both share a host.
+	statusAddr := strings.TrimSpace(os.Getenv("CEDRO_STATUS_ADDR"))
+	if statusAddr == "" {
+		statusAddr = ":9091"
+	}
+
+	// CEDRO_DEBUG_RECENT enables /debug/recent with that many raw lines kept
+	// per symbol.
+	debugRecent := 0
+	if value := strings.TrimSpace(os.Getenv("CEDRO_DEBUG_RECENT")); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			log.Fatalf("invalid CEDRO_DEBUG_RECENT: %q", value)
+		}
+		debugRecent = size
+	}
+
 	address := net.JoinHostPort(host, port)
-	log.Printf("starting cedro-ticker-uploader address=%s commands=%q data_dir=%s", address, commandList, uploadDir)
+	log.Printf("starting cedro-ticker-uploader address=%s commands=%q data_dir=%s raw_format=%t write_buffer=%d max_open_files=%d status_addr=%s debug_recent=%d unknown_symbols=%s", address, commandList, uploadDir, rawFormat, files.bufferSize, files.maxOpen, statusAddr, debugRecent, unknown.policy)
+
+	status := newConnectionStatus()
+	recent := newRecentMessages(debugRecent)
+	go serveStatus(statusAddr, status, recent)
 
 	backoff := 2 * time.Second
 	for {
-		if err := run(address, username, password, commandList, uploadDir); err != nil {
+		status.set("connecting")
+		err := run(address, username, password, commandList, uploadDir, layout, rawFormat, rawFields, files, flushGrace, limit, unknown, status, recent)
+		if err != nil {
 			log.Printf("tcp error: %v", err)
 		}
 
+		status.backingOff(backoff, err)
 		time.Sleep(backoff)
+		status.reconnecting()
 		if backoff < 30*time.Second {
 			backoff *= 2
 		}
 	}
 }
 
-func run(address, username, password, commandList, uploadDir string) error {
+func run(address, username, password, commandList, uploadDir string, layout dateLayout, rawFormat bool, rawFields map[string]bool, filesCfg fileCacheConfig, flushGrace time.Duration, limit bufferLimit, unknown unknownSymbolConfig, status *connectionStatus, recent *recentMessages) error {
 	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
 	if err != nil {
 		return err
@@ -95,11 +222,16 @@ func run(address, username, password, commandList, uploadDir string) error {
 		}
 		log.Printf("command sent: %s", command)
 	}
+	status.set("connected")
+	defer status.set("disconnected")
 
 	flushInterval := 1 * time.Minute
-	acc := newTickAccumulator(flushInterval, func(symbol string, entries []cedroTick) error {
-		return writeCSV(uploadDir, symbol, entries)
-	})
+	files := newFileCache(filesCfg)
+	defer files.Close()
+	limit.onDrop = status.droppedTick
+	acc := newTickAccumulator(flushInterval, flushGrace, limit, func(symbol string, entries []cedroTick) error {
+		return writeCSV(files, uploadDir, layout, rawFormat, rawFields, symbol, entries)
+	}, files.Flush)
 	defer acc.Stop()
 
 	for {
@@ -122,10 +254,29 @@ func run(address, username, password, commandList, uploadDir string) error {
 			continue
 		}
 
-		ts := time.Now().UTC().UnixMilli()
+		received := time.Now().UTC()
+		symbol := parseSymbol(text)
+		if symbol == "" {
+			count := status.unknownSymbol()
+			switch unknown.policy {
+			case "drop":
+				continue
+			case "log":
+				if count == 1 || count%unknownLogEvery == 0 {
+					log.Printf("dropping message without symbol (%d so far): %q", count, text)
+				}
+				continue
+			case "quarantine":
+				if err := quarantineTick(files, unknown.dir, received, text); err != nil {
+					log.Printf("quarantine error: %v", err)
+				}
+				continue
+			}
+		}
+		recent.add(symbol, text, received)
 		acc.Add(cedroTick{
-			TimeMSC: ts,
-			Symbol:  parseSymbol(text),
+			TimeMSC: received.UnixMilli(),
+			Symbol:  symbol,
 			Raw:     text,
 		})
 	}
@@ -251,6 +402,75 @@ func parseSymbol(text string) string {
 	return strings.TrimSpace(parts[1])
 }
 
+// Cedro quote (GQT) field indexes used in the CSV columns.
+const (
+	quoteFieldLast   = "2"
+	quoteFieldBid    = "3"
+	quoteFieldAsk    = "4"
+	quoteFieldVolume = "9" // cumulative traded volume
+)
+
+// parseQuoteFields reads the index:value pairs that follow the symbol and
+// time in a quote message ("T:PETR4:135958:2:25.30:3:25.29!"). Quote
+// messages only carry the fields that changed, so absent ones are "".
+func parseQuoteFields(text string) map[string]string {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimSpace(text), "!"), ":")
+	fields := make(map[string]string)
+	for i := 3; i+1 < len(parts); i += 2 {
+		fields[strings.TrimSpace(parts[i])] = strings.TrimSpace(parts[i+1])
+	}
+	return fields
+}
+
+// parseRawFields reads a comma-separated list of quote field indexes. An
+// empty value returns nil, meaning keep every field.
+func parseRawFields(value string) (map[string]bool, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	fields := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if index, err := strconv.Atoi(part); err != nil || index < 0 {
+			return nil, fmt.Errorf("%q is not a field index", part)
+		}
+		fields[part] = true
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// trimQuoteFields drops the index:value pairs of a quote message whose index
+// is not in keep, leaving the type, symbol and time in front and pair order
+// unchanged. The first pair is always kept: the BFF prices a raw line by its
+// value. Other messages, and any message when keep is nil, pass through.
+func trimQuoteFields(text string, keep map[string]bool) string {
+	if keep == nil || !strings.HasPrefix(text, "T:") {
+		return text
+	}
+	body := strings.TrimSpace(text)
+	suffix := ""
+	if strings.HasSuffix(body, "!") {
+		body, suffix = strings.TrimSuffix(body, "!"), "!"
+	}
+	parts := strings.Split(body, ":")
+	if len(parts) < 3 {
+		return text
+	}
+	out := append(make([]string, 0, len(parts)), parts[:3]...)
+	for i := 3; i+1 < len(parts); i += 2 {
+		if i == 3 || keep[strings.TrimSpace(parts[i])] {
+			out = append(out, parts[i], parts[i+1])
+		}
+	}
+	return strings.Join(out, ":") + suffix
+}
+
 func splitCommands(input string) []string {
 	if strings.TrimSpace(input) == "" {
 		return nil
@@ -288,20 +508,46 @@ func isCedroStatus(text string) bool {
 	}
 }
 
+// tickAccumulator buffers ticks per symbol and flushes them on every tick of
+// its ticker. Ticks whose minute ended less than grace ago are held back to
+// the next flush so late arrivals land in the same write as the rest of
+// their minute; Stop flushes everything.
 type tickAccumulator struct {
-	mu      sync.Mutex
+	mu       sync.Mutex
 	bySymbol map[string][]cedroTick
-	ticker  *time.Ticker
-	stopCh  chan struct{}
-	flushFn func(symbol string, entries []cedroTick) error
+	buffered int
+	limit    bufferLimit
+	grace    time.Duration
+	ticker   *time.Ticker
+	flushNow chan struct{}
+	stopCh   chan struct{}
+	flushFn  func(symbol string, entries []cedroTick) error
+	// flushed, when set, runs after each flush round's flushFn calls.
+	flushed func()
 }
 
-func newTickAccumulator(interval time.Duration, flushFn func(symbol string, entries []cedroTick) error) *tickAccumulator {
+// bufferLimit caps the ticks a tickAccumulator holds across all symbols
+// (CEDRO_MAX_BUFFERED_TICKS, 0 for no cap). Past the cap it either drops
+// the oldest ticks (CEDRO_BUFFER_OVERFLOW=drop) or asks for an early flush
+// (flush, the default); a flush that can't keep up, e.g. on a hung disk,
+// falls back to dropping at twice the cap. onDrop counts each dropped tick
+// and returns the running total.
+type bufferLimit struct {
+	maxTicks int
+	drop     bool
+	onDrop   func() int64
+}
+
+func newTickAccumulator(interval, grace time.Duration, limit bufferLimit, flushFn func(symbol string, entries []cedroTick) error, flushed func()) *tickAccumulator {
 	acc := &tickAccumulator{
 		bySymbol: make(map[string][]cedroTick),
+		limit:    limit,
+		grace:    grace,
 		ticker:   time.NewTicker(interval),
+		flushNow: make(chan struct{}, 1),
 		stopCh:   make(chan struct{}),
 		flushFn:  flushFn,
+		flushed:  flushed,
 	}
 
 	go acc.loop()
@@ -318,27 +564,74 @@ func (a *tickAccumulator) Add(tick cedroTick) {
 		symbol = "UNKNOWN"
 	}
 	a.bySymbol[symbol] = append(a.bySymbol[symbol], tick)
+	a.buffered++
+	a.enforceLimit()
 	a.mu.Unlock()
 }
 
+// enforceLimit applies a.limit after an Add; a.mu must be held.
+func (a *tickAccumulator) enforceLimit() {
+	max := a.limit.maxTicks
+	if max <= 0 || a.buffered <= max {
+		return
+	}
+	if !a.limit.drop {
+		select {
+		case a.flushNow <- struct{}{}:
+		default:
+		}
+		max *= 2
+	}
+	for a.buffered > max {
+		a.dropOldest()
+	}
+}
+
+// dropOldest removes the oldest buffered tick; a.mu must be held.
+func (a *tickAccumulator) dropOldest() {
+	oldest := ""
+	for symbol, entries := range a.bySymbol {
+		if oldest == "" || entries[0].TimeMSC < a.bySymbol[oldest][0].TimeMSC {
+			oldest = symbol
+		}
+	}
+	if oldest == "" {
+		return
+	}
+	if entries := a.bySymbol[oldest][1:]; len(entries) > 0 {
+		a.bySymbol[oldest] = entries
+	} else {
+		delete(a.bySymbol, oldest)
+	}
+	a.buffered--
+	if a.limit.onDrop == nil {
+		return
+	}
+	if total := a.limit.onDrop(); total == 1 || total%1000 == 0 {
+		log.Printf("tick buffer over %d ticks, dropped %d so far", a.limit.maxTicks, total)
+	}
+}
+
 func (a *tickAccumulator) Stop() {
 	close(a.stopCh)
 	a.ticker.Stop()
-	a.flush()
+	a.flush(true)
 }
 
 func (a *tickAccumulator) loop() {
 	for {
 		select {
 		case <-a.ticker.C:
-			a.flush()
+			a.flush(false)
+		case <-a.flushNow:
+			a.flush(true)
 		case <-a.stopCh:
 			return
 		}
 	}
 }
 
-func (a *tickAccumulator) flush() {
+func (a *tickAccumulator) flush(force bool) {
 	a.mu.Lock()
 	if len(a.bySymbol) == 0 {
 		a.mu.Unlock()
@@ -346,6 +639,22 @@ func (a *tickAccumulator) flush() {
 	}
 	pending := a.bySymbol
 	a.bySymbol = make(map[string][]cedroTick)
+	a.buffered = 0
+	if !force {
+		cutoff := time.Now().UTC().Add(-time.Minute - a.grace).Truncate(time.Minute).Add(time.Minute).UnixMilli()
+		for symbol, entries := range pending {
+			ready := entries[:0:0]
+			for _, entry := range entries {
+				if entry.TimeMSC >= cutoff {
+					a.bySymbol[symbol] = append(a.bySymbol[symbol], entry)
+					a.buffered++
+					continue
+				}
+				ready = append(ready, entry)
+			}
+			pending[symbol] = ready
+		}
+	}
 	a.mu.Unlock()
 
 	for symbol, entries := range pending {
@@ -356,9 +665,219 @@ func (a *tickAccumulator) flush() {
 			log.Printf("persist error: %v", err)
 		}
 	}
+	if a.flushed != nil {
+		a.flushed()
+	}
+}
+
+type fileCacheConfig struct {
+	bufferSize  int
+	maxOpen     int
+	idleTimeout time.Duration
+}
+
+type cachedFile struct {
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	lastUsed time.Time
+	elem     *list.Element
+	// empty is true until the first write to a file that was empty when
+	// opened, so callers know to write a header.
+	empty bool
+}
+
+// fileCache keeps recently written minute files open across flushes so
+// high-frequency symbols don't pay an open/close per bucket. Handles are
+// evicted least-recently-used, synced and closed when idle, and closed on
+// Close. Writes are buffered per handle and reach the file on Flush, on
+// the idle sync, or when the handle is closed.
+type fileCache struct {
+	mu      sync.Mutex
+	cfg     fileCacheConfig
+	handles map[string]*cachedFile
+	lru     *list.List
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func newFileCache(cfg fileCacheConfig) *fileCache {
+	if cfg.bufferSize <= 0 {
+		cfg.bufferSize = 4096
+	}
+	if cfg.maxOpen <= 0 {
+		cfg.maxOpen = 1
+	}
+	if cfg.idleTimeout <= 0 {
+		cfg.idleTimeout = 2 * time.Minute
+	}
+	c := &fileCache{
+		cfg:     cfg,
+		handles: make(map[string]*cachedFile),
+		lru:     list.New(),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+func (c *fileCache) withFile(path string, fn func(w *bufio.Writer, empty bool) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	handle, ok := c.handles[path]
+	if !ok {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		handle = &cachedFile{
+			path:   path,
+			file:   file,
+			writer: bufio.NewWriterSize(file, c.cfg.bufferSize),
+			empty:  info.Size() == 0,
+		}
+		handle.elem = c.lru.PushFront(handle)
+		c.handles[path] = handle
+		for c.lru.Len() > c.cfg.maxOpen {
+			oldest := c.lru.Back().Value.(*cachedFile)
+			if err := c.closeLocked(oldest); err != nil {
+				log.Printf("close %s: %v", oldest.path, err)
+			}
+		}
+	} else {
+		c.lru.MoveToFront(handle.elem)
+	}
+	handle.lastUsed = time.Now()
+
+	if err := fn(handle.writer, handle.empty); err != nil {
+		return err
+	}
+	handle.empty = false
+	return nil
 }
 
-func writeCSV(uploadDir, symbol string, ticks []cedroTick) error {
+// Flush writes out every handle's buffer. Writes otherwise sit in the
+// CEDRO_WRITE_BUFFER_BYTES buffers until the handle is evicted or idle, so
+// the accumulator calls this once per flush round.
+func (c *fileCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, handle := range c.handles {
+		if err := handle.writer.Flush(); err != nil {
+			log.Printf("flush %s: %v", handle.path, err)
+		}
+	}
+}
+
+func (c *fileCache) loop() {
+	defer close(c.doneCh)
+	ticker := time.NewTicker(c.cfg.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.syncIdle()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func (c *fileCache) syncIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cutoff := time.Now().Add(-c.cfg.idleTimeout)
+	for _, handle := range c.handles {
+		if handle.lastUsed.Before(cutoff) {
+			if err := c.closeLocked(handle); err != nil {
+				log.Printf("close %s: %v", handle.path, err)
+			}
+			continue
+		}
+		if err := handle.writer.Flush(); err != nil {
+			log.Printf("flush %s: %v", handle.path, err)
+			continue
+		}
+		if err := handle.file.Sync(); err != nil {
+			log.Printf("sync %s: %v", handle.path, err)
+		}
+	}
+}
+
+func (c *fileCache) closeLocked(handle *cachedFile) error {
+	c.lru.Remove(handle.elem)
+	delete(c.handles, handle.path)
+	if err := handle.writer.Flush(); err != nil {
+		_ = handle.file.Close()
+		return err
+	}
+	if err := handle.file.Sync(); err != nil {
+		_ = handle.file.Close()
+		return err
+	}
+	return handle.file.Close()
+}
+
+func (c *fileCache) Close() {
+	close(c.stopCh)
+	<-c.doneCh
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, handle := range c.handles {
+		if err := c.closeLocked(handle); err != nil {
+			log.Printf("close %s: %v", handle.path, err)
+		}
+	}
+}
+
+// quarantineTick appends a message without a symbol to the day's quarantine
+// log. The files sit outside the date/symbol layout, so the BFF ignores them.
+func quarantineTick(files *fileCache, dir string, received time.Time, raw string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, received.Format("2006-01-02")+".log")
+	return files.withFile(path, func(w *bufio.Writer, _ bool) error {
+		_, err := fmt.Fprintf(w, "%d|%s\n", received.UnixMilli(), raw)
+		return err
+	})
+}
+
+// dateLayout is how minute files are grouped by day under the upload dir.
+type dateLayout int
+
+const (
+	flatDates   dateLayout = iota // <date>/<symbol>/HH_MM.csv, date as 2006-01-02
+	nestedDates                   // 2006/01/02/<symbol>/HH_MM.csv
+)
+
+func parseDateLayout(value string) (dateLayout, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "flat":
+		return flatDates, nil
+	case "nested":
+		return nestedDates, nil
+	default:
+		return flatDates, fmt.Errorf("unknown layout %q", value)
+	}
+}
+
+// dir returns the day directory, relative to the upload dir, for tm.
+func (l dateLayout) dir(tm time.Time) string {
+	if l == nestedDates {
+		return filepath.Join(tm.Format("2006"), tm.Format("01"), tm.Format("02"))
+	}
+	return tm.Format("2006-01-02")
+}
+
+func writeCSV(files *fileCache, uploadDir string, layout dateLayout, rawFormat bool, rawFields map[string]bool, symbol string, ticks []cedroTick) error {
 	type bucket struct {
 		dateDir string
 		minute  string
@@ -374,7 +893,7 @@ func writeCSV(uploadDir, symbol string, ticks []cedroTick) error {
 		}
 		tm := time.UnixMilli(ts).UTC()
 		key := bucket{
-			dateDir: tm.Format("2006-01-02"),
+			dateDir: layout.dir(tm),
 			minute:  tm.Format("15_04"),
 		}
 		if _, ok := groups[key]; !ok {
@@ -384,7 +903,7 @@ func writeCSV(uploadDir, symbol string, ticks []cedroTick) error {
 	}
 
 	for _, key := range order {
-		targetDir := filepath.Join(uploadDir, key.dateDir, symbol)
+		targetDir := filepath.Join(uploadDir, key.dateDir, sanitizeSymbol(symbol))
 		if err := os.MkdirAll(targetDir, 0o755); err != nil {
 			return err
 		}
@@ -395,25 +914,257 @@ func writeCSV(uploadDir, symbol string, ticks []cedroTick) error {
 		})
 
 		outPath := filepath.Join(targetDir, fmt.Sprintf("%s.csv", key.minute))
-		outFile, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		err := files.withFile(outPath, func(w *bufio.Writer, empty bool) error {
+			if rawFormat {
+				for _, tick := range entries {
+					line := fmt.Sprintf("%d|%s\n", tick.TimeMSC, trimQuoteFields(tick.Raw, rawFields))
+					if _, err := w.WriteString(line); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			writer := csv.NewWriter(w)
+			if empty {
+				if _, err := w.WriteString(csvSchemaLine); err != nil {
+					return err
+				}
+				if err := writer.Write([]string{"time_msc", "last", "bid", "ask", "volume"}); err != nil {
+					return err
+				}
+			}
+			for _, tick := range entries {
+				fields := parseQuoteFields(tick.Raw)
+				row := []string{strconv.FormatInt(tick.TimeMSC, 10), fields[quoteFieldLast], fields[quoteFieldBid], fields[quoteFieldAsk], fields[quoteFieldVolume]}
+				if err := writer.Write(row); err != nil {
+					return err
+				}
+			}
+			writer.Flush()
+			return writer.Error()
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, tick := range entries {
-			line := fmt.Sprintf("%d|%s\n", tick.TimeMSC, tick.Raw)
-			if _, err := outFile.WriteString(line); err != nil {
-				_ = outFile.Close()
-				return err
-			}
+	return nil
+}
+
+// sanitizeSymbol makes a feed symbol safe to use as a single directory name:
+// path separators and control characters become '_', and names that are
+// empty or only dots (".", "..") become "UNKNOWN".
+func sanitizeSymbol(symbol string) string {
+	symbol = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
 		}
+		return r
+	}, strings.TrimSpace(symbol))
+	if strings.Trim(symbol, ".") == "" {
+		return "UNKNOWN"
+	}
+	return symbol
+}
 
-		if err := outFile.Close(); err != nil {
-			return err
+// recentMessages keeps the last size raw messages per symbol so /debug/recent
+// can show what the feed sent without a packet capture. A nil
+// *recentMessages is disabled and ignores adds.
+type recentMessages struct {
+	mu       sync.Mutex
+	size     int
+	bySymbol map[string]*messageRing
+}
+
+// messageRing is a fixed-size ring; once full, each add overwrites the
+// oldest entry.
+type messageRing struct {
+	entries []recentMessage
+	next    int
+}
+
+type recentMessage struct {
+	Received string `json:"received"`
+	Raw      string `json:"raw"`
+}
+
+func newRecentMessages(size int) *recentMessages {
+	if size <= 0 {
+		return nil
+	}
+	return &recentMessages{size: size, bySymbol: make(map[string]*messageRing)}
+}
+
+func (r *recentMessages) add(symbol, raw string, received time.Time) {
+	if r == nil {
+		return
+	}
+	entry := recentMessage{Received: received.UTC().Format(time.RFC3339Nano), Raw: raw}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ring := r.bySymbol[symbol]
+	if ring == nil {
+		ring = &messageRing{entries: make([]recentMessage, 0, r.size)}
+		r.bySymbol[symbol] = ring
+	}
+	if len(ring.entries) < r.size {
+		ring.entries = append(ring.entries, entry)
+		return
+	}
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % r.size
+}
+
+// snapshot returns the buffered messages, oldest first, for symbol or for
+// every symbol when symbol is empty.
+func (r *recentMessages) snapshot(symbol string) map[string][]recentMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string][]recentMessage)
+	for name, ring := range r.bySymbol {
+		if symbol != "" && name != symbol {
+			continue
 		}
+		ordered := make([]recentMessage, 0, len(ring.entries))
+		ordered = append(ordered, ring.entries[ring.next:]...)
+		ordered = append(ordered, ring.entries[:ring.next]...)
+		out[name] = ordered
 	}
+	return out
+}
 
-	return nil
+// connectionStatus tracks the upstream connection lifecycle for /status.
+type connectionStatus struct {
+	mu         sync.Mutex
+	state      string
+	since      time.Time
+	reconnects int
+	backoff    time.Duration
+	lastError  string
+	// droppedTicks counts ticks the accumulator shed to stay under its cap.
+	droppedTicks int64
+	// unknownSymbols counts messages parseSymbol found no symbol in.
+	unknownSymbols int64
+}
+
+type connectionStatusResponse struct {
+	State          string `json:"state"`
+	Since          string `json:"since"`
+	Reconnects     int    `json:"reconnects"`
+	Backoff        string `json:"backoff,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	UnknownSymbols int64  `json:"unknown_symbols"`
+	DroppedTicks   int64  `json:"dropped_ticks"`
+}
+
+func newConnectionStatus() *connectionStatus {
+	return &connectionStatus{state: "starting", since: time.Now().UTC()}
+}
+
+func (c *connectionStatus) set(state string) {
+	c.mu.Lock()
+	c.state = state
+	c.since = time.Now().UTC()
+	if state == "connected" {
+		c.backoff = 0
+	}
+	c.mu.Unlock()
+}
+
+func (c *connectionStatus) backingOff(backoff time.Duration, err error) {
+	c.mu.Lock()
+	c.state = "backing-off"
+	c.since = time.Now().UTC()
+	c.backoff = backoff
+	if err != nil {
+		c.lastError = err.Error()
+	}
+	c.mu.Unlock()
+}
+
+func (c *connectionStatus) droppedTick() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.droppedTicks++
+	return c.droppedTicks
+}
+
+func (c *connectionStatus) reconnecting() {
+	c.mu.Lock()
+	c.reconnects++
+	c.mu.Unlock()
+}
+
+// unknownSymbol counts one message without a symbol and returns the total.
+func (c *connectionStatus) unknownSymbol() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unknownSymbols++
+	return c.unknownSymbols
+}
+
+func (c *connectionStatus) snapshot() connectionStatusResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := connectionStatusResponse{
+		State:          c.state,
+		Since:          c.since.Format(time.RFC3339),
+		Reconnects:     c.reconnects,
+		LastError:      c.lastError,
+		UnknownSymbols: c.unknownSymbols,
+		DroppedTicks:   c.droppedTicks,
+	}
+	if c.backoff > 0 {
+		resp.Backoff = c.backoff.String()
+	}
+	return resp
+}
+
+func serveStatus(addr string, status *connectionStatus, recent *recentMessages) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(status.snapshot())
+	})
+	if recent != nil {
+		mux.HandleFunc("/debug/recent", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			symbol := strings.TrimSpace(r.URL.Query().Get("symbol"))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(recent.snapshot(symbol))
+		})
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("status server failed: %v", err)
+	}
+}
+
+func envInt(key string, fallback int) int {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("invalid %s=%q, using %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
 }
 
 func init() {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrimQuoteFieldsKeepsLeadingPrice(t *testing.T) {
+	keep, err := parseRawFields("9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := trimQuoteFields("T:PETR4:103000:2:38.51:3:38.50:9:1200!", keep)
+	want := "T:PETR4:103000:2:38.51:9:1200!"
+	if got != want {
+		t.Fatalf("trimQuoteFields = %q, want %q", got, want)
+	}
+}
+
+// newTestAccumulator returns an accumulator without its flush loop, so the
+// test sees exactly what enforceLimit did.
+func newTestAccumulator(limit bufferLimit) *tickAccumulator {
+	return &tickAccumulator{
+		bySymbol: make(map[string][]cedroTick),
+		limit:    limit,
+		flushNow: make(chan struct{}, 1),
+	}
+}
+
+func TestTickAccumulatorDropsOldestPastCap(t *testing.T) {
+	var dropped int64
+	acc := newTestAccumulator(bufferLimit{maxTicks: 3, drop: true, onDrop: func() int64 { dropped++; return dropped }})
+	for i, symbol := range []string{"PETR4", "VALE3", "PETR4", "VALE3", "PETR4"} {
+		acc.Add(cedroTick{TimeMSC: int64(i), Symbol: symbol, Raw: "T:" + symbol})
+	}
+	if acc.buffered != 3 || dropped != 2 {
+		t.Fatalf("buffered %d, dropped %d; want 3 and 2", acc.buffered, dropped)
+	}
+	for _, entries := range acc.bySymbol {
+		for _, tick := range entries {
+			if tick.TimeMSC < 2 {
+				t.Errorf("tick %d kept, want the oldest dropped", tick.TimeMSC)
+			}
+		}
+	}
+	select {
+	case <-acc.flushNow:
+		t.Error("drop mode asked for a flush")
+	default:
+	}
+}
+
+func TestTickAccumulatorFlushesEarlyPastCap(t *testing.T) {
+	var dropped int64
+	acc := newTestAccumulator(bufferLimit{maxTicks: 3, onDrop: func() int64 { dropped++; return dropped }})
+	for i := 0; i < 4; i++ {
+		acc.Add(cedroTick{TimeMSC: int64(i), Symbol: "PETR4", Raw: "T:PETR4"})
+	}
+	select {
+	case <-acc.flushNow:
+	default:
+		t.Fatal("no early flush requested past the cap")
+	}
+	if dropped != 0 {
+		t.Fatalf("dropped %d ticks before twice the cap", dropped)
+	}
+	// With the flush stuck, ticks past twice the cap are dropped.
+	for i := 4; i < 8; i++ {
+		acc.Add(cedroTick{TimeMSC: int64(i), Symbol: "PETR4", Raw: "T:PETR4"})
+	}
+	if acc.buffered != 6 || dropped != 2 {
+		t.Fatalf("buffered %d, dropped %d; want 6 and 2", acc.buffered, dropped)
+	}
+}
+
+func TestSanitizeSymbolStaysInOneDir(t *testing.T) {
+	for _, symbol := range []string{"../etc", "..", ".", "a/b", `..\..\win`, "/abs", "x\x00y", "  ", ""} {
+		got := sanitizeSymbol(symbol)
+		if got == "" || strings.ContainsAny(got, `/\`) || strings.Trim(got, ".") == "" {
+			t.Errorf("sanitizeSymbol(%q) = %q", symbol, got)
+		}
+		if dir := filepath.Join("/upload", got); filepath.Dir(dir) != "/upload" {
+			t.Errorf("sanitizeSymbol(%q) = %q escapes the upload dir", symbol, got)
+		}
+	}
+	if got := sanitizeSymbol("PETR4"); got != "PETR4" {
+		t.Errorf("sanitizeSymbol(PETR4) = %q", got)
+	}
+}
+
+func TestFileCacheBuffersUntilFlushOrEviction(t *testing.T) {
+	dir := t.TempDir()
+	files := newFileCache(fileCacheConfig{bufferSize: 1 << 10, maxOpen: 1})
+	defer files.Close()
+	size := func(path string) int64 {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	write := func(path string) {
+		t.Helper()
+		err := files.withFile(path, func(w *bufio.Writer, _ bool) error {
+			_, err := w.WriteString("1709632800000|T:PETR4\n")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := filepath.Join(dir, "10_00.csv")
+	write(first)
+	if n := size(first); n != 0 {
+		t.Fatalf("%d bytes on disk before a flush, want 0", n)
+	}
+	files.Flush()
+	if n := size(first); n == 0 {
+		t.Fatal("Flush left the buffer unwritten")
+	}
+
+	write(first)
+	before := size(first)
+	// With one open handle allowed, opening a second file evicts the first.
+	write(filepath.Join(dir, "10_01.csv"))
+	if n := size(first); n <= before {
+		t.Fatal("eviction left the buffer unwritten")
+	}
+}
@@ -2,4 +2,9 @@ module market-visual-runner-bff
 
 go 1.22
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gorilla/websocket v1.5.3
+)
+
+require golang.org/x/sys v0.4.0 // indirect
@@ -2,22 +2,38 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"encoding/hex"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
 )
 
@@ -28,22 +44,173 @@ type statusResponse struct {
 	Version string `json:"version"`
 }
 
+type healthResponse struct {
+	Service        string             `json:"service"`
+	Status         string             `json:"status"`
+	Uptime         string             `json:"uptime"`
+	LastReloadAge  string             `json:"last_reload_age,omitempty"`
+	SymbolCount    int                `json:"symbol_count"`
+	ReloadFailures int                `json:"reload_failures"`
+	WSConnections  int64              `json:"ws_connections"`
+	Dependencies   []dependencyStatus `json:"dependencies"`
+}
+
+type dependencyStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// dataSourceStatus is what one DATA_DIRS root contributed to the latest
+// load. LoadedAt is the last load of this root that succeeded.
+type dataSourceStatus struct {
+	Dir         string `json:"dir"`
+	Exists      bool   `json:"exists"`
+	Readable    bool   `json:"readable"`
+	Error       string `json:"error,omitempty"`
+	SymbolCount int    `json:"symbol_count"`
+	FileCount   int    `json:"file_count"`
+	// SkippedFiles counts files that failed to ingest and were left out;
+	// LastSkipError is the most recent of those failures.
+	SkippedFiles  int    `json:"skipped_files"`
+	LastSkipError string `json:"last_skip_error,omitempty"`
+	LoadedAt      string `json:"loaded_at,omitempty"`
+}
+
 type timeframeResponse struct {
-	Start            string                 `json:"start"`
-	End              string                 `json:"end"`
-	Resolution       string                 `json:"resolution"`
-	FrameQuality     []symbolFrameQuality   `json:"frame_quality"`
+	Start        string               `json:"start"`
+	End          string               `json:"end"`
+	Resolution   string               `json:"resolution"`
+	FrameQuality []symbolFrameQuality `json:"frame_quality"`
+	ClosedDates  []string             `json:"closed_dates,omitempty"`
+	Generation   string               `json:"generation"`
+	NoData       bool                 `json:"no_data,omitempty"`
 }
 
+type timeframeUnchangedResponse struct {
+	Status     string `json:"status"`
+	Generation string `json:"generation"`
+}
+
+type generationResponse struct {
+	Generation string `json:"generation"`
+	LoadedAt   string `json:"loaded_at,omitempty"`
+}
+
+// clockResponse lets clients align their "now" with the server's and show
+// how fresh the loaded data is. The data fields are omitted until something
+// has been loaded.
+type clockResponse struct {
+	ServerTime     string `json:"server_time"`
+	ServerTimeMs   int64  `json:"server_time_ms"`
+	DataEnd        string `json:"data_end,omitempty"`
+	DataEndMs      int64  `json:"data_end_ms,omitempty"`
+	DataAgeSeconds *int64 `json:"data_age_seconds,omitempty"`
+}
+
+// symbolFrameQuality is one timeframe row. Source is set, to the root dir,
+// only when the timeframe was requested by_source.
 type symbolFrameQuality struct {
-	Symbol                string `json:"symbol"`
-	Quality               []int  `json:"quality"`
+	Symbol  string `json:"symbol"`
+	Source  string `json:"source,omitempty"`
+	Quality []int  `json:"quality"`
 }
 
+// priceOverviewResponse buckets are aligned so that bucket i starts at
+// FirstBucketEpoch + i*ResolutionSeconds (Unix seconds, UTC).
 type priceOverviewResponse struct {
-	Resolution string     `json:"resolution"`
-	Prices     []*float64 `json:"prices"`
-	Datetimes  []string   `json:"datetimes"`
+	Resolution        string     `json:"resolution"`
+	ResolutionLabel   string     `json:"resolution_label"`
+	ResolutionSeconds int        `json:"resolution_seconds"`
+	FirstBucketEpoch  int64      `json:"first_bucket_epoch"`
+	BucketCount       int        `json:"bucket_count"`
+	Start             string     `json:"start"`
+	End               string     `json:"end"`
+	Prices            []*float64 `json:"prices"`
+	Highs             []*float64 `json:"highs,omitempty"`
+	Lows              []*float64 `json:"lows,omitempty"`
+	// Secondary is aligned with Prices and holds SecondaryField from the
+	// same tick as each bucket's price; only set when requested.
+	SecondaryField string     `json:"secondary_field,omitempty"`
+	Secondary      []*float64 `json:"secondary,omitempty"`
+	Datetimes      []string   `json:"datetimes"`
+	// Volumes is aligned with Prices and sums the traded volume of the
+	// minutes in each bucket; omitted when no minute in range carries one.
+	Volumes []*int64 `json:"volumes,omitempty"`
+	// FirstPrice and LastPrice are the ticks nearest the range's edges,
+	// independent of bucketing; only set when anchors are requested.
+	FirstPrice *priceAnchor `json:"first_price,omitempty"`
+	LastPrice  *priceAnchor `json:"last_price,omitempty"`
+	// Truncated is set when the overview was coarsened from the requested
+	// resolution to fit BFF_MAX_RESPONSE_BYTES.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// priceAnchor is one minute's price, stamped with its latest tick.
+type priceAnchor struct {
+	Price    float64 `json:"price"`
+	Ts       int64   `json:"ts"`
+	Datetime string  `json:"datetime"`
+}
+
+// candleResponse holds one OHLC candle per bucket, aligned like
+// priceOverviewResponse; buckets without data are null in every series.
+type candleResponse struct {
+	ResolutionSeconds int        `json:"resolution_seconds"`
+	FirstBucketEpoch  int64      `json:"first_bucket_epoch"`
+	BucketCount       int        `json:"bucket_count"`
+	Start             string     `json:"start"`
+	End               string     `json:"end"`
+	Opens             []*float64 `json:"opens"`
+	Highs             []*float64 `json:"highs"`
+	Lows              []*float64 `json:"lows"`
+	Closes            []*float64 `json:"closes"`
+	Datetimes         []string   `json:"datetimes"`
+}
+
+type priceOverviewStringResponse struct {
+	Resolution        string       `json:"resolution"`
+	ResolutionLabel   string       `json:"resolution_label"`
+	ResolutionSeconds int          `json:"resolution_seconds"`
+	FirstBucketEpoch  int64        `json:"first_bucket_epoch"`
+	BucketCount       int          `json:"bucket_count"`
+	Start             string       `json:"start"`
+	End               string       `json:"end"`
+	Prices            []*string    `json:"prices"`
+	Highs             []*string    `json:"highs,omitempty"`
+	Lows              []*string    `json:"lows,omitempty"`
+	SecondaryField    string       `json:"secondary_field,omitempty"`
+	Secondary         []*string    `json:"secondary,omitempty"`
+	Datetimes         []string     `json:"datetimes"`
+	Volumes           []*int64     `json:"volumes,omitempty"`
+	FirstPrice        *priceAnchor `json:"first_price,omitempty"`
+	LastPrice         *priceAnchor `json:"last_price,omitempty"`
+	Truncated         bool         `json:"truncated,omitempty"`
+}
+
+// priceOverviewRunsResponse is price_overview with encoding "rle". Each of
+// Prices, Highs and Lows is a list of [price, count] pairs: count consecutive
+// buckets share price, which may be null. Expanding the runs in order gives
+// BucketCount values, and bucket i starts at FirstBucketEpoch +
+// i*ResolutionSeconds, so Datetimes is left out.
+type priceOverviewRunsResponse struct {
+	Resolution        string       `json:"resolution"`
+	ResolutionLabel   string       `json:"resolution_label"`
+	ResolutionSeconds int          `json:"resolution_seconds"`
+	FirstBucketEpoch  int64        `json:"first_bucket_epoch"`
+	BucketCount       int          `json:"bucket_count"`
+	Start             string       `json:"start"`
+	End               string       `json:"end"`
+	Encoding          string       `json:"encoding"`
+	Prices            [][2]any     `json:"prices"`
+	Highs             [][2]any     `json:"highs,omitempty"`
+	Lows              [][2]any     `json:"lows,omitempty"`
+	SecondaryField    string       `json:"secondary_field,omitempty"`
+	Secondary         [][2]any     `json:"secondary,omitempty"`
+	Volumes           [][2]any     `json:"volumes,omitempty"`
+	FirstPrice        *priceAnchor `json:"first_price,omitempty"`
+	LastPrice         *priceAnchor `json:"last_price,omitempty"`
+	Truncated         bool         `json:"truncated,omitempty"`
 }
 
 type timeframeCache struct {
@@ -72,18 +239,57 @@ type sessionManager struct {
 }
 
 type wsRequest struct {
-	Type       string   `json:"type"`
-	RequestID  string   `json:"request_id,omitempty"`
-	Symbol     string   `json:"symbol,omitempty"`
-	Symbols    []string `json:"symbols,omitempty"`
-	Start      string   `json:"start,omitempty"`
-	End        string   `json:"end,omitempty"`
-	RangeStart int      `json:"range_start,omitempty"`
-	RangeEnd   int      `json:"range_end,omitempty"`
-	ComputeMode *bool  `json:"compute_mode,omitempty"`
-	Resolution int      `json:"resolution,omitempty"`
-	Ticks      int      `json:"ticks,omitempty"`
-	State      *computeStatePayload `json:"state,omitempty"`
+	Type               string               `json:"type"`
+	RequestID          string               `json:"request_id,omitempty"`
+	Symbol             string               `json:"symbol,omitempty"`
+	Symbols            []string             `json:"symbols,omitempty"`
+	Start              string               `json:"start,omitempty"`
+	End                string               `json:"end,omitempty"`
+	RangeStart         int                  `json:"range_start,omitempty"`
+	RangeEnd           int                  `json:"range_end,omitempty"`
+	ComputeMode        *bool                `json:"compute_mode,omitempty"`
+	Resolution         int                  `json:"resolution,omitempty"`
+	Ticks              int                  `json:"ticks,omitempty"`
+	State              *computeStatePayload `json:"state,omitempty"`
+	Generation         string               `json:"generation,omitempty"`
+	PriceFormat        string               `json:"price_format,omitempty"`
+	PriceDecimals      *int                 `json:"price_decimals,omitempty"`
+	Timestamp          string               `json:"timestamp,omitempty"`
+	ToleranceSeconds   int                  `json:"tolerance_seconds,omitempty"`
+	Windows            []wsRangeWindow      `json:"windows,omitempty"`
+	Count              int                  `json:"count,omitempty"`
+	MinCoverageMinutes *int                 `json:"min_coverage_minutes,omitempty"`
+	IncludeExtremes    bool                 `json:"include_extremes,omitempty"`
+	Cursor             string               `json:"cursor,omitempty"`
+	TargetPoints       int                  `json:"target_points,omitempty"`
+	TrimEdges          bool                 `json:"trim_edges,omitempty"`
+	BySource           bool                 `json:"by_source,omitempty"`
+	Sort               string               `json:"sort,omitempty"`
+	Encoding           string               `json:"encoding,omitempty"`
+	MinPrice           *float64             `json:"min_price,omitempty"`
+	Secondary          string               `json:"secondary,omitempty"`
+	ChunkSize          int                  `json:"chunk_size,omitempty"`
+	Anchors            bool                 `json:"anchors,omitempty"`
+	Gridlines          int                  `json:"gridlines,omitempty"`
+	Marker             string               `json:"marker,omitempty"`
+	MarkerValue        *int                 `json:"marker_value,omitempty"`
+}
+
+type wsRangeWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type multiRangeWindowItem struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Data  any    `json:"data,omitempty"`
+}
+
+type multiRangeOverviewPayload struct {
+	Symbol            string                 `json:"symbol"`
+	ResolutionSeconds int                    `json:"resolution_seconds"`
+	Windows           []multiRangeWindowItem `json:"windows"`
 }
 
 type wsResponse struct {
@@ -93,53 +299,422 @@ type wsResponse struct {
 	Message   string `json:"message,omitempty"`
 }
 
+// overviewStreamDone ends a price_overview_stream. Chunks counts the
+// price_overview_chunk messages sent; chunks without data are skipped.
+type overviewStreamDone struct {
+	Symbol      string `json:"symbol"`
+	BucketCount int    `json:"bucket_count"`
+	Chunks      int    `json:"chunks"`
+	Done        bool   `json:"done"`
+	Cancelled   bool   `json:"cancelled,omitempty"`
+}
+
 type wsPriceOverviewItem struct {
-	Symbol string                `json:"symbol"`
-	Data   *priceOverviewResponse `json:"data,omitempty"`
+	Symbol string `json:"symbol"`
+	Data   any    `json:"data,omitempty"`
 }
 
 type wsIncreaseResolutionPayload struct {
-	ResolutionSeconds int                  `json:"resolution_seconds"`
+	ResolutionSeconds int                   `json:"resolution_seconds"`
+	TicksRequested    int                   `json:"ticks_requested"`
+	Clamped           bool                  `json:"clamped,omitempty"`
 	Items             []wsPriceOverviewItem `json:"items"`
 }
 
 type computeStatePayload struct {
-	ComputeMode bool           `json:"compute_mode"`
-	RangeStart  int            `json:"range_start"`
-	RangeEnd    int            `json:"range_end"`
-	Markers     map[string]int `json:"markers,omitempty"`
-	TicksRequested int         `json:"ticks_requested"`
-	LastSymbol     string      `json:"last_symbol,omitempty"`
-	RangeStartTime string      `json:"range_start_time,omitempty"`
-	RangeEndTime   string      `json:"range_end_time,omitempty"`
-	Resolution     string      `json:"resolution,omitempty"`
-	CustomResolutionSeconds int `json:"custom_resolution_seconds,omitempty"`
+	ComputeMode             bool           `json:"compute_mode"`
+	RangeStart              int            `json:"range_start"`
+	RangeEnd                int            `json:"range_end"`
+	Markers                 map[string]int `json:"markers,omitempty"`
+	TicksRequested          int            `json:"ticks_requested"`
+	LastSymbol              string         `json:"last_symbol,omitempty"`
+	RangeStartTime          string         `json:"range_start_time,omitempty"`
+	RangeEndTime            string         `json:"range_end_time,omitempty"`
+	Resolution              string         `json:"resolution,omitempty"`
+	CustomResolutionSeconds int            `json:"custom_resolution_seconds,omitempty"`
 }
 
 type dataStore struct {
 	mu              sync.RWMutex
-	startTS         int64
-	endTS           int64
+	ingest          ingestConfig
+	minCoverage     int
+	boot            string
+	reloadFailures  int
+	loadConcurrency int
+	calendar        tradingCalendar
+	// emptyRange is the window the timeframe reports, ending now, while no
+	// symbol has data; set from BFF_EMPTY_RANGE.
+	emptyRange time.Duration
+	// minPrice is the default price floor for overviews: minutes priced at
+	// or below it are gaps. Requests override it with min_price.
+	minPrice   *float64
+	sourceDirs []string
+	sources    []dataSourceStatus
+	// data is the published snapshot; readers load it once per request and
+	// never block on a reload.
+	data atomic.Pointer[storeData]
+	// publishMu serializes swap and mergeFiles, so a merge built on one
+	// snapshot can't replace a reload published after it was read.
+	publishMu sync.Mutex
+}
+
+const storeShardCount = 16
+
+// storeData is one loaded generation: the shards together with the range
+// and generation they make up. It is never modified once published; swap
+// and mergeFiles build a new one and replace the pointer, so a reader sees
+// shards and bounds from the same load.
+type storeData struct {
+	shards     [storeShardCount]storeShard
+	startTS    int64
+	endTS      int64
+	generation uint64
+	loadedAt   time.Time
+}
+
+// storeShard holds the per-symbol maps for the symbols that hash to it, so a
+// merge only copies the shards its symbols land in.
+type storeShard struct {
 	qualityBySymbol map[string]map[int64]bool
 	priceBySymbol   map[string]map[int64]minutePrice
 }
 
+const (
+	protocolV1 = "mvr.v1"
+	protocolV2 = "mvr.v2"
+)
+
+var supportedSubprotocols = []string{protocolV2, protocolV1}
+
+const (
+	defaultResolutionSeconds = 300
+	defaultRange             = 60 * time.Minute
+	defaultIncreaseTicks     = 5000
+	maxIncreaseBuckets       = 20000
+	maxOverviewBuckets       = 20000
+	rejectIncreaseFactor     = 100 // ticks above BFF_MAX_INCREASE_TICKS times this are rejected, not clamped
+	defaultPriceAtTolerance  = 5 * time.Minute
+	maxRangeWindows          = 20
+	maxMultiRangeBuckets     = 100000
+	defaultRecentPrices      = 60
+	maxRecentPrices          = 10000
+	maxSnapshotSymbols       = 50
+	defaultMaxBatchSymbols   = 200
+	defaultMaxFileBytes      = 256 << 20
+	maxReplayBytes           = 32 << 20
+	defaultWSIdleTimeout     = 2 * time.Minute
+	maxSourceDirs            = 32
+	defaultTopMovers         = 10
+	maxTopMovers             = 100
+	defaultStreamChunk       = 500
+	maxStreamChunk           = 5000
+	maxMarkers               = 500
+	maxGridlines             = 50
+	maxMarkerKeyLen          = 64
+)
+
+type rangePreviewResponse struct {
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	HasData     bool   `json:"has_data"`
+	SymbolCount int    `json:"symbol_count"`
+	FileCount   int    `json:"file_count"`
+}
+
+type priceAtResponse struct {
+	Symbol        string   `json:"symbol"`
+	Timestamp     string   `json:"timestamp"`
+	Status        string   `json:"status"`
+	Price         *float64 `json:"price,omitempty"`
+	Datetime      string   `json:"datetime,omitempty"`
+	OffsetSeconds *float64 `json:"offset_seconds,omitempty"`
+}
+
+type recentPricesResponse struct {
+	Symbol     string    `json:"symbol"`
+	Prices     []float64 `json:"prices"`
+	Datetimes  []string  `json:"datetimes"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+type sourceCoverageResponse struct {
+	Start   string               `json:"start"`
+	End     string               `json:"end"`
+	Sources []string             `json:"sources"`
+	Symbols []sourceCoverageItem `json:"symbols"`
+}
+
+// sourceCoverageItem counts covered minutes per root dir. Minutes is
+// aligned with sourceCoverageResponse.Sources; AllSources counts the minutes
+// every source covered.
+type sourceCoverageItem struct {
+	Symbol       string `json:"symbol"`
+	TotalMinutes int    `json:"total_minutes"`
+	AllSources   int    `json:"all_sources_minutes"`
+	Minutes      []int  `json:"minutes_by_source"`
+	// Won counts, per source, the minutes whose price came from it.
+	Won []int `json:"won_by_source"`
+}
+
+// downsamplePreviewResponse sizes a price_overview without building it:
+// BucketCount and NonNullCount match len(prices) and its non-null entries.
+type downsamplePreviewResponse struct {
+	Symbol            string `json:"symbol"`
+	ResolutionSeconds int    `json:"resolution_seconds"`
+	Start             string `json:"start"`
+	End               string `json:"end"`
+	BucketCount       int    `json:"bucket_count"`
+	NonNullCount      int    `json:"non_null_count"`
+}
+
+type symbolStatsResponse struct {
+	Symbol       string  `json:"symbol"`
+	Count        int     `json:"count"`
+	Mean         float64 `json:"mean"`
+	StdDev       float64 `json:"stddev"`
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	First        float64 `json:"first"`
+	Last         float64 `json:"last"`
+	LastDatetime string  `json:"last_datetime"`
+}
+
+// symbolMove is one symbol's change between its first and last minute price
+// in a range.
+type symbolMove struct {
+	Symbol        string  `json:"symbol"`
+	First         float64 `json:"first"`
+	Last          float64 `json:"last"`
+	ChangePercent float64 `json:"change_percent"`
+}
+
+type topMoversResponse struct {
+	Start   string       `json:"start"`
+	End     string       `json:"end"`
+	Gainers []symbolMove `json:"gainers"`
+	Losers  []symbolMove `json:"losers"`
+}
+
+type chartHintsResponse struct {
+	Symbol    string    `json:"symbol"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	AxisMin   float64   `json:"axis_min"`
+	AxisMax   float64   `json:"axis_max"`
+	Step      float64   `json:"step"`
+	Gridlines []float64 `json:"gridlines"`
+}
+
+type snapshotResponse struct {
+	Generation string           `json:"generation"`
+	Symbols    []snapshotSymbol `json:"symbols"`
+}
+
+type snapshotSymbol struct {
+	Symbol  string          `json:"symbol"`
+	Minutes []snapshotPoint `json:"minutes"`
+}
+
+type snapshotPoint struct {
+	Minute int64   `json:"minute"`
+	TS     int64   `json:"ts"`
+	Price  float64 `json:"price"`
+}
+
+type clientConfigResponse struct {
+	Protocol                 string   `json:"protocol"`
+	DefaultResolutionSeconds int      `json:"default_resolution_seconds"`
+	DefaultRangeSeconds      int      `json:"default_range_seconds"`
+	MinResolutionSeconds     int      `json:"min_resolution_seconds"`
+	MaxResolutionSeconds     int      `json:"max_resolution_seconds"`
+	AllowedResolutions       []int    `json:"allowed_resolutions"`
+	DefaultIncreaseTicks     int      `json:"default_increase_ticks"`
+	MaxIncreaseTicks         int      `json:"max_increase_ticks"`
+	MaxBuckets               int      `json:"max_buckets"`
+	FillModes                []string `json:"fill_modes"`
+	SymbolCount              int      `json:"symbol_count"`
+	Features                 []string `json:"features"`
+}
+
+var (
+	errNoReadableDataDirs = errors.New("no data dir is readable")
+	errEmptyReload        = errors.New("reload found no data; keeping previous data")
+	errFileTooLarge       = errors.New("file exceeds BFF_MAX_FILE_BYTES")
+)
+
+type ingestConfig struct {
+	priceFields     []string
+	ignoreDirs      []string
+	jsonTimeFields  []string
+	jsonPriceFields []string
+	// jsonVolumeFields are the JSON tick fields holding the tick's size,
+	// first present wins; set from BFF_JSON_VOLUME_FIELDS.
+	jsonVolumeFields []string
+	symbolFilter     map[string]bool
+	symbolRenames    map[string]string
+	priceFormulas    map[string]priceFormula
+	maxFileBytes     int64
+	// columnTimeUnits overrides timestamp unit detection for a time column
+	// or JSON field; sourceTimeUnits does so per root dir index.
+	columnTimeUnits map[string]timeUnit
+	sourceTimeUnits map[int]timeUnit
+	sourceTimeUnit  timeUnit
+	// sourceRanks orders root dirs by BFF_SOURCE_PRIORITY; sourceRank is
+	// the current root's entry.
+	sourceRanks map[int]uint8
+	sourceRank  uint8
+	// strict makes a file that fails to ingest fail the whole load, as it
+	// did before; otherwise the file is skipped. Set from BFF_STRICT_INGEST.
+	strict bool
+	// minPrice drops ticks priced at or below it; set from
+	// BFF_INGEST_MIN_PRICE, nil keeps every tick.
+	minPrice *float64
+	// secondaryField is the price field (last, bid, ask or mid) kept per
+	// minute next to the primary price, for price_overview's secondary
+	// series. Set from BFF_SECONDARY_PRICE; empty keeps none.
+	secondaryField string
+	// symbolCase folds symbol names to "upper" or "lower" case at ingest and
+	// lookup, so "ewz" finds EWZ. Set from BFF_SYMBOL_CASE; empty keeps
+	// names as stored.
+	symbolCase string
+	// source is the bit for the root dir currently being loaded; the
+	// loaders set it on their own copy of the config.
+	source uint32
+}
+
+var defaultPriceFields = []string{"last", "bid", "ask"}
+
+// effectiveConfig is the resolved configuration served by GET /config.
+// Tokens are reported only as set or not.
+type effectiveConfig struct {
+	Addr               string            `json:"addr"`
+	Version            string            `json:"version"`
+	AllowedOrigins     []string          `json:"allowed_origins"`
+	DataDirs           []string          `json:"data_dirs"`
+	CacheTTL           string            `json:"cache_ttl"`
+	RefreshInterval    string            `json:"refresh_interval"`
+	Watch              bool              `json:"watch"`
+	WatchDebounce      string            `json:"watch_debounce"`
+	RequestTimeout     string            `json:"request_timeout"`
+	WSIdleTimeout      string            `json:"ws_idle_timeout"`
+	FieldCase          string            `json:"field_case"`
+	MaxBatchSymbols    int               `json:"max_batch_symbols"`
+	MaxIncreaseTicks   int               `json:"max_increase_ticks"`
+	MaxResponseBytes   int               `json:"max_response_bytes,omitempty"`
+	WSCompression      bool              `json:"ws_compression"`
+	MaxReloadFailures  int               `json:"max_reload_failures"`
+	MinCoverage        int               `json:"min_coverage_minutes"`
+	LoadConcurrency    int               `json:"load_concurrency"`
+	EmptyRange         string            `json:"empty_range"`
+	MinPrice           *float64          `json:"min_price"`
+	IngestMinPrice     *float64          `json:"ingest_min_price"`
+	SourcePriority     []string          `json:"source_priority,omitempty"`
+	SecondaryPrice     string            `json:"secondary_price,omitempty"`
+	SymbolCase         string            `json:"symbol_case,omitempty"`
+	StrictIngest       bool              `json:"strict_ingest"`
+	MaxFileBytes       int64             `json:"max_file_bytes"`
+	PriceFields        []string          `json:"price_fields"`
+	PriceFormulas      map[string]string `json:"price_formulas"`
+	ColumnTimeUnits    map[string]string `json:"column_time_units"`
+	SourceTimeUnits    map[string]string `json:"source_time_units"`
+	CalendarFile       string            `json:"calendar_file"`
+	ClosedDates        []string          `json:"closed_dates"`
+	ExportCSVDelimiter string            `json:"export_csv_delimiter"`
+	ExportCSVQuote     string            `json:"export_csv_quote"`
+	IgnoreDirs         []string          `json:"ignore_dirs"`
+	JSONTimeFields     []string          `json:"json_time_fields"`
+	JSONPriceFields    []string          `json:"json_price_fields"`
+	JSONVolumeFields   []string          `json:"json_volume_fields"`
+	SymbolFilter       []string          `json:"symbol_filter"`
+	SymbolRenames      map[string]string `json:"symbol_renames"`
+	Features           []string          `json:"features"`
+	TraceSpans         bool              `json:"trace_spans"`
+	DebugReplay        bool              `json:"debug_replay"`
+	SnapshotTokenSet   bool              `json:"snapshot_token_set"`
+	AdminTokenSet      bool              `json:"admin_token_set"`
+}
+
 func main() {
 	start := time.Now().UTC()
 	port := envOrDefault("PORT", "8080")
+	bindAddr := strings.TrimSpace(os.Getenv("BIND_ADDR"))
+	addr := net.JoinHostPort(bindAddr, port)
 	version := envOrDefault("APP_VERSION", "dev")
 	allowedOrigins := parseOrigins(envOrDefault("BFF_ALLOWED_ORIGINS", "*"))
 	dataDirs := parseDirs(envOrDefault("DATA_DIRS", "/data/cedro-ticker-uploader,/data/massive-ticker-uploader"))
 	cacheTTL := time.Minute
 	refreshInterval := 30 * time.Minute
 	cache := &timeframeCache{}
-	store := newDataStore()
+	sourceUnitsByDir := parseTimeUnits(envOrDefault("BFF_SOURCE_TIME_UNITS", ""))
+	ingest := ingestConfig{
+		priceFields:      parsePriceFields(envOrDefault("BFF_PRICE_PRIORITY", strings.Join(defaultPriceFields, ","))),
+		ignoreDirs:       parseDirs(envOrDefault("BFF_IGNORE_DIRS", "")),
+		jsonTimeFields:   parseDirs(envOrDefault("BFF_JSON_TIME_FIELDS", "t,time_msc,timestamp")),
+		jsonPriceFields:  parseDirs(envOrDefault("BFF_JSON_PRICE_FIELDS", "p,price,last")),
+		jsonVolumeFields: parseDirs(envOrDefault("BFF_JSON_VOLUME_FIELDS", "s,volume,size")),
+		symbolFilter:     parseSymbolFilter(envOrDefault("BFF_SYMBOL_FILTER", "")),
+		symbolRenames:    parseSymbolRenames(envOrDefault("BFF_SYMBOL_RENAMES", "")),
+		priceFormulas:    parsePriceFormulas(envOrDefault("BFF_PRICE_FORMULAS", "")),
+		maxFileBytes:     int64(envIntOrDefault("BFF_MAX_FILE_BYTES", defaultMaxFileBytes)),
+		columnTimeUnits:  parseTimeUnits(envOrDefault("BFF_COLUMN_TIME_UNITS", "")),
+		sourceTimeUnits:  sourceTimeUnits(dataDirs, sourceUnitsByDir),
+		sourceRanks:      sourceRanks(dataDirs, parseDirs(envOrDefault("BFF_SOURCE_PRIORITY", ""))),
+		minPrice:         envPriceFloor("BFF_INGEST_MIN_PRICE"),
+		strict:           strings.EqualFold(envOrDefault("BFF_STRICT_INGEST", ""), "true"),
+	}
+	if value := strings.ToLower(strings.TrimSpace(os.Getenv("BFF_SECONDARY_PRICE"))); value != "" {
+		switch value {
+		case "mid", "last", "bid", "ask":
+			ingest.secondaryField = value
+		default:
+			log.Fatalf("invalid BFF_SECONDARY_PRICE: %q", value)
+		}
+	}
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("BFF_SYMBOL_CASE"))); value {
+	case "", "exact":
+	case "upper", "lower":
+		ingest.symbolCase = value
+		ingest.symbolFilter = foldSymbolKeys(ingest.symbolFilter, ingest.foldSymbol)
+		ingest.priceFormulas = foldSymbolKeys(ingest.priceFormulas, ingest.foldSymbol)
+	default:
+		log.Fatalf("invalid BFF_SYMBOL_CASE: %q", value)
+	}
+	store := newDataStore(ingest)
+	store.minCoverage = envIntOrDefault("BFF_MIN_COVERAGE_MINUTES", 0)
+	store.loadConcurrency = envIntOrDefault("BFF_LOAD_CONCURRENCY", 4)
+	calendarFile := envOrDefault("BFF_CALENDAR_FILE", "")
+	calendar, err := loadTradingCalendar(calendarFile, envOrDefault("BFF_CLOSED_DATES", ""))
+	if err != nil {
+		log.Fatalf("invalid trading calendar: %v", err)
+	}
+	store.calendar = calendar
+	store.emptyRange = envDurationOrDefault("BFF_EMPTY_RANGE", 0)
+	store.minPrice = envPriceFloor("BFF_MIN_PRICE")
+	exportFormat, err := parseCSVFormat(os.Getenv("BFF_EXPORT_CSV_DELIMITER"), os.Getenv("BFF_EXPORT_CSV_QUOTE"))
+	if err != nil {
+		log.Fatalf("invalid export CSV format: %v", err)
+	}
+	fieldCase, ok := parseFieldCase(envOrDefault("BFF_FIELD_CASE", fieldCaseSnake))
+	if !ok {
+		log.Fatalf("invalid BFF_FIELD_CASE: %q", os.Getenv("BFF_FIELD_CASE"))
+	}
 	sessions := newSessionManager()
 
 	if err := store.loadFromDirs(dataDirs); err != nil {
 		log.Printf("failed to preload data: %v", err)
 	}
-	go startDataReloader(refreshInterval, dataDirs, store, cache)
+	warmTimeframeCache(store, cache)
+	maxReloadFailures := envIntOrDefault("BFF_MAX_RELOAD_FAILURES", 3)
+	watch := strings.EqualFold(envOrDefault("BFF_WATCH", ""), "true")
+	debounce := envDurationOrDefault("BFF_WATCH_DEBOUNCE", 2*time.Second)
+	if watch {
+		if err := startDataWatcher(dataDirs, debounce, store, cache); err != nil {
+			log.Printf("could not watch data dirs, falling back to polling: %v", err)
+			go startDataReloader(refreshInterval, dataDirs, store, cache)
+		}
+	} else {
+		go startDataReloader(refreshInterval, dataDirs, store, cache)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -147,9 +722,19 @@ func main() {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+		resp := buildHealth(start, store, dataDirs, maxReloadFailures)
+		w.Header().Set("X-Data-Generation", store.generationToken())
+		status := http.StatusOK
+		if resp.Status == "down" {
+			status = http.StatusServiceUnavailable
+		}
+		if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(resp.Status))
+			return
+		}
+		writeJSON(w, status, resp)
 	})
 
 	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
@@ -168,7 +753,220 @@ func main() {
 		writeJSON(w, http.StatusOK, resp)
 	})
 
-	mux.HandleFunc("/ws", handleWebsocket(store, cache, cacheTTL, allowedOrigins, dataDirs, sessions))
+	mux.HandleFunc("/export/daily", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		symbol := strings.TrimSpace(r.URL.Query().Get("symbol"))
+		if symbol == "" {
+			http.Error(w, "missing symbol", http.StatusBadRequest)
+			return
+		}
+		day, ok := parseDirDate(strings.TrimSpace(r.URL.Query().Get("date")))
+		if !ok {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		if notModified(w, r, store.generationToken()) {
+			return
+		}
+		rows := store.buildDailyGrid(symbol, day)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		// symbol is user input; FormatMediaType quotes or encodes it.
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": symbol + "_" + day.Format("2006-01-02") + ".csv"}))
+		w.WriteHeader(http.StatusOK)
+		writer := exportFormat.newWriter(w)
+		_ = writer.Write([]string{"datetime", "price", "trading"})
+		for _, row := range rows {
+			_ = writer.Write(row)
+		}
+		writer.Flush()
+	})
+
+	snapshotToken := strings.TrimSpace(os.Getenv("BFF_SNAPSHOT_TOKEN"))
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if snapshotToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !bearerAuthorized(r, snapshotToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		symbols := parseDirs(r.URL.Query().Get("symbols"))
+		if len(symbols) == 0 {
+			http.Error(w, "symbols query parameter is required", http.StatusBadRequest)
+			return
+		}
+		if len(symbols) > maxSnapshotSymbols {
+			http.Error(w, fmt.Sprintf("at most %d symbols per snapshot", maxSnapshotSymbols), http.StatusBadRequest)
+			return
+		}
+
+		if notModified(w, r, store.generationToken()) {
+			return
+		}
+		snapshot := store.buildSnapshot(symbols)
+		var body any = snapshot
+		if fieldCaseFor(r, fieldCase) == fieldCaseCamel {
+			body = camelCaseJSON{value: snapshot}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("X-Data-Generation", snapshot.Generation)
+		w.WriteHeader(http.StatusOK)
+		gz := gzip.NewWriter(w)
+		if err := json.NewEncoder(gz).Encode(body); err != nil {
+			log.Printf("snapshot encode failed: %v", err)
+		}
+		_ = gz.Close()
+	})
+
+	debugReplay := strings.EqualFold(envOrDefault("BFF_DEBUG_REPLAY", ""), "true")
+	if debugReplay {
+		mux.HandleFunc("/debug/replay", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			symbol := strings.TrimSpace(r.URL.Query().Get("symbol"))
+			if symbol == "" || symbol != filepath.Base(symbol) || symbol == "." || symbol == ".." {
+				http.Error(w, "symbol must be a plain directory name", http.StatusBadRequest)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxReplayBytes)
+			snapshot, err := replayFile(ingest, symbol, r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("replay failed: %v", err), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, snapshot)
+		})
+	}
+
+	adminToken := strings.TrimSpace(os.Getenv("BFF_ADMIN_TOKEN"))
+	mux.HandleFunc("/session/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !bearerAuthorized(r, adminToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := strings.TrimSpace(r.URL.Query().Get("id"))
+		if id == "" {
+			http.Error(w, "missing id", http.StatusBadRequest)
+			return
+		}
+		if !sessions.deleteState(id) {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		w.Header().Add("Set-Cookie", expireSessionCookie())
+		writeJSON(w, http.StatusOK, map[string]string{"status": "purged", "id": id})
+	})
+
+	traceSpans = strings.EqualFold(envOrDefault("BFF_TRACE_SPANS", ""), "true")
+	requestTimeout := envDurationOrDefault("BFF_REQUEST_TIMEOUT", 10*time.Second)
+	maxBatchSymbols := envIntOrDefault("BFF_MAX_BATCH_SYMBOLS", defaultMaxBatchSymbols)
+	if maxBatchSymbols < 0 {
+		log.Fatalf("invalid BFF_MAX_BATCH_SYMBOLS: must not be negative, got %d", maxBatchSymbols)
+	}
+	if maxBatchSymbols == 0 {
+		maxBatchSymbols = defaultMaxBatchSymbols
+	}
+	maxResponseBytes := envIntOrDefault("BFF_MAX_RESPONSE_BYTES", 0)
+	wsCompression := strings.EqualFold(envOrDefault("BFF_WS_COMPRESSION", ""), "true")
+	maxIncreaseTicks := envIntOrDefault("BFF_MAX_INCREASE_TICKS", maxIncreaseBuckets)
+	if maxIncreaseTicks <= 0 || maxIncreaseTicks > maxIncreaseBuckets {
+		log.Fatalf("invalid BFF_MAX_INCREASE_TICKS: must be 1-%d, got %d", maxIncreaseBuckets, maxIncreaseTicks)
+	}
+	features := parseFeatures(envOrDefault("BFF_FEATURES", ""))
+	wsIdleTimeout := envDurationOrDefault("BFF_WS_IDLE_TIMEOUT", defaultWSIdleTimeout)
+	// The ping ticker runs every wsIdleTimeout/2, which must not be zero.
+	if wsIdleTimeout < 2*time.Nanosecond {
+		log.Fatalf("invalid BFF_WS_IDLE_TIMEOUT: must be at least 2ns, got %s", wsIdleTimeout)
+	}
+	mux.HandleFunc("/ws", handleWebsocket(store, cache, cacheTTL, requestTimeout, wsIdleTimeout, maxBatchSymbols, maxIncreaseTicks, maxResponseBytes, wsCompression, fieldCase, features, allowedOrigins, dataDirs, sessions, adminToken))
+
+	effective := effectiveConfig{
+		Addr:               addr,
+		Version:            version,
+		AllowedOrigins:     allowedOrigins,
+		DataDirs:           dataDirs,
+		CacheTTL:           cacheTTL.String(),
+		RefreshInterval:    refreshInterval.String(),
+		Watch:              watch,
+		WatchDebounce:      debounce.String(),
+		RequestTimeout:     requestTimeout.String(),
+		WSIdleTimeout:      wsIdleTimeout.String(),
+		FieldCase:          fieldCase,
+		MaxBatchSymbols:    maxBatchSymbols,
+		MaxIncreaseTicks:   maxIncreaseTicks,
+		MaxResponseBytes:   maxResponseBytes,
+		WSCompression:      wsCompression,
+		MaxReloadFailures:  maxReloadFailures,
+		MinCoverage:        store.minCoverage,
+		LoadConcurrency:    store.loadConcurrency,
+		EmptyRange:         store.emptyRange.String(),
+		MinPrice:           store.minPrice,
+		IngestMinPrice:     ingest.minPrice,
+		SourcePriority:     parseDirs(envOrDefault("BFF_SOURCE_PRIORITY", "")),
+		SecondaryPrice:     ingest.secondaryField,
+		SymbolCase:         ingest.symbolCase,
+		StrictIngest:       ingest.strict,
+		MaxFileBytes:       ingest.maxFileBytes,
+		PriceFields:        ingest.priceFields,
+		PriceFormulas:      make(map[string]string, len(ingest.priceFormulas)),
+		ColumnTimeUnits:    formatTimeUnits(ingest.columnTimeUnits),
+		SourceTimeUnits:    formatTimeUnits(sourceUnitsByDir),
+		CalendarFile:       calendarFile,
+		ClosedDates:        calendar.dates(),
+		ExportCSVDelimiter: string(exportFormat.delimiter),
+		ExportCSVQuote:     exportFormat.quotePolicy(),
+		IgnoreDirs:         ingest.ignoreDirs,
+		JSONTimeFields:     ingest.jsonTimeFields,
+		JSONPriceFields:    ingest.jsonPriceFields,
+		JSONVolumeFields:   ingest.jsonVolumeFields,
+		SymbolRenames:      ingest.symbolRenames,
+		Features:           features.active(),
+		TraceSpans:         traceSpans,
+		DebugReplay:        debugReplay,
+		SnapshotTokenSet:   snapshotToken != "",
+		AdminTokenSet:      adminToken != "",
+	}
+	for symbol := range ingest.symbolFilter {
+		effective.SymbolFilter = append(effective.SymbolFilter, symbol)
+	}
+	for symbol, formula := range ingest.priceFormulas {
+		effective.PriceFormulas[symbol] = formula.String()
+	}
+	sort.Strings(effective.SymbolFilter)
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !bearerAuthorized(r, adminToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, effective)
+	})
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -183,1019 +981,4938 @@ func main() {
 	})
 
 	server := &http.Server{
-		Addr:              ":" + port,
-		Handler:           withCORS(mux, allowedOrigins),
+		Addr:              addr,
+		Handler:           withTrace(withCORS(withGzip(mux), allowedOrigins)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	log.Printf("market-visual-runner-bff listening on :%s", port)
+	log.Printf("market-visual-runner-bff listening on %s", addr)
 	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server failed: %v", err)
 	}
 }
 
-func withCORS(next http.Handler, allowedOrigins []string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin != "" && originAllowed(origin, allowedOrigins) {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Vary", "Origin")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		}
+// buildHealth reports "ok" when every data dir is readable, "degraded" when
+// only some are, and "down" when none are or the last maxReloadFailures
+// reloads all failed.
+func buildHealth(start time.Time, store *dataStore, dataDirs []string, maxReloadFailures int) healthResponse {
+	resp := healthResponse{
+		Service:        "market-visual-runner-bff",
+		Uptime:         time.Since(start).Truncate(time.Second).String(),
+		SymbolCount:    len(store.listSymbols()),
+		ReloadFailures: store.consecutiveReloadFailures(),
+		WSConnections:  wsConnections.Load(),
+		Dependencies:   make([]dependencyStatus, 0, len(dataDirs)),
+	}
+	if loadedAt := store.lastLoadedAt(); !loadedAt.IsZero() {
+		resp.LastReloadAge = time.Since(loadedAt).Truncate(time.Second).String()
+	}
 
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
+	readable := 0
+	for _, dir := range dataDirs {
+		dep := dependencyStatus{Name: dir, Status: "ok"}
+		if _, err := os.ReadDir(dir); err != nil {
+			dep.Status = "error"
+			dep.Error = err.Error()
+		} else {
+			readable++
 		}
+		resp.Dependencies = append(resp.Dependencies, dep)
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	switch {
+	case maxReloadFailures > 0 && resp.ReloadFailures >= maxReloadFailures:
+		resp.Status = "down"
+	case readable == len(dataDirs):
+		resp.Status = "ok"
+	case readable > 0:
+		resp.Status = "degraded"
+	default:
+		resp.Status = "down"
+	}
+	return resp
 }
 
-func handleWebsocket(store *dataStore, cache *timeframeCache, cacheTTL time.Duration, allowedOrigins []string, dataDirs []string, sessions *sessionManager) http.HandlerFunc {
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  4096,
-		WriteBufferSize: 4096,
-		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header.Get("Origin")
-			if origin == "" {
-				return true
-			}
-			return originAllowed(origin, allowedOrigins)
-		},
+const (
+	fieldCaseSnake = "snake"
+	fieldCaseCamel = "camel"
+)
+
+func parseFieldCase(value string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case fieldCaseSnake:
+		return fieldCaseSnake, true
+	case fieldCaseCamel:
+		return fieldCaseCamel, true
 	}
+	return "", false
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		sessionID, created := sessions.getOrCreateID(r)
-		headers := http.Header{}
-		if created {
-			headers.Add("Set-Cookie", buildSessionCookie(sessionID))
+// fieldCaseFor picks the response key casing for r: a field_case query
+// parameter, then a field-case parameter on any Accept media range (e.g.
+// "application/json; field-case=camel"), then fallback.
+func fieldCaseFor(r *http.Request, fallback string) string {
+	if value := r.URL.Query().Get("field_case"); value != "" {
+		if fieldCase, ok := parseFieldCase(value); ok {
+			return fieldCase
 		}
-		conn, err := upgrader.Upgrade(w, r, headers)
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(accept)
 		if err != nil {
-			log.Printf("ws upgrade failed: %v", err)
-			return
+			continue
 		}
-		defer conn.Close()
-
-		for {
-			var msg wsRequest
-			if err := conn.ReadJSON(&msg); err != nil {
-				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-					return
-				}
-				log.Printf("ws read error: %v", err)
-				return
-			}
+		if fieldCase, ok := parseFieldCase(params["field-case"]); ok {
+			return fieldCase
+		}
+	}
+	return fallback
+}
 
-			switch strings.TrimSpace(msg.Type) {
-			case "state_get":
-				state := sessions.getState(sessionID)
-				_ = conn.WriteJSON(wsResponse{Type: "state", RequestID: msg.RequestID, Data: state})
+// camelCaseJSON marshals value as encoding/json would, except struct fields
+// are keyed by the camelCase form of their json tag. Map keys are data
+// (symbols, mostly) and are left alone.
+type camelCaseJSON struct {
+	value any
+}
 
-			case "state_update":
-				if msg.State == nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing state"})
-					continue
-				}
-				sessions.setState(sessionID, msg.State.toComputeState())
-				_ = conn.WriteJSON(wsResponse{Type: "state_update", RequestID: msg.RequestID, Data: map[string]string{"status": "ok"}})
+func (c camelCaseJSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(camelCaseValue(reflect.ValueOf(c.value)))
+}
 
-			case "range_selection":
-				start, end, err := parseStartEndStrings(msg.Start, msg.End)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
-					continue
-				}
-				sessions.updateRange(sessionID, start, end, msg.RangeStart, msg.RangeEnd, msg.ComputeMode)
-				_ = conn.WriteJSON(wsResponse{Type: "range_selection", RequestID: msg.RequestID, Data: map[string]string{"status": "ok"}})
+// camelObject is a re-keyed struct; it keeps the struct's field order.
+type camelObject []camelField
 
-			case "state_reset":
-				state := sessions.resetState(sessionID)
-				_ = conn.WriteJSON(wsResponse{Type: "state_reset", RequestID: msg.RequestID, Data: state})
+type camelField struct {
+	key   string
+	value any
+}
 
-			case "timeframe":
-				resp, err := cache.getOrBuild(cacheTTL, func() (timeframeResponse, error) {
-					return store.buildTimeframeResponse()
-				})
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not build timeframe"})
-					continue
-				}
-				_ = conn.WriteJSON(wsResponse{Type: "timeframe", RequestID: msg.RequestID, Data: resp})
-
-			case "price_overview":
-				symbol := strings.TrimSpace(msg.Symbol)
-				if symbol == "" {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
-					continue
-				}
-				start, end, err := parseStartEndStrings(msg.Start, msg.End)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
-					continue
-				}
-				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
-					continue
-				}
-				resp, ok, err := store.buildPriceOverview(symbol, start, end, resolutionSeconds)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not build price overview"})
-					continue
-				}
-				if !ok {
-					_ = conn.WriteJSON(wsResponse{Type: "price_overview", RequestID: msg.RequestID, Data: nil})
-					continue
-				}
-				_ = conn.WriteJSON(wsResponse{Type: "price_overview", RequestID: msg.RequestID, Data: resp})
-
-			case "price_overview_batch":
-				start, end, err := parseStartEndStrings(msg.Start, msg.End)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
-					continue
-				}
-				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
-					continue
-				}
-				items := make([]wsPriceOverviewItem, 0, len(msg.Symbols))
-				for _, rawSymbol := range msg.Symbols {
-					symbol := strings.TrimSpace(rawSymbol)
-					if symbol == "" {
-						continue
-					}
-					resp, ok, err := store.buildPriceOverview(symbol, start, end, resolutionSeconds)
-					if err != nil {
-						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not build price overview"})
-						items = nil
-						break
-					}
-					if !ok {
-						items = append(items, wsPriceOverviewItem{Symbol: symbol})
-						continue
-					}
-					respCopy := resp
-					items = append(items, wsPriceOverviewItem{Symbol: symbol, Data: &respCopy})
-				}
-				if items == nil {
-					continue
-				}
-				_ = conn.WriteJSON(wsResponse{Type: "price_overview_batch", RequestID: msg.RequestID, Data: items})
-
-			case "compute_mode":
-				start, end, err := parseStartEndStrings(msg.Start, msg.End)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
-					continue
-				}
-				if err := store.loadFromDirsRange(dataDirs, start, end); err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not load range"})
-					continue
-				}
-				cache.reset()
-				_ = conn.WriteJSON(wsResponse{Type: "compute_mode", RequestID: msg.RequestID, Data: map[string]string{"status": "ok"}})
-
-			case "increase_resolution":
-				start, end, err := parseStartEndStrings(msg.Start, msg.End)
-				if err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
-					continue
-				}
-				ticks := msg.Ticks
-				if ticks <= 0 {
-					ticks = 5000
-				}
-				if err := store.loadFromDirsRange(dataDirs, start, end); err != nil {
-					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not load range"})
-					continue
-				}
-				cache.reset()
-				resolutionSeconds := computeResolutionSecondsForTicks(start, end, ticks)
-				symbols := msg.Symbols
-				if len(symbols) == 0 {
-					symbols = store.listSymbols()
-				}
-				items := make([]wsPriceOverviewItem, 0, len(symbols))
-				for _, rawSymbol := range symbols {
-					symbol := strings.TrimSpace(rawSymbol)
-					if symbol == "" {
-						continue
-					}
-					resp, ok, err := store.buildPriceOverview(symbol, start, end, resolutionSeconds)
-					if err != nil {
-						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not build price overview"})
-						items = nil
-						break
-					}
-					if !ok {
-						items = append(items, wsPriceOverviewItem{Symbol: symbol})
-						continue
-					}
-					respCopy := resp
-					items = append(items, wsPriceOverviewItem{Symbol: symbol, Data: &respCopy})
-				}
-				if items == nil {
-					continue
-				}
-				payload := wsIncreaseResolutionPayload{
-					ResolutionSeconds: resolutionSeconds,
-					Items:             items,
-				}
-				_ = conn.WriteJSON(wsResponse{Type: "increase_resolution", RequestID: msg.RequestID, Data: payload})
+func (o camelObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
 
-			default:
-				_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "unknown message type"})
+func camelCaseValue(v reflect.Value) any {
+	if !v.IsValid() {
+		return nil
+	}
+	if !hasStructs(v.Type()) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return camelCaseValue(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = camelCaseValue(v.Index(i))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out[fmt.Sprint(iter.Key().Interface())] = camelCaseValue(iter.Value())
+		}
+		return out
+	case reflect.Struct:
+		t := v.Type()
+		out := make(camelObject, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
 			}
+			if name == "" {
+				name = field.Name
+			}
+			value := v.Field(i)
+			if strings.Contains(opts, "omitempty") && isEmptyJSONValue(value) {
+				continue
+			}
+			out = append(out, camelField{key: snakeToCamel(name), value: camelCaseValue(value)})
 		}
+		return out
 	}
+	return v.Interface()
 }
 
-func originAllowed(origin string, allowedOrigins []string) bool {
-	if len(allowedOrigins) == 0 {
-		return false
-	}
-	if len(allowedOrigins) == 1 && allowedOrigins[0] == "*" {
+// hasStructs reports whether values of t can contain a struct, i.e. whether
+// camelCaseValue has anything to re-key. Plain slices of prices skip the walk.
+func hasStructs(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Interface:
 		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return hasStructs(t.Elem())
 	}
-	for _, allowed := range allowedOrigins {
-		if strings.EqualFold(origin, allowed) {
-			return true
-		}
+	return false
+}
+
+// isEmptyJSONValue matches encoding/json's omitempty test.
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
 	}
 	return false
 }
 
-func parseOrigins(value string) []string {
-	parts := strings.Split(value, ",")
-	origins := make([]string, 0, len(parts))
-	for _, part := range parts {
-		trimmed := strings.TrimSpace(part)
-		if trimmed == "" {
+// snakeToCamel turns "resolution_seconds" into "resolutionSeconds".
+func snakeToCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "" {
 			continue
 		}
-		origins = append(origins, trimmed)
+		runes := []rune(parts[i])
+		runes[0] = unicode.ToUpper(runes[0])
+		parts[i] = string(runes)
 	}
-	return origins
+	return strings.Join(parts, "")
 }
 
-func parseDirs(value string) []string {
-	parts := strings.Split(value, ",")
-	dirs := make([]string, 0, len(parts))
-	for _, part := range parts {
-		trimmed := strings.TrimSpace(part)
-		if trimmed == "" {
+// experimentalMessages are websocket message types that stay disabled unless
+// listed in BFF_FEATURES, so new handlers can ship dark. Only messages that
+// have never been served belong here: listing a released one would break
+// clients of deployments that don't set BFF_FEATURES. Remove a message once
+// it is released. cancel is not listed; it only stops price_overview_stream.
+var experimentalMessages = map[string]bool{
+	"candle_batch":            true,
+	"clock":                   true,
+	"data_sources":            true,
+	"downsample_preview":      true,
+	"marker_add":              true,
+	"marker_remove":           true,
+	"price_overview_stream":   true,
+	"range_overview_by_index": true,
+	"symbols":                 true,
+	"top_movers":              true,
+	"twap_overview":           true,
+}
+
+// featureSet is the set of experimental messages enabled by BFF_FEATURES;
+// "*" enables all of them.
+type featureSet map[string]bool
+
+func parseFeatures(value string) featureSet {
+	features := make(featureSet)
+	for _, name := range parseDirs(value) {
+		if name != "*" && !experimentalMessages[name] {
+			log.Printf("ignoring unknown feature %q", name)
 			continue
 		}
-		dirs = append(dirs, trimmed)
+		features[name] = true
 	}
-	return dirs
+	return features
 }
 
-func envOrDefault(key, fallback string) string {
-	value := strings.TrimSpace(os.Getenv(key))
-	if value == "" {
-		return fallback
+func (f featureSet) enabled(msgType string) bool {
+	if !experimentalMessages[msgType] {
+		return true
 	}
-	return value
+	return f["*"] || f[msgType]
 }
 
-func writeJSON(w http.ResponseWriter, status int, payload any) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(status)
-	encoder := json.NewEncoder(w)
-	encoder.SetEscapeHTML(true)
-	_ = encoder.Encode(payload)
+// active lists the enabled experimental messages, sorted.
+func (f featureSet) active() []string {
+	active := make([]string, 0, len(experimentalMessages))
+	for name := range experimentalMessages {
+		if f.enabled(name) {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
 }
 
-func parseStartEnd(r *http.Request) (time.Time, time.Time, error) {
-	query := r.URL.Query()
-	startRaw := strings.TrimSpace(query.Get("start"))
-	endRaw := strings.TrimSpace(query.Get("end"))
+// traceSpans enables span log lines for the expensive builds; set from
+// BFF_TRACE_SPANS.
+var traceSpans bool
 
-	now := time.Now().UTC().Truncate(time.Minute)
-	start := now.Add(-60 * time.Minute)
-	end := now
+type traceContextKey struct{}
 
-	if startRaw != "" {
-		parsed, err := parseDateTime(startRaw)
-		if err != nil {
-			return time.Time{}, time.Time{}, err
+// traceContext is the W3C trace context of the request being served. When
+// the caller sent no valid traceparent a new trace is started.
+type traceContext struct {
+	traceID string
+	parent  string
+	state   string
+}
+
+// withTrace echoes traceparent/tracestate on every response, makes the
+// trace available to handlers and logs each request with its trace id.
+func withTrace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace := traceFromHeaders(r.Header)
+		w.Header().Set("traceparent", trace.parent)
+		if trace.state != "" {
+			w.Header().Set("tracestate", trace.state)
 		}
-		start = parsed
+
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), traceContextKey{}, trace)))
+		log.Printf("http method=%s path=%s status=%d duration=%s trace_id=%s", r.Method, r.URL.Path, recorder.status, time.Since(started), trace.traceID)
+	})
+}
+
+func traceFromHeaders(header http.Header) traceContext {
+	parent := strings.TrimSpace(header.Get("traceparent"))
+	if traceID, ok := parseTraceparent(parent); ok {
+		return traceContext{traceID: traceID, parent: parent, state: strings.TrimSpace(header.Get("tracestate"))}
 	}
+	traceID := randomHex(16)
+	return traceContext{traceID: traceID, parent: "00-" + traceID + "-" + randomHex(8) + "-01"}
+}
 
-	if endRaw != "" {
-		parsed, err := parseDateTime(endRaw)
-		if err != nil {
-			return time.Time{}, time.Time{}, err
+// parseTraceparent accepts "00-<32 hex trace id>-<16 hex parent id>-<2 hex
+// flags>" and rejects the all-zero ids the spec marks invalid.
+func parseTraceparent(value string) (string, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return "", false
 		}
-		end = parsed
 	}
-
-	if end.Before(start) {
-		return time.Time{}, time.Time{}, errors.New("end must be after start")
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", false
 	}
+	return strings.ToLower(parts[1]), true
+}
 
-	return start, end, nil
+func traceFrom(ctx context.Context) traceContext {
+	trace, _ := ctx.Value(traceContextKey{}).(traceContext)
+	return trace
 }
 
-func parseStartEndStrings(startRaw, endRaw string) (time.Time, time.Time, error) {
-	startRaw = strings.TrimSpace(startRaw)
-	endRaw = strings.TrimSpace(endRaw)
+// startSpan logs how long an expensive build took under the request's trace
+// id when BFF_TRACE_SPANS is set. Call the returned func when the build ends.
+func startSpan(ctx context.Context, name string) func() {
+	if !traceSpans {
+		return func() {}
+	}
+	started := time.Now()
+	return func() {
+		log.Printf("span name=%s duration=%s trace_id=%s", name, time.Since(started), traceFrom(ctx).traceID)
+	}
+}
 
-	now := time.Now().UTC().Truncate(time.Minute)
-	start := now.Add(-60 * time.Minute)
-	end := now
+// statusRecorder captures the response status for request logs. It passes
+// Hijack through so websocket upgrades still work.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-	if startRaw != "" {
-		parsed, err := parseDateTime(startRaw)
-		if err != nil {
-			return time.Time{}, time.Time{}, err
-		}
-		start = parsed
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
 	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
 
-	if endRaw != "" {
-		parsed, err := parseDateTime(endRaw)
-		if err != nil {
-			return time.Time{}, time.Time{}, err
+// minGzipBytes is the smallest response body withGzip compresses.
+const minGzipBytes = 1024
+
+// withGzip compresses responses for clients that accept gzip. Websocket
+// upgrades and handlers that set their own Content-Encoding pass through,
+// and bodies under minGzipBytes are sent as is.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
 		}
-		end = parsed
-	}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
 
-	if end.Before(start) {
-		return time.Time{}, time.Time{}, errors.New("end must be after start")
-	}
+// gzipResponseWriter holds the status and the first minGzipBytes of the
+// body back until it knows whether the response is worth compressing.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	started bool
+	gz      *gzip.Writer
+}
 
-	return start, end, nil
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if !g.started {
+		g.status = status
+	}
 }
 
-func parseResolutionSeconds(r *http.Request) (int, error) {
-	query := r.URL.Query()
-	raw := strings.TrimSpace(query.Get("resolution"))
-	if raw == "" {
-		return 300, nil
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.started {
+		g.buf = append(g.buf, p...)
+		if len(g.buf) < minGzipBytes {
+			return len(p), nil
+		}
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
 	}
-	seconds, err := strconv.Atoi(raw)
-	if err != nil || seconds <= 0 {
-		return 0, errors.New("resolution must be a positive integer in seconds")
+	if g.gz != nil {
+		return g.gz.Write(p)
 	}
-	return seconds, nil
+	return g.ResponseWriter.Write(p)
 }
 
+// start sends the header and the held back bytes, compressed if compress
+// and the handler did not pick its own encoding.
+func (g *gzipResponseWriter) start(compress bool) error {
+	g.started = true
+	header := g.ResponseWriter.Header()
+	if compress && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Add("Vary", "Accept-Encoding")
+		header.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	buf := g.buf
+	g.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if g.gz != nil {
+		_, err := g.gz.Write(buf)
+		return err
+	}
+	_, err := g.ResponseWriter.Write(buf)
+	return err
+}
+
+func (g *gzipResponseWriter) close() {
+	if !g.started {
+		_ = g.start(false)
+	}
+	if g.gz != nil {
+		_ = g.gz.Close()
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%0*x", n*2, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// notModified tags a data-derived response with the store generation as an
+// ETag and writes 304 when the client's If-None-Match already has it.
+func notModified(w http.ResponseWriter, r *http.Request, generation string) bool {
+	etag := `"` + generation + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Data-Generation", generation)
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func withCORS(next http.Handler, allowedOrigins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(origin, allowedOrigins) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match, traceparent, tracestate")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Data-Generation, traceparent, tracestate")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wsConnections counts the open websocket connections.
+var wsConnections atomic.Int64
+
+// lockedConn serializes WriteJSON so streams running in their own goroutine
+// can share the connection with the read loop. Pings go through
+// WriteControl, which is already safe to call concurrently.
+type lockedConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+	// compress turns on permessage-deflate, when the client negotiated it,
+	// for messages of at least minWSCompressBytes; set by BFF_WS_COMPRESSION.
+	compress bool
+}
+
+// minWSCompressBytes keeps acks and errors out of the compressor; overview
+// payloads are far larger.
+const minWSCompressBytes = 16 << 10
+
+func (c *lockedConn) WriteJSON(v any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.compress {
+		return c.Conn.WriteJSON(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Conn.EnableWriteCompression(len(data) >= minWSCompressBytes)
+	return c.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// overviewStreams tracks a connection's running streams by request_id so a
+// cancel message can stop them.
+type overviewStreams struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (s *overviewStreams) start(id string, cancel context.CancelFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, running := s.cancels[id]; running {
+		return false
+	}
+	s.cancels[id] = cancel
+	s.wg.Add(1)
+	return true
+}
+
+func (s *overviewStreams) finish(id string) {
+	s.mu.Lock()
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+		delete(s.cancels, id)
+	}
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *overviewStreams) cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// stop cancels every stream and waits for them to return.
+func (s *overviewStreams) stop() {
+	s.mu.Lock()
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// handleWebsocket serves /ws. A connection whose client sends no message
+// for idleTimeout is closed, as is one that stops answering the pings sent
+// every idleTimeout/2.
+func handleWebsocket(store *dataStore, cache *timeframeCache, cacheTTL, requestTimeout, idleTimeout time.Duration, maxBatchSymbols, maxIncreaseTicks, maxResponseBytes int, wsCompression bool, fieldCase string, features featureSet, allowedOrigins []string, dataDirs []string, sessions *sessionManager, adminToken string) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		Subprotocols:    supportedSubprotocols,
+		// Only offers permessage-deflate; lockedConn decides per message.
+		EnableCompression: wsCompression,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			return originAllowed(origin, allowedOrigins)
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		protocol, ok := negotiateSubprotocol(r)
+		if !ok {
+			http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+			return
+		}
+		sessionID, created := sessions.getOrCreateID(r)
+		// Admin messages need BFF_ADMIN_TOKEN as a bearer token on the upgrade
+		// request.
+		admin := adminToken != "" && bearerAuthorized(r, adminToken)
+		// Overview and timeframe payloads are re-keyed to camelCase when the
+		// connection asks for it.
+		shape := func(v any) any { return v }
+		if fieldCaseFor(r, fieldCase) == fieldCaseCamel {
+			shape = func(v any) any { return camelCaseJSON{value: v} }
+		}
+		trace := traceFrom(r.Context())
+		headers := http.Header{}
+		if created {
+			headers.Add("Set-Cookie", buildSessionCookie(sessionID))
+		}
+		if trace.parent != "" {
+			headers.Set("traceparent", trace.parent)
+			if trace.state != "" {
+				headers.Set("tracestate", trace.state)
+			}
+		}
+		upgraded, err := upgrader.Upgrade(w, r, headers)
+		if err != nil {
+			log.Printf("ws upgrade failed: %v", err)
+			return
+		}
+		conn := &lockedConn{Conn: upgraded, compress: wsCompression}
+		defer conn.Close()
+		streams := &overviewStreams{cancels: make(map[string]context.CancelFunc)}
+		defer streams.stop()
+		wsConnections.Add(1)
+		defer wsConnections.Add(-1)
+
+		// Pongs only keep the read deadline alive; idleness is measured from
+		// lastActivity, which client messages and finished handlers stamp.
+		var lastActivity atomic.Int64
+		var handling, idleClosed atomic.Bool
+		lastActivity.Store(time.Now().UnixNano())
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		})
+		stopPings := make(chan struct{})
+		defer close(stopPings)
+		go func() {
+			ticker := time.NewTicker(idleTimeout / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopPings:
+					return
+				case <-ticker.C:
+					if !handling.Load() && time.Since(time.Unix(0, lastActivity.Load())) > idleTimeout {
+						log.Printf("ws closing idle connection after %s", idleTimeout)
+						idleClosed.Store(true)
+						_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle"), time.Now().Add(time.Second))
+						_ = conn.Close()
+						return
+					}
+					if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		// writeLimited sends out, or an error in its place when out is over
+		// BFF_MAX_RESPONSE_BYTES.
+		writeLimited := func(out wsResponse) {
+			if err := checkResponseSize(out, maxResponseBytes); err != nil {
+				_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: out.RequestID, Message: err.Error()})
+				return
+			}
+			_ = conn.WriteJSON(out)
+		}
+
+		handle := func(ctx context.Context, msg wsRequest) {
+			if !features.enabled(strings.TrimSpace(msg.Type)) {
+				_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "feature_disabled"})
+				return
+			}
+			switch strings.TrimSpace(msg.Type) {
+			case "state_get":
+				state := sessions.getState(sessionID)
+				_ = conn.WriteJSON(wsResponse{Type: "state", RequestID: msg.RequestID, Data: state})
+
+			case "state_update":
+				if msg.State == nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing state"})
+					return
+				}
+				sessions.setState(sessionID, msg.State.toComputeState())
+				_ = conn.WriteJSON(wsResponse{Type: "state_update", RequestID: msg.RequestID, Data: map[string]string{"status": "ok"}})
+
+			case "range_selection":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				sessions.updateRange(sessionID, start, end, msg.RangeStart, msg.RangeEnd, msg.ComputeMode)
+				_ = conn.WriteJSON(wsResponse{Type: "range_selection", RequestID: msg.RequestID, Data: map[string]string{"status": "ok"}})
+
+			case "marker_add":
+				key, err := validMarkerKey(msg.Marker)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				if msg.MarkerValue == nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing marker_value"})
+					return
+				}
+				markers, err := sessions.addMarker(sessionID, key, *msg.MarkerValue)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "marker_add", RequestID: msg.RequestID, Data: map[string]map[string]int{"markers": markers}})
+
+			case "marker_remove":
+				key, err := validMarkerKey(msg.Marker)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				markers := sessions.removeMarker(sessionID, key)
+				_ = conn.WriteJSON(wsResponse{Type: "marker_remove", RequestID: msg.RequestID, Data: map[string]map[string]int{"markers": markers}})
+
+			case "state_reset":
+				state := sessions.resetState(sessionID)
+				_ = conn.WriteJSON(wsResponse{Type: "state_reset", RequestID: msg.RequestID, Data: state})
+
+			case "timeframe":
+				if generation := strings.TrimSpace(msg.Generation); generation != "" && generation == store.generationToken() {
+					_ = conn.WriteJSON(wsResponse{Type: "timeframe", RequestID: msg.RequestID, Data: shape(timeframeUnchangedResponse{Status: "unchanged", Generation: generation})})
+					return
+				}
+				order, err := parseSymbolOrder(msg.Sort)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				minCoverage := store.coverageFor(msg.MinCoverageMinutes)
+				var resp timeframeResponse
+				if minCoverage == store.minCoverage && !msg.BySource && order == symbolOrderCoverage {
+					resp, err = cache.getOrBuild(cacheTTL, store.generationToken(), func() (timeframeResponse, error) {
+						return store.buildTimeframeResponse(ctx, minCoverage, false, symbolOrderCoverage)
+					})
+				} else {
+					resp, err = store.buildTimeframeResponse(ctx, minCoverage, msg.BySource, order)
+				}
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: timeframeErrorMessage(err)})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "timeframe", RequestID: msg.RequestID, Data: shape(resp)})
+
+			case "price_overview":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				decimals, err := parsePriceFormat(msg.PriceFormat, msg.PriceDecimals)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				if msg.Encoding != "" && msg.Encoding != "rle" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "encoding must be rle"})
+					return
+				}
+				if msg.TargetPoints < 0 {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "target_points must not be negative"})
+					return
+				}
+				// Only the field chosen by BFF_SECONDARY_PRICE is kept per
+				// minute, so that is the only secondary series available.
+				if secondary := strings.ToLower(strings.TrimSpace(msg.Secondary)); secondary != "" && secondary != store.ingest.secondaryField {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: fmt.Sprintf("secondary price %q is not retained", secondary)})
+					return
+				}
+				start, end, err = store.clampToCoverage(symbol, start, end)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				// target_points overrides resolution; the pick is echoed back in
+				// resolution_seconds.
+				if msg.TargetPoints > 0 {
+					resolutionSeconds, _ = computeResolutionSecondsForTicks(start, end, msg.TargetPoints)
+				}
+				// Past maxOverviewBuckets or BFF_MAX_RESPONSE_BYTES the overview
+				// is built at a coarser resolution, and flagged truncated.
+				var out wsResponse
+				resolutionSeconds, truncated := clampOverviewResolution(start, end, resolutionSeconds)
+				for {
+					resp, ok, err := store.buildPriceOverview(ctx, symbol, start, end, resolutionSeconds, msg.IncludeExtremes, strings.TrimSpace(msg.Secondary) != "", store.priceFloor(msg.MinPrice))
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+						return
+					}
+					if !ok {
+						if protocol == protocolV2 {
+							_ = conn.WriteJSON(wsResponse{Type: "price_overview", RequestID: msg.RequestID, Data: shape(wsPriceOverviewItem{Symbol: symbol})})
+							return
+						}
+						_ = conn.WriteJSON(wsResponse{Type: "price_overview", RequestID: msg.RequestID, Data: nil})
+						return
+					}
+					if msg.TrimEdges {
+						resp = resp.trimEdges()
+					}
+					if msg.Anchors {
+						resp.FirstPrice, resp.LastPrice = store.rangeAnchors(symbol, start, end, store.priceFloor(msg.MinPrice))
+					}
+					resp.Truncated = truncated
+					var data any = resp
+					switch {
+					case msg.Encoding == "rle":
+						data = resp.withRunLengthPrices(msg.PriceFormat == "string", decimals)
+					case msg.PriceFormat == "string":
+						data = resp.withStringPrices(decimals)
+					}
+					if protocol == protocolV2 {
+						data = wsPriceOverviewItem{Symbol: symbol, Data: data}
+					}
+					out = wsResponse{Type: "price_overview", RequestID: msg.RequestID, Data: shape(data)}
+					next, shrink, err := fitResolution(out, resolutionSeconds, start, end, maxResponseBytes)
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+						return
+					}
+					if !shrink {
+						break
+					}
+					resolutionSeconds, truncated = next, true
+				}
+				_ = conn.WriteJSON(out)
+
+			case "twap_overview":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				decimals, err := parsePriceFormat(msg.PriceFormat, msg.PriceDecimals)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				start, end, err = store.clampToCoverage(symbol, start, end)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				// Sized against maxOverviewBuckets and BFF_MAX_RESPONSE_BYTES
+				// like price_overview.
+				var out wsResponse
+				resolutionSeconds, truncated := clampOverviewResolution(start, end, resolutionSeconds)
+				for {
+					resp, ok, err := store.buildTWAP(ctx, symbol, start, end, resolutionSeconds, store.priceFloor(msg.MinPrice))
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+						return
+					}
+					if !ok {
+						_ = conn.WriteJSON(wsResponse{Type: "twap_overview", RequestID: msg.RequestID, Data: shape(wsPriceOverviewItem{Symbol: symbol})})
+						return
+					}
+					resp.Truncated = truncated
+					var data any = resp
+					if msg.PriceFormat == "string" {
+						data = resp.withStringPrices(decimals)
+					}
+					out = wsResponse{Type: "twap_overview", RequestID: msg.RequestID, Data: shape(wsPriceOverviewItem{Symbol: symbol, Data: data})}
+					next, shrink, err := fitResolution(out, resolutionSeconds, start, end, maxResponseBytes)
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+						return
+					}
+					if !shrink {
+						break
+					}
+					resolutionSeconds, truncated = next, true
+				}
+				_ = conn.WriteJSON(out)
+
+			case "range_overview_by_index":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				startTS, endTS, _ := store.bounds()
+				if startTS <= 0 || endTS <= 0 {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "no data loaded"})
+					return
+				}
+				grid := newTimeframeGrid(startTS, endTS)
+				start, end, err := grid.indexRange(msg.RangeStart, msg.RangeEnd)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resp, ok, err := store.buildPriceOverview(ctx, symbol, start, end, grid.resolutionMinutes*60, msg.IncludeExtremes, false, store.priceFloor(msg.MinPrice))
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+					return
+				}
+				item := wsPriceOverviewItem{Symbol: symbol}
+				if ok {
+					item.Data = resp
+				}
+				writeLimited(wsResponse{Type: "range_overview_by_index", RequestID: msg.RequestID, Data: shape(item)})
+
+			case "price_overview_stream":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				if msg.RequestID == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", Message: "price_overview_stream needs a request_id"})
+					return
+				}
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				start, end, err = store.clampToCoverage(symbol, start, end)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				chunk := msg.ChunkSize
+				if chunk <= 0 {
+					chunk = defaultStreamChunk
+				}
+				if chunk > maxStreamChunk {
+					chunk = maxStreamChunk
+				}
+				// The stream outlives this handler call, so it gets its own
+				// context; cancel or the request timeout stops it.
+				streamCtx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+				if !streams.start(msg.RequestID, cancel) {
+					cancel()
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "request_id is already streaming"})
+					return
+				}
+				minPrice := store.priceFloor(msg.MinPrice)
+				go func(requestID string) {
+					defer streams.finish(requestID)
+					buckets, chunks, err := store.streamPriceOverview(streamCtx, symbol, start, end, resolutionSeconds, chunk, minPrice, func(part priceOverviewResponse) error {
+						out := wsResponse{Type: "price_overview_chunk", RequestID: requestID, Data: shape(wsPriceOverviewItem{Symbol: symbol, Data: part})}
+						if err := checkResponseSize(out, maxResponseBytes); err != nil {
+							return fmt.Errorf("%w; use a smaller chunk_size", err)
+						}
+						return conn.WriteJSON(out)
+					})
+					done := overviewStreamDone{Symbol: symbol, BucketCount: buckets, Chunks: chunks, Done: true}
+					switch {
+					case errors.Is(err, context.Canceled):
+						done.Cancelled = true
+					case err != nil:
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: requestID, Message: overviewErrorMessage(err)})
+						return
+					}
+					_ = conn.WriteJSON(wsResponse{Type: "price_overview_stream", RequestID: requestID, Data: shape(done)})
+				}(msg.RequestID)
+
+			case "cancel":
+				cancelled := streams.cancel(msg.RequestID)
+				_ = conn.WriteJSON(wsResponse{Type: "cancel", RequestID: msg.RequestID, Data: map[string]bool{"cancelled": cancelled}})
+
+			case "downsample_preview":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				start, end, err = store.clampToCoverage(symbol, start, end)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				writeLimited(wsResponse{Type: "downsample_preview", RequestID: msg.RequestID, Data: store.downsamplePreview(symbol, start, end, resolutionSeconds, store.priceFloor(msg.MinPrice))})
+
+			case "price_at":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				at, err := parseDateTime(strings.TrimSpace(msg.Timestamp))
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				if msg.ToleranceSeconds < 0 {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "tolerance_seconds must not be negative"})
+					return
+				}
+				tolerance := defaultPriceAtTolerance
+				if msg.ToleranceSeconds > 0 {
+					tolerance = time.Duration(msg.ToleranceSeconds) * time.Second
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "price_at", RequestID: msg.RequestID, Data: store.priceAt(symbol, at, tolerance)})
+
+			case "recent_prices":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				count := msg.Count
+				if count <= 0 {
+					count = defaultRecentPrices
+				}
+				if count > maxRecentPrices {
+					count = maxRecentPrices
+				}
+				before := int64(math.MaxInt64)
+				if cursor := strings.TrimSpace(msg.Cursor); cursor != "" {
+					minute, err := decodeMinuteCursor(cursor)
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+						return
+					}
+					before = minute
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "recent_prices", RequestID: msg.RequestID, Data: store.recentPrices(symbol, count, before)})
+
+			case "symbol_stats":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				stats, ok := store.symbolStats(symbol, start, end)
+				if !ok {
+					_ = conn.WriteJSON(wsResponse{Type: "symbol_stats", RequestID: msg.RequestID, Data: nil})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "symbol_stats", RequestID: msg.RequestID, Data: stats})
+
+			case "top_movers":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				count := msg.Count
+				if count <= 0 {
+					count = defaultTopMovers
+				}
+				if count > maxTopMovers {
+					count = maxTopMovers
+				}
+				resp, err := store.topMovers(ctx, start, end, count)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "top_movers", RequestID: msg.RequestID, Data: resp})
+
+			case "source_coverage":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				var symbols []string
+				if symbol := strings.TrimSpace(msg.Symbol); symbol != "" {
+					symbols = []string{symbol}
+				} else {
+					symbols = store.listSymbols()
+				}
+				if len(symbols) > maxBatchSymbols {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: fmt.Sprintf("at most %d symbols per batch; pass a symbol", maxBatchSymbols)})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "source_coverage", RequestID: msg.RequestID, Data: store.sourceCoverage(symbols, start, end)})
+
+			case "chart_hints":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resp, ok, err := store.buildPriceOverview(ctx, symbol, start, end, resolutionSeconds, false, false, store.priceFloor(msg.MinPrice))
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+					return
+				}
+				low, high, hasRange := priceRange(resp.Prices)
+				if !ok || !hasRange {
+					_ = conn.WriteJSON(wsResponse{Type: "chart_hints", RequestID: msg.RequestID, Data: nil})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "chart_hints", RequestID: msg.RequestID, Data: buildChartHints(symbol, low, high, msg.Gridlines)})
+
+			case "price_overview_batch":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				if len(msg.Symbols) > maxBatchSymbols {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: fmt.Sprintf("at most %d symbols per batch", maxBatchSymbols)})
+					return
+				}
+				var items []wsPriceOverviewItem
+				resolutionSeconds, truncated := clampOverviewResolution(start, end, resolutionSeconds)
+				for {
+					items = make([]wsPriceOverviewItem, 0, len(msg.Symbols))
+					for _, rawSymbol := range msg.Symbols {
+						symbol := strings.TrimSpace(rawSymbol)
+						if symbol == "" {
+							continue
+						}
+						resp, ok, err := store.buildPriceOverview(ctx, symbol, start, end, resolutionSeconds, false, false, store.priceFloor(msg.MinPrice))
+						if err != nil {
+							_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+							return
+						}
+						if !ok {
+							items = append(items, wsPriceOverviewItem{Symbol: symbol})
+							continue
+						}
+						respCopy := resp
+						respCopy.Truncated = truncated
+						items = append(items, wsPriceOverviewItem{Symbol: symbol, Data: &respCopy})
+					}
+					next, shrink, err := fitResolution(wsResponse{Type: "price_overview_batch", RequestID: msg.RequestID, Data: shape(items)}, resolutionSeconds, start, end, maxResponseBytes)
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+						return
+					}
+					if !shrink {
+						break
+					}
+					resolutionSeconds, truncated = next, true
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "price_overview_batch", RequestID: msg.RequestID, Data: shape(items)})
+
+			case "candle_batch":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				if resolutionSeconds < 60 {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "candle resolution must be at least 60 seconds"})
+					return
+				}
+				if len(msg.Symbols) > maxBatchSymbols {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: fmt.Sprintf("at most %d symbols per batch", maxBatchSymbols)})
+					return
+				}
+				items := make([]wsPriceOverviewItem, 0, len(msg.Symbols))
+				for _, rawSymbol := range msg.Symbols {
+					symbol := strings.TrimSpace(rawSymbol)
+					if symbol == "" {
+						continue
+					}
+					resp, ok, err := store.buildCandles(ctx, symbol, start, end, resolutionSeconds, store.priceFloor(msg.MinPrice))
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+						items = nil
+						break
+					}
+					if !ok {
+						items = append(items, wsPriceOverviewItem{Symbol: symbol})
+						continue
+					}
+					respCopy := resp
+					items = append(items, wsPriceOverviewItem{Symbol: symbol, Data: &respCopy})
+				}
+				if items == nil {
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "candle_batch", RequestID: msg.RequestID, Data: items})
+
+			case "symbols":
+				order, err := parseSymbolOrder(msg.Sort)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				symbols := store.listSymbolsWithCoverage(store.coverageFor(msg.MinCoverageMinutes))
+				store.sortSymbols(symbols, order)
+				_ = conn.WriteJSON(wsResponse{Type: "symbols", RequestID: msg.RequestID, Data: store.describeSymbols(symbols)})
+
+			case "config":
+				_ = conn.WriteJSON(wsResponse{Type: "config", RequestID: msg.RequestID, Data: clientConfigResponse{
+					Protocol:                 protocol,
+					DefaultResolutionSeconds: defaultResolutionSeconds,
+					DefaultRangeSeconds:      int(defaultRange.Seconds()),
+					MinResolutionSeconds:     allowedResolutions[0],
+					MaxResolutionSeconds:     allowedResolutions[len(allowedResolutions)-1],
+					AllowedResolutions:       allowedResolutions,
+					DefaultIncreaseTicks:     min(defaultIncreaseTicks, maxIncreaseTicks),
+					MaxIncreaseTicks:         maxIncreaseTicks,
+					MaxBuckets:               maxOverviewBuckets,
+					FillModes:                overviewFillModes,
+					SymbolCount:              len(store.listSymbols()),
+					Features:                 features.active(),
+				}})
+
+			case "generation":
+				resp := generationResponse{Generation: store.generationToken()}
+				if loadedAt := store.lastLoadedAt(); !loadedAt.IsZero() {
+					resp.LoadedAt = loadedAt.Format(time.RFC3339)
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "generation", RequestID: msg.RequestID, Data: resp})
+
+			case "clock":
+				now := time.Now().UTC()
+				resp := clockResponse{ServerTime: now.Format(time.RFC3339Nano), ServerTimeMs: now.UnixMilli()}
+				if _, endTS, _ := store.bounds(); endTS > 0 {
+					age := (now.UnixMilli() - endTS) / 1000
+					resp.DataEnd = time.UnixMilli(endTS).UTC().Format(time.RFC3339)
+					resp.DataEndMs = endTS
+					resp.DataAgeSeconds = &age
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "clock", RequestID: msg.RequestID, Data: resp})
+
+			case "range_preview":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				preview, err := store.previewRange(dataDirs, start, end)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not preview range"})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "range_preview", RequestID: msg.RequestID, Data: preview})
+
+			case "multi_range_overview":
+				symbol := strings.TrimSpace(msg.Symbol)
+				if symbol == "" {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "missing symbol"})
+					return
+				}
+				resolutionSeconds, err := parseResolutionValue(msg.Resolution)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				payload, err := store.buildMultiRangeOverview(ctx, dataDirs, symbol, msg.Windows, resolutionSeconds, store.priceFloor(msg.MinPrice))
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				writeLimited(wsResponse{Type: "multi_range_overview", RequestID: msg.RequestID, Data: payload})
+
+			case "compute_mode":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				if err := store.loadFromDirsRange(dataDirs, start, end); err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not load range"})
+					return
+				}
+				cache.reset()
+				go warmTimeframeCache(store, cache)
+				_ = conn.WriteJSON(wsResponse{Type: "compute_mode", RequestID: msg.RequestID, Data: map[string]string{"status": "ok"}})
+
+			case "increase_resolution":
+				start, end, err := parseStartEndStrings(msg.Start, msg.End)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				ticks, ticksClamped, err := clampIncreaseTicks(msg.Ticks, maxIncreaseTicks)
+				if err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: err.Error()})
+					return
+				}
+				if len(msg.Symbols) > maxBatchSymbols {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: fmt.Sprintf("at most %d symbols per batch", maxBatchSymbols)})
+					return
+				}
+				if err := store.loadFromDirsRange(dataDirs, start, end); err != nil {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "could not load range"})
+					return
+				}
+				cache.reset()
+				go warmTimeframeCache(store, cache)
+				resolutionSeconds, clamped := computeResolutionSecondsForTicks(start, end, ticks)
+				clamped = clamped || ticksClamped
+				symbols := msg.Symbols
+				if len(symbols) == 0 {
+					symbols = store.listSymbolsWithCoverage(store.coverageFor(msg.MinCoverageMinutes))
+					// The listed symbols count against the same cap.
+					if len(symbols) > maxBatchSymbols {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: fmt.Sprintf("at most %d symbols per batch; pass symbols", maxBatchSymbols)})
+						return
+					}
+				}
+				items := make([]wsPriceOverviewItem, 0, len(symbols))
+				for _, rawSymbol := range symbols {
+					symbol := strings.TrimSpace(rawSymbol)
+					if symbol == "" {
+						continue
+					}
+					resp, ok, err := store.buildPriceOverview(ctx, symbol, start, end, resolutionSeconds, false, false, store.priceFloor(msg.MinPrice))
+					if err != nil {
+						_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: overviewErrorMessage(err)})
+						items = nil
+						break
+					}
+					if !ok {
+						items = append(items, wsPriceOverviewItem{Symbol: symbol})
+						continue
+					}
+					respCopy := resp
+					items = append(items, wsPriceOverviewItem{Symbol: symbol, Data: &respCopy})
+				}
+				if items == nil {
+					return
+				}
+				payload := wsIncreaseResolutionPayload{
+					ResolutionSeconds: resolutionSeconds,
+					TicksRequested:    ticks,
+					Clamped:           clamped,
+					Items:             items,
+				}
+				writeLimited(wsResponse{Type: "increase_resolution", RequestID: msg.RequestID, Data: payload})
+
+			case "data_sources":
+				if !admin {
+					_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "unauthorized"})
+					return
+				}
+				_ = conn.WriteJSON(wsResponse{Type: "data_sources", RequestID: msg.RequestID, Data: store.dataSources()})
+
+			default:
+				_ = conn.WriteJSON(wsResponse{Type: "error", RequestID: msg.RequestID, Message: "unknown message type"})
+			}
+		}
+
+		for {
+			var msg wsRequest
+			if err := conn.ReadJSON(&msg); err != nil {
+				if idleClosed.Load() || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					log.Printf("ws closing unresponsive connection: no pong for %s", idleTimeout)
+					return
+				}
+				log.Printf("ws read error: %v", err)
+				return
+			}
+			lastActivity.Store(time.Now().UnixNano())
+
+			started := time.Now()
+			ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+			handling.Store(true)
+			handle(ctx, msg)
+			handling.Store(false)
+			cancel()
+			// handle runs synchronously and pongs are only read by ReadJSON,
+			// so a slow handler must not eat into the next read's deadline.
+			lastActivity.Store(time.Now().UnixNano())
+			_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+			log.Printf("ws message type=%s request_id=%s duration=%s trace_id=%s", strings.TrimSpace(msg.Type), msg.RequestID, time.Since(started), trace.traceID)
+		}
+	}
+}
+
+// negotiateSubprotocol picks the message schema version for a websocket
+// connection. Clients that do not send Sec-WebSocket-Protocol get mvr.v1;
+// clients that only request unknown protocols are rejected.
+func negotiateSubprotocol(r *http.Request) (string, bool) {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return protocolV1, true
+	}
+	for _, supported := range supportedSubprotocols {
+		for _, candidate := range requested {
+			if candidate == supported {
+				return supported, true
+			}
+		}
+	}
+	return "", false
+}
+
+func originAllowed(origin string, allowedOrigins []string) bool {
+	if len(allowedOrigins) == 0 {
+		return false
+	}
+	if len(allowedOrigins) == 1 && allowedOrigins[0] == "*" {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseOrigins(value string) []string {
+	parts := strings.Split(value, ",")
+	origins := make([]string, 0, len(parts))
+	for _, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		origins = append(origins, trimmed)
+	}
+	return origins
+}
+
+func parseDirs(value string) []string {
+	parts := strings.Split(value, ",")
+	dirs := make([]string, 0, len(parts))
+	for _, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		dirs = append(dirs, trimmed)
+	}
+	return dirs
+}
+
+func envDurationOrDefault(key string, fallback time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("invalid %s=%q, using %s", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func envIntOrDefault(key string, fallback int) int {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		log.Printf("invalid %s=%q, using %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// envPriceFloor parses a price floor from key; unset or invalid disables it.
+func envPriceFloor(key string) *float64 {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return nil
+	}
+	floor, ok := parseFloat(value)
+	if !ok {
+		log.Printf("invalid %s=%q, ignoring", key, value)
+		return nil
+	}
+	return &floor
+}
+
+func envOrDefault(key, fallback string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(true)
+	_ = encoder.Encode(payload)
+}
+
+func parseStartEnd(r *http.Request) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+	startRaw := strings.TrimSpace(query.Get("start"))
+	endRaw := strings.TrimSpace(query.Get("end"))
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	start := now.Add(-defaultRange)
+	end := now
+
+	if startRaw != "" {
+		parsed, err := parseDateTime(startRaw)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start = parsed
+	}
+
+	if endRaw != "" {
+		parsed, err := parseDateTime(endRaw)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end = parsed
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("end must be after start")
+	}
+
+	return start, end, nil
+}
+
+func parseStartEndStrings(startRaw, endRaw string) (time.Time, time.Time, error) {
+	startRaw = strings.TrimSpace(startRaw)
+	endRaw = strings.TrimSpace(endRaw)
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	start := now.Add(-defaultRange)
+	end := now
+
+	if startRaw != "" {
+		parsed, err := parseDateTime(startRaw)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start = parsed
+	}
+
+	if endRaw != "" {
+		parsed, err := parseDateTime(endRaw)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end = parsed
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("end must be after start")
+	}
+
+	return start, end, nil
+}
+
+func parseResolutionSeconds(r *http.Request) (int, error) {
+	query := r.URL.Query()
+	raw := strings.TrimSpace(query.Get("resolution"))
+	if raw == "" {
+		return defaultResolutionSeconds, nil
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		return 0, errors.New("resolution must be a positive integer in seconds")
+	}
+	return seconds, nil
+}
+
+// allowedResolutions are the resolutions offered to clients, in seconds.
+// parseResolutionValue takes these or any custom value between the first
+// and the last.
+var allowedResolutions = []int{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 14400, 86400}
+
+// overviewFillModes is how overviews fill buckets without a price: they
+// are left null.
+var overviewFillModes = []string{"null"}
+
 func parseResolutionValue(seconds int) (int, error) {
 	if seconds == 0 {
-		return 300, nil
+		return defaultResolutionSeconds, nil
+	}
+	if seconds < 0 {
+		return 0, errors.New("resolution must be a positive integer in seconds")
+	}
+	if maxSeconds := allowedResolutions[len(allowedResolutions)-1]; seconds > maxSeconds {
+		return 0, fmt.Errorf("resolution must be at most %d seconds", maxSeconds)
+	}
+	return seconds, nil
+}
+
+// clampOverviewResolution raises resolutionSeconds so [start, end] spans at
+// most maxOverviewBuckets buckets; the second return value reports whether
+// it did.
+func clampOverviewResolution(start, end time.Time, resolutionSeconds int) (int, bool) {
+	totalSeconds := int(end.Sub(start).Seconds())
+	if totalSeconds <= 0 || totalSeconds/resolutionSeconds+1 <= maxOverviewBuckets {
+		return resolutionSeconds, false
+	}
+	return (totalSeconds + maxOverviewBuckets - 2) / (maxOverviewBuckets - 1), true
+}
+
+func overviewErrorMessage(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "request timed out"
+	}
+	if errors.Is(err, errResponseTooLarge) {
+		return err.Error()
+	}
+	return "could not build price overview"
+}
+
+func timeframeErrorMessage(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "request timed out"
+	}
+	return "could not build timeframe"
+}
+
+func parsePriceFormat(format string, decimals *int) (int, error) {
+	switch format {
+	case "", "number":
+		return 0, nil
+	case "string":
+	default:
+		return 0, errors.New("price_format must be number or string")
+	}
+	if decimals == nil {
+		return -1, nil
+	}
+	if *decimals < 0 || *decimals > 15 {
+		return 0, errors.New("price_decimals must be between 0 and 15")
+	}
+	return *decimals, nil
+}
+
+// computeResolutionSecondsForTicks spreads ticks points over [start, end].
+// The result is clamped so a range never yields more than maxIncreaseBuckets
+// buckets; the second return value reports whether that happened.
+func computeResolutionSecondsForTicks(start, end time.Time, ticks int) (int, bool) {
+	if ticks <= 1 {
+		return 60, false
+	}
+	if end.Before(start) {
+		return 60, false
+	}
+	totalSeconds := int64(end.Sub(start).Seconds())
+	if totalSeconds <= 0 {
+		return 60, false
+	}
+	steps := int64(ticks - 1)
+	seconds := totalSeconds / steps
+	if totalSeconds%steps != 0 {
+		seconds += 1
+	}
+	if seconds < 1 {
+		seconds = 1
+	}
+	minSeconds := totalSeconds / (maxIncreaseBuckets - 1)
+	if totalSeconds%(maxIncreaseBuckets-1) != 0 {
+		minSeconds += 1
+	}
+	if seconds < minSeconds {
+		return int(minSeconds), true
+	}
+	return int(seconds), false
+}
+
+// clampIncreaseTicks applies BFF_MAX_INCREASE_TICKS to a requested tick
+// count: 0 or less picks the default, counts past limit are clamped to it
+// (reported by the bool) and counts past limit*rejectIncreaseFactor are
+// rejected outright.
+func clampIncreaseTicks(ticks, limit int) (int, bool, error) {
+	if ticks <= 0 {
+		ticks = defaultIncreaseTicks
+	}
+	if reject := limit * rejectIncreaseFactor; ticks > reject {
+		return 0, false, fmt.Errorf("ticks must be at most %d", reject)
+	}
+	if ticks > limit {
+		return limit, true, nil
+	}
+	return ticks, false, nil
+}
+
+func newSessionManager() *sessionManager {
+	return &sessionManager{
+		sessions: make(map[string]*computeState),
+	}
+}
+
+func (m *sessionManager) getOrCreateID(r *http.Request) (string, bool) {
+	if cookie, err := r.Cookie("mvr_session"); err == nil && cookie.Value != "" {
+		return cookie.Value, false
+	}
+	return newSessionID(), true
+}
+
+func (m *sessionManager) getState(id string) *computeState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if state, ok := m.sessions[id]; ok {
+		return state
+	}
+	return nil
+}
+
+func (m *sessionManager) setState(id string, state *computeState) {
+	if id == "" || state == nil {
+		return
+	}
+	state.UpdatedAt = time.Now().UTC()
+	m.mu.Lock()
+	m.sessions[id] = state
+	m.mu.Unlock()
+}
+
+func (m *sessionManager) updateRange(id string, start, end time.Time, rangeStart, rangeEnd int, computeMode *bool) {
+	if id == "" {
+		return
+	}
+	m.mu.Lock()
+	state, ok := m.sessions[id]
+	if !ok || state == nil {
+		state = &computeState{}
+		m.sessions[id] = state
+	}
+	state.RangeStart = rangeStart
+	state.RangeEnd = rangeEnd
+	state.RangeStartTime = start.UTC().Format(time.RFC3339Nano)
+	state.RangeEndTime = end.UTC().Format(time.RFC3339Nano)
+	if computeMode != nil {
+		state.ComputeMode = *computeMode
+	}
+	state.UpdatedAt = time.Now().UTC()
+	m.mu.Unlock()
+}
+
+func (m *sessionManager) resetState(id string) *computeState {
+	if id == "" {
+		return nil
+	}
+	m.mu.Lock()
+	state := &computeState{
+		ComputeMode: false,
+		RangeStart:  0,
+		RangeEnd:    0,
+		Markers:     nil,
+		TicksRequested: 0,
+		LastSymbol:     "",
+		RangeStartTime: "",
+		RangeEndTime:   "",
+		Resolution:     "",
+		CustomResolutionSeconds: 0,
+		UpdatedAt:      time.Now().UTC(),
+	}
+	m.sessions[id] = state
+	m.mu.Unlock()
+	return state
+}
+
+// errResponseTooLarge means a response is over BFF_MAX_RESPONSE_BYTES and
+// can't be made smaller; it is sent to the client instead.
+var errResponseTooLarge = errors.New("response too large")
+
+// fitResolution checks the encoded size of the message v against limit (0
+// disables it). When it is over and [start, end] still spans more than one
+// bucket, it returns a coarser resolution to retry with, scaled by how far
+// over v is; at one bucket it returns errResponseTooLarge.
+func fitResolution(v any, resolutionSeconds int, start, end time.Time, limit int) (int, bool, error) {
+	if limit <= 0 {
+		return resolutionSeconds, false, nil
+	}
+	size := encodedSize(v)
+	if size <= limit {
+		return resolutionSeconds, false, nil
+	}
+	if resolutionSeconds > int(end.Sub(start).Seconds()) {
+		return resolutionSeconds, false, fmt.Errorf("%w: %d bytes at a single bucket, limit is %d", errResponseTooLarge, size, limit)
+	}
+	if resolutionSeconds <= 0 {
+		resolutionSeconds = defaultResolutionSeconds
+	}
+	return resolutionSeconds * max(2, (size+limit-1)/limit), true, nil
+}
+
+// checkResponseSize returns errResponseTooLarge when the message v encodes
+// to more than limit bytes (0 disables it). It is the check for messages
+// without a resolution to coarsen.
+func checkResponseSize(v any, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	if size := encodedSize(v); size > limit {
+		return fmt.Errorf("%w: %d bytes, limit is %d", errResponseTooLarge, size, limit)
+	}
+	return nil
+}
+
+// encodedSize is the length of v as JSON, or 0 when it can't be encoded;
+// WriteJSON then fails on it anyway.
+func encodedSize(v any) int {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(encoded)
+}
+
+// validMarkerKey trims key and checks it is 1-64 letters, digits or "_-.:".
+func validMarkerKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", errors.New("missing marker")
+	}
+	if len(key) > maxMarkerKeyLen {
+		return "", fmt.Errorf("marker must be at most %d characters", maxMarkerKeyLen)
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.:", r)) {
+			return "", fmt.Errorf("invalid marker %q", key)
+		}
+	}
+	return key, nil
+}
+
+// addMarker sets one marker in the session's state, creating the state if
+// needed, and returns a copy of the resulting set.
+func (m *sessionManager) addMarker(id, key string, value int) (map[string]int, error) {
+	if id == "" {
+		return nil, errors.New("no session")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.sessions[id]
+	if !ok || state == nil {
+		state = &computeState{}
+		m.sessions[id] = state
+	}
+	if _, exists := state.Markers[key]; !exists && len(state.Markers) >= maxMarkers {
+		return nil, fmt.Errorf("at most %d markers per session", maxMarkers)
+	}
+	if state.Markers == nil {
+		state.Markers = make(map[string]int)
+	}
+	state.Markers[key] = value
+	state.UpdatedAt = time.Now().UTC()
+	return copyMarkers(state.Markers), nil
+}
+
+// removeMarker deletes one marker, if present, and returns a copy of the
+// remaining set.
+func (m *sessionManager) removeMarker(id, key string) map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.sessions[id]
+	if !ok || state == nil {
+		return map[string]int{}
+	}
+	if _, exists := state.Markers[key]; exists {
+		delete(state.Markers, key)
+		state.UpdatedAt = time.Now().UTC()
+	}
+	return copyMarkers(state.Markers)
+}
+
+func copyMarkers(markers map[string]int) map[string]int {
+	out := make(map[string]int, len(markers))
+	for k, v := range markers {
+		out[k] = v
+	}
+	return out
+}
+
+// deleteState forgets a session and reports whether it existed.
+func (m *sessionManager) deleteState(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		return false
+	}
+	delete(m.sessions, id)
+	return true
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return hex.EncodeToString(b)
+}
+
+func expireSessionCookie() string {
+	return (&http.Cookie{
+		Name:     "mvr_session",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}).String()
+}
+
+// bearerAuthorized reports whether r carries "Authorization: Bearer token".
+func bearerAuthorized(r *http.Request, token string) bool {
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+func buildSessionCookie(id string) string {
+	return (&http.Cookie{
+		Name:     "mvr_session",
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}).String()
+}
+
+func (p *computeStatePayload) toComputeState() *computeState {
+	if p == nil {
+		return nil
+	}
+	state := &computeState{
+		ComputeMode: p.ComputeMode,
+		RangeStart:  p.RangeStart,
+		RangeEnd:    p.RangeEnd,
+		TicksRequested: p.TicksRequested,
+		LastSymbol:     p.LastSymbol,
+		RangeStartTime: p.RangeStartTime,
+		RangeEndTime:   p.RangeEndTime,
+		Resolution:     p.Resolution,
+		CustomResolutionSeconds: p.CustomResolutionSeconds,
+	}
+	if len(p.Markers) > 0 {
+		state.Markers = make(map[string]int, len(p.Markers))
+		for k, v := range p.Markers {
+			state.Markers[k] = v
+		}
+	}
+	return state
+}
+
+func parseDateTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, errors.New("invalid datetime")
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if ts > 10_000_000_000 {
+			return time.UnixMilli(ts).UTC(), nil
+		}
+		return time.Unix(ts, 0).UTC(), nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed.UTC(), nil
+	}
+	if parsed, err := time.Parse("2006-01-02 15:04:05", value); err == nil {
+		return parsed.UTC(), nil
+	}
+	return time.Time{}, errors.New("invalid datetime format")
+}
+
+// secondsToLabel renders a resolution in the largest whole unit, e.g. 300 ->
+// "5m", 3600 -> "1h", 90 -> "90s".
+func secondsToLabel(seconds int) string {
+	switch {
+	case seconds <= 0:
+		return strconv.Itoa(seconds) + "s"
+	case seconds%86400 == 0:
+		return strconv.Itoa(seconds/86400) + "d"
+	case seconds%3600 == 0:
+		return strconv.Itoa(seconds/3600) + "h"
+	case seconds%60 == 0:
+		return strconv.Itoa(seconds/60) + "m"
+	default:
+		return strconv.Itoa(seconds) + "s"
+	}
+}
+
+func formatDateTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+type minutePrice struct {
+	ts    int64
+	price float64
+	// high and low are the extremes of every tick seen in the minute.
+	high float64
+	low  float64
+	// sources has bit i set when root dir i contributed a tick to this
+	// minute. Root dirs past maxSourceDirs are not tracked.
+	sources uint32
+	// priceSource is the bit of the root dir whose tick set price, and rank
+	// that root's BFF_SOURCE_PRIORITY rank (lower wins; 0 without one).
+	priceSource uint32
+	// secondary is ingestConfig.secondaryField from the tick that set
+	// price, when that tick had it.
+	secondary    float64
+	hasSecondary bool
+	rank         uint8
+	// volume is the minute's summed tick sizes or, with cumulative set, the
+	// highest running session total seen in it (cedro reports volume that
+	// way); volumeCounter turns those into per-minute amounts.
+	volume     int64
+	cumulative bool
+}
+
+// forSource returns a copy of the config that tags ingested points with the
+// bit for root dir index i.
+func (c ingestConfig) forSource(i int) ingestConfig {
+	c.source = 0
+	if i < maxSourceDirs {
+		c.source = 1 << uint(i)
+	}
+	c.sourceTimeUnit = c.sourceTimeUnits[i]
+	c.sourceRank = c.sourceRanks[i]
+	return c
+}
+
+// timeUnitFor returns the configured unit for a time column, falling back to
+// the current source's unit and then to auto detection.
+func (c ingestConfig) timeUnitFor(column string) timeUnit {
+	if unit, ok := c.columnTimeUnits[column]; ok {
+		return unit
+	}
+	return c.sourceTimeUnit
+}
+
+func (c ingestConfig) ignoreDir(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, pattern := range c.ignoreDirs {
+		if matched, err := filepath.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreSymbol reports whether a symbol directory should be skipped, either
+// because it is ignored like any other dir or because BFF_SYMBOL_FILTER is set
+// and does not list it.
+func (c ingestConfig) ignoreSymbol(name string) bool {
+	if c.ignoreDir(name) {
+		return true
+	}
+	return len(c.symbolFilter) > 0 && !c.symbolFilter[c.canonicalSymbol(name)]
+}
+
+// canonicalSymbol maps a symbol directory name to the name it is served
+// under, so data stored under a retired ticker merges into the new one.
+func (c ingestConfig) canonicalSymbol(name string) string {
+	if renamed, ok := c.symbolRenames[name]; ok {
+		return c.foldSymbol(renamed)
+	}
+	return c.foldSymbol(name)
+}
+
+// foldSymbol applies BFF_SYMBOL_CASE; stored keys and requested symbols both
+// go through it, so they always meet in the same case.
+func (c ingestConfig) foldSymbol(name string) string {
+	switch c.symbolCase {
+	case "upper":
+		return strings.ToUpper(name)
+	case "lower":
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// foldSymbolKeys re-keys a per-symbol config map with fold.
+func foldSymbolKeys[V any](m map[string]V, fold func(string) string) map[string]V {
+	if m == nil {
+		return nil
+	}
+	folded := make(map[string]V, len(m))
+	for symbol, value := range m {
+		folded[fold(symbol)] = value
+	}
+	return folded
+}
+
+// parseSymbolRenames parses "OLD:NEW,OLD2:NEW2".
+func parseSymbolRenames(value string) map[string]string {
+	pairs := parseDirs(value)
+	if len(pairs) == 0 {
+		return nil
+	}
+	renames := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		from, to, ok := strings.Cut(pair, ":")
+		from = strings.TrimSpace(from)
+		to = strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			log.Printf("ignoring invalid symbol rename %q", pair)
+			continue
+		}
+		renames[from] = to
+	}
+	return renames
+}
+
+func parseSymbolFilter(value string) map[string]bool {
+	symbols := parseDirs(value)
+	if len(symbols) == 0 {
+		return nil
+	}
+	filter := make(map[string]bool, len(symbols))
+	for _, symbol := range symbols {
+		filter[symbol] = true
+	}
+	return filter
+}
+
+func parsePriceFields(value string) []string {
+	parts := strings.Split(value, ",")
+	fields := make([]string, 0, len(parts))
+	for _, part := range parts {
+		field := strings.ToLower(strings.TrimSpace(part))
+		switch field {
+		case "":
+			continue
+		case "mid", "last", "bid", "ask":
+			fields = append(fields, field)
+		default:
+			log.Printf("ignoring unknown price field %q", field)
+		}
+	}
+	if len(fields) == 0 {
+		return defaultPriceFields
+	}
+	return fields
+}
+
+// priceFormula is a weighted sum of a record's price fields, e.g.
+// 0.5*bid+0.5*ask. It only applies to CSV files with last/bid/ask columns.
+type priceFormula []priceTerm
+
+type priceTerm struct {
+	field  string
+	weight float64
+}
+
+// parsePriceFormulas reads SYMBOL:FORMULA pairs. Invalid formulas are logged
+// and skipped, leaving that symbol on the default price selection.
+func parsePriceFormulas(value string) map[string]priceFormula {
+	pairs := parseDirs(value)
+	if len(pairs) == 0 {
+		return nil
+	}
+	formulas := make(map[string]priceFormula, len(pairs))
+	for _, pair := range pairs {
+		symbol, expr, ok := strings.Cut(pair, ":")
+		symbol = strings.TrimSpace(symbol)
+		if !ok || symbol == "" {
+			log.Printf("ignoring invalid price formula %q", pair)
+			continue
+		}
+		formula, err := parsePriceFormula(expr)
+		if err != nil {
+			log.Printf("ignoring price formula for %s: %v", symbol, err)
+			continue
+		}
+		formulas[symbol] = formula
+	}
+	return formulas
+}
+
+func parsePriceFormula(expr string) (priceFormula, error) {
+	var formula priceFormula
+	for _, raw := range strings.Split(expr, "+") {
+		term := strings.ToLower(strings.TrimSpace(raw))
+		weight := 1.0
+		field := term
+		if w, f, ok := strings.Cut(term, "*"); ok {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+			if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+				return nil, fmt.Errorf("invalid weight in %q", raw)
+			}
+			weight = parsed
+			field = strings.TrimSpace(f)
+		}
+		switch field {
+		case "last", "bid", "ask":
+		default:
+			return nil, fmt.Errorf("unknown field in %q", raw)
+		}
+		formula = append(formula, priceTerm{field: field, weight: weight})
+	}
+	if len(formula) == 0 {
+		return nil, errors.New("empty formula")
+	}
+	return formula, nil
+}
+
+// String renders f in BFF_PRICE_FORMULAS syntax.
+func (f priceFormula) String() string {
+	terms := make([]string, len(f))
+	for i, term := range f {
+		terms[i] = strconv.FormatFloat(term.weight, 'g', -1, 64) + "*" + term.field
+	}
+	return strings.Join(terms, "+")
+}
+
+// eval returns the weighted sum, or false when any field is missing from
+// the record. A nil formula never applies.
+func (f priceFormula) eval(record []string, idxLast, idxBid, idxAsk int) (float64, bool) {
+	if len(f) == 0 {
+		return 0, false
+	}
+	total := 0.0
+	for _, term := range f {
+		idx := idxLast
+		switch term.field {
+		case "bid":
+			idx = idxBid
+		case "ask":
+			idx = idxAsk
+		}
+		value, ok := parseRecordFloat(record, idx)
+		if !ok {
+			return 0, false
+		}
+		total += term.weight * value
+	}
+	return total, true
+}
+
+func parsePrice(record []string, fields []string, idxLast, idxBid, idxAsk int) (float64, bool) {
+	for _, field := range fields {
+		switch field {
+		case "last":
+			if value, ok := parseRecordFloat(record, idxLast); ok {
+				return value, true
+			}
+		case "bid":
+			if value, ok := parseRecordFloat(record, idxBid); ok {
+				return value, true
+			}
+		case "ask":
+			if value, ok := parseRecordFloat(record, idxAsk); ok {
+				return value, true
+			}
+		case "mid":
+			bid, okBid := parseRecordFloat(record, idxBid)
+			ask, okAsk := parseRecordFloat(record, idxAsk)
+			if okBid && okAsk {
+				return (bid + ask) / 2, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func parseRecordFloat(record []string, idx int) (float64, bool) {
+	if idx < 0 || idx >= len(record) {
+		return 0, false
+	}
+	return parseFloat(record[idx])
+}
+
+func parseFloat(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+func indexOf(values []string, key string) int {
+	for i, value := range values {
+		if strings.EqualFold(strings.TrimSpace(value), key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func newDataStore(ingest ingestConfig) *dataStore {
+	s := &dataStore{
+		ingest: ingest,
+		boot:   newSessionID()[:8],
+	}
+	data := &storeData{}
+	for i := range data.shards {
+		data.shards[i] = storeShard{
+			qualityBySymbol: make(map[string]map[int64]bool),
+			priceBySymbol:   make(map[string]map[int64]minutePrice),
+		}
+	}
+	s.data.Store(data)
+	return s
+}
+
+func shardIndex(symbol string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(symbol))
+	return h.Sum32() % storeShardCount
+}
+
+// swap publishes freshly loaded maps as the next generation, shards and
+// range in one step.
+func (s *dataStore) swap(sourceDirs []string, startTS, endTS int64, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice) {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	next := &storeData{
+		startTS:    startTS,
+		endTS:      endTS,
+		generation: s.data.Load().generation + 1,
+		loadedAt:   time.Now().UTC(),
+	}
+	for i := range next.shards {
+		next.shards[i] = storeShard{
+			qualityBySymbol: make(map[string]map[int64]bool),
+			priceBySymbol:   make(map[string]map[int64]minutePrice),
+		}
+	}
+	for symbol, minutes := range quality {
+		shard := &next.shards[shardIndex(symbol)]
+		shard.qualityBySymbol[symbol] = minutes
+		shard.priceBySymbol[symbol] = prices[symbol]
+	}
+
+	s.mu.Lock()
+	s.sourceDirs = sourceDirs
+	s.mu.Unlock()
+	s.data.Store(next)
+}
+
+func (s *dataStore) symbolPoints(symbol string) map[int64]minutePrice {
+	return s.data.Load().points(s.ingest.foldSymbol(symbol))
+}
+
+func (d *storeData) points(symbol string) map[int64]minutePrice {
+	return d.shards[shardIndex(symbol)].priceBySymbol[symbol]
+}
+
+// priceFloor picks the request's min_price over the store default.
+func (s *dataStore) priceFloor(requested *float64) *float64 {
+	if requested != nil {
+		return requested
+	}
+	return s.minPrice
+}
+
+// abovePriceFloor reports whether price is usable under floor; a nil floor
+// accepts everything.
+func abovePriceFloor(price float64, floor *float64) bool {
+	return floor == nil || price > *floor
+}
+
+// qualitySnapshot returns the per-symbol minute coverage across all shards.
+// The inner maps are shared, not copied; they are never mutated after swap.
+func (s *dataStore) qualitySnapshot() map[string]map[int64]bool {
+	return s.data.Load().qualitySnapshot()
+}
+
+func (d *storeData) qualitySnapshot() map[string]map[int64]bool {
+	snapshot := make(map[string]map[int64]bool)
+	for _, shard := range d.shards {
+		for symbol, minutes := range shard.qualityBySymbol {
+			snapshot[symbol] = minutes
+		}
+	}
+	return snapshot
+}
+
+func (s *dataStore) recordReloadFailure() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadFailures++
+	return s.reloadFailures
+}
+
+func (s *dataStore) recordReloadSuccess() {
+	s.mu.Lock()
+	s.reloadFailures = 0
+	s.mu.Unlock()
+}
+
+func (s *dataStore) consecutiveReloadFailures() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reloadFailures
+}
+
+func (s *dataStore) lastLoadedAt() time.Time {
+	return s.data.Load().loadedAt
+}
+
+// bounds returns the loaded range with the generationToken of the data it
+// belongs to.
+func (s *dataStore) bounds() (startTS, endTS int64, generation string) {
+	return s.data.Load().bounds(s.boot)
+}
+
+func (d *storeData) bounds(boot string) (startTS, endTS int64, generation string) {
+	return d.startTS, d.endTS, boot + "-" + strconv.FormatUint(d.generation, 10)
+}
+
+func (s *dataStore) loadFromDirs(rootDirs []string) error {
+	result, readable, err := s.loadRoots(rootDirs, loadFromDir)
+	if err != nil {
+		return err
+	}
+
+	if len(result.quality) == 0 && len(s.listSymbolsWithCoverage(0)) > 0 {
+		if readable == 0 {
+			return errNoReadableDataDirs
+		}
+		return errEmptyReload
+	}
+
+	s.swap(rootDirs, result.startTS, result.endTS, result.quality, result.prices)
+
+	return nil
+}
+
+func (s *dataStore) loadFromDirsRange(rootDirs []string, start, end time.Time) error {
+	startMs := start.UTC().UnixMilli()
+	endMs := end.UTC().UnixMilli()
+
+	result, _, err := s.loadRoots(rootDirs, func(rootDir string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, startTS, endTS *int64, stats *loadStats) error {
+		return loadFromDirRange(rootDir, startMs, endMs, cfg, quality, prices, startTS, endTS, stats)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.swap(rootDirs, result.startTS, result.endTS, result.quality, result.prices)
+
+	return nil
+}
+
+// rootLoad is what one or more root dirs contributed to a load.
+type rootLoad struct {
+	quality map[string]map[int64]bool
+	prices  map[string]map[int64]minutePrice
+	startTS int64
+	endTS   int64
+	stats   loadStats
+}
+
+// loadStats counts the files a root load ingested and the ones it skipped
+// because ingestFile failed on them.
+type loadStats struct {
+	files    int
+	skipped  int
+	lastSkip string
+}
+
+// ingest runs ingestFile on path. Outside strict mode a failing file is
+// logged and counted instead of failing the whole load.
+func (st *loadStats) ingest(path string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, startTS, endTS *int64) error {
+	if err := ingestFile(path, cfg, quality, prices, startTS, endTS); err != nil {
+		if cfg.strict {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		log.Printf("skipping %s: %v", path, err)
+		st.skipped++
+		st.lastSkip = fmt.Sprintf("%s: %v", path, err)
+		return nil
+	}
+	st.files++
+	return nil
+}
+
+type rootLoader func(rootDir string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, startTS, endTS *int64, stats *loadStats) error
+
+// loadRoots loads each existing root dir into its own maps, running at most
+// s.loadConcurrency roots at a time, and merges them. A minute present in
+// several roots keeps the latest tick. Errors from every root are joined;
+// readable counts the roots that exist. Each root's outcome is recorded for
+// dataSources whether or not the load succeeds.
+func (s *dataStore) loadRoots(rootDirs []string, load rootLoader) (rootLoad, int, error) {
+	limit := s.loadConcurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	results := make([]rootLoad, len(rootDirs))
+	errs := make([]error, len(rootDirs))
+	readable := make([]bool, len(rootDirs))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, rootDir := range rootDirs {
+		if strings.TrimSpace(rootDir) == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, rootDir string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if _, err := os.Stat(rootDir); err != nil {
+				if !os.IsNotExist(err) {
+					errs[i] = err
+				}
+				return
+			}
+			readable[i] = true
+			result := rootLoad{
+				quality: make(map[string]map[int64]bool),
+				prices:  make(map[string]map[int64]minutePrice),
+			}
+			if err := load(rootDir, s.ingest.forSource(i), result.quality, result.prices, &result.startTS, &result.endTS, &result.stats); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", rootDir, err)
+				return
+			}
+			if result.stats.skipped > 0 {
+				log.Printf("%s: skipped %d unreadable files", rootDir, result.stats.skipped)
+			}
+			results[i] = result
+		}(i, rootDir)
+	}
+	wg.Wait()
+	s.recordSources(rootDirs, results, readable, errs)
+
+	if err := errors.Join(errs...); err != nil {
+		return rootLoad{}, 0, err
+	}
+
+	merged := newRootLoad()
+	count := 0
+	for i, result := range results {
+		if !readable[i] {
+			continue
+		}
+		count++
+		merged.absorb(result)
+	}
+	return merged, count, nil
+}
+
+func newRootLoad() rootLoad {
+	return rootLoad{
+		quality: make(map[string]map[int64]bool),
+		prices:  make(map[string]map[int64]minutePrice),
+	}
+}
+
+// absorb merges another root's load into m. Minutes both hold go through
+// mergeMinutePrice, so two roots that saw the same trades don't add up
+// their volumes the way ticks of one root do. result's maps may be reused.
+func (m *rootLoad) absorb(result rootLoad) {
+	if result.startTS != 0 && (m.startTS == 0 || result.startTS < m.startTS) {
+		m.startTS = result.startTS
+	}
+	if result.endTS > m.endTS {
+		m.endTS = result.endTS
+	}
+	for symbol, minutes := range result.quality {
+		if m.quality[symbol] == nil {
+			m.quality[symbol] = minutes
+			m.prices[symbol] = result.prices[symbol]
+			continue
+		}
+		for minute := range minutes {
+			m.quality[symbol][minute] = true
+		}
+		for minute, point := range result.prices[symbol] {
+			current, exists := m.prices[symbol][minute]
+			m.prices[symbol][minute] = mergeMinutePrice(current, exists, point)
+		}
+	}
+}
+
+// recordSources replaces the per-root load report. A root that failed keeps
+// the LoadedAt of its previous successful load.
+func (s *dataStore) recordSources(rootDirs []string, results []rootLoad, readable []bool, errs []error) {
+	now := formatDateTime(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := make(map[string]string, len(s.sources))
+	for _, source := range s.sources {
+		previous[source.Dir] = source.LoadedAt
+	}
+	sources := make([]dataSourceStatus, 0, len(rootDirs))
+	for i, rootDir := range rootDirs {
+		if strings.TrimSpace(rootDir) == "" {
+			continue
+		}
+		source := dataSourceStatus{Dir: rootDir, Exists: readable[i], LoadedAt: previous[rootDir]}
+		if errs[i] != nil {
+			source.Error = errs[i].Error()
+		} else if readable[i] {
+			source.Readable = true
+			source.SymbolCount = len(results[i].quality)
+			source.FileCount = results[i].stats.files
+			source.SkippedFiles = results[i].stats.skipped
+			source.LastSkipError = results[i].stats.lastSkip
+			source.LoadedAt = now
+		}
+		sources = append(sources, source)
+	}
+	s.sources = sources
+}
+
+// dataSources returns the per-root report of the latest load.
+func (s *dataStore) dataSources() []dataSourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]dataSourceStatus(nil), s.sources...)
+}
+
+// mergeMinutePrice combines two observations of the same minute: the one
+// from the better-ranked source wins, then the later tick; the extremes
+// widen and the source bits of both are kept. Ranking by source first keeps
+// overlapping roots from trading the minute back and forth between reloads.
+func mergeMinutePrice(current minutePrice, exists bool, point minutePrice) minutePrice {
+	if !exists {
+		return point
+	}
+	merged := current
+	if point.rank < current.rank || (point.rank == current.rank && point.ts > current.ts) {
+		merged = point
+	}
+	merged.sources = current.sources | point.sources
+	merged.high = math.Max(current.high, point.high)
+	merged.low = math.Min(current.low, point.low)
+	// Another root, or a re-read of a file that grew, sees the same trades:
+	// keep the larger total rather than adding them up.
+	if current.cumulative == point.cumulative {
+		merged.volume = max(current.volume, point.volume)
+	}
+	return merged
+}
+
+// mergeFiles ingests paths on top of the current data and publishes the
+// result as a new generation. Only the symbols the files touch are copied;
+// re-ingesting a file that grew since its last load is harmless.
+func (s *dataStore) mergeFiles(rootDirs []string, paths []string) error {
+	// Each root is ingested on its own and then merged, as a full load
+	// does, so one minute seen by two roots isn't counted twice.
+	bySource := make(map[int]*rootLoad)
+	for _, path := range paths {
+		source, dateName, symbolDir, ok := splitDataPath(rootDirs, path)
+		if !ok || s.ingest.ignoreDir(dateName) || s.ingest.ignoreSymbol(symbolDir) {
+			continue
+		}
+		load := bySource[source]
+		if load == nil {
+			fresh := newRootLoad()
+			load = &fresh
+			bySource[source] = load
+		}
+		updateRangeFromPath(dateName, filepath.Base(path), &load.startTS, &load.endTS)
+		if err := ingestFile(path, s.ingest.forSource(source), load.quality, load.prices, &load.startTS, &load.endTS); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			if s.ingest.strict {
+				return err
+			}
+			log.Printf("skipping %s: %v", path, err)
+		}
+	}
+	batch := newRootLoad()
+	for _, load := range bySource {
+		batch.absorb(*load)
+	}
+	quality, prices, startTS, endTS := batch.quality, batch.prices, batch.startTS, batch.endTS
+	if len(quality) == 0 {
+		return nil
+	}
+
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	current := s.data.Load()
+	next := *current
+	next.generation++
+	next.loadedAt = time.Now().UTC()
+	if startTS != 0 && (next.startTS == 0 || startTS < next.startTS) {
+		next.startTS = startTS
+	}
+	if endTS > next.endTS {
+		next.endTS = endTS
+	}
+	// Shards the batch touches get fresh top-level maps; the rest are
+	// shared with the current generation.
+	var copied [storeShardCount]bool
+	for symbol, minutes := range quality {
+		idx := shardIndex(symbol)
+		shard := &next.shards[idx]
+		if !copied[idx] {
+			shard.qualityBySymbol = maps.Clone(shard.qualityBySymbol)
+			shard.priceBySymbol = maps.Clone(shard.priceBySymbol)
+			copied[idx] = true
+		}
+		currentQuality := shard.qualityBySymbol[symbol]
+		currentPrices := shard.priceBySymbol[symbol]
+
+		mergedQuality := make(map[int64]bool, len(currentQuality)+len(minutes))
+		for minute := range currentQuality {
+			mergedQuality[minute] = true
+		}
+		mergedPrices := make(map[int64]minutePrice, len(currentPrices)+len(prices[symbol]))
+		for minute, point := range currentPrices {
+			mergedPrices[minute] = point
+		}
+		for minute := range minutes {
+			mergedQuality[minute] = true
+		}
+		for minute, point := range prices[symbol] {
+			current, exists := mergedPrices[minute]
+			mergedPrices[minute] = mergeMinutePrice(current, exists, point)
+		}
+
+		shard.qualityBySymbol[symbol] = mergedQuality
+		shard.priceBySymbol[symbol] = mergedPrices
+	}
+	s.data.Store(&next)
+	return nil
+}
+
+// Uploaders lay minute files out as <root>/<date>/<symbol>/HH_MM.csv, with
+// <date> either a flat YYYY-MM-DD dir or nested YYYY/MM/DD dirs. A
+// four-digit top-level dir marks the nested layout; both can share a root.
+
+// isYearDir reports whether name is the top dir of a nested YYYY/MM/DD date.
+func isYearDir(name string) bool {
+	if len(name) != 4 {
+		return false
+	}
+	for _, r := range name {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// dateLevels is how many leading parts of a root-relative path name the
+// date: 3 for YYYY/MM/DD, 1 otherwise.
+func dateLevels(parts []string) int {
+	if len(parts) > 0 && isYearDir(parts[0]) {
+		return 3
+	}
+	return 1
+}
+
+// dateDir is one day's directory; name is always YYYY-MM-DD style, whatever
+// the layout on disk.
+type dateDir struct {
+	name string
+	path string
+}
+
+// listDateDirs lists the date dirs of rootDir in either layout, skipping
+// those ignore matches.
+func listDateDirs(rootDir string, ignore func(string) bool) ([]dateDir, error) {
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make([]dateDir, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || ignore(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(rootDir, entry.Name())
+		if !isYearDir(entry.Name()) {
+			dirs = append(dirs, dateDir{name: entry.Name(), path: path})
+			continue
+		}
+		months, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, month := range months {
+			if !month.IsDir() {
+				continue
+			}
+			days, err := os.ReadDir(filepath.Join(path, month.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, day := range days {
+				name := entry.Name() + "-" + month.Name() + "-" + day.Name()
+				if !day.IsDir() || ignore(name) {
+					continue
+				}
+				dirs = append(dirs, dateDir{name: name, path: filepath.Join(path, month.Name(), day.Name())})
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// splitDataPath maps a minute file under one of rootDirs to the root's index
+// and its date (as YYYY-MM-DD) and symbol directory names.
+func splitDataPath(rootDirs []string, path string) (source int, dateName, symbolDir string, ok bool) {
+	if !strings.HasSuffix(path, ".csv") {
+		return 0, "", "", false
+	}
+	for i, rootDir := range rootDirs {
+		if strings.TrimSpace(rootDir) == "" {
+			continue
+		}
+		rel, err := filepath.Rel(rootDir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		levels := dateLevels(parts)
+		if len(parts) != levels+2 {
+			return 0, "", "", false
+		}
+		return i, strings.Join(parts[:levels], "-"), parts[levels], true
+	}
+	return 0, "", "", false
+}
+
+func loadFromDir(rootDir string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, startTS, endTS *int64, stats *loadStats) error {
+	dateDirs, err := listDateDirs(rootDir, cfg.ignoreDir)
+	if err != nil {
+		return err
+	}
+
+	for _, date := range dateDirs {
+		dateName, datePath := date.name, date.path
+		symbolDirs, err := os.ReadDir(datePath)
+		if err != nil {
+			return err
+		}
+		for _, symbolEntry := range symbolDirs {
+			if !symbolEntry.IsDir() || cfg.ignoreSymbol(symbolEntry.Name()) {
+				continue
+			}
+			symbol := symbolEntry.Name()
+			symbolPath := filepath.Join(datePath, symbol)
+			files, err := os.ReadDir(symbolPath)
+			if err != nil {
+				return err
+			}
+			for _, fileEntry := range files {
+				if fileEntry.IsDir() {
+					continue
+				}
+				name := fileEntry.Name()
+				if !strings.HasSuffix(name, ".csv") {
+					continue
+				}
+				updateRangeFromPath(dateName, name, startTS, endTS)
+				path := filepath.Join(symbolPath, name)
+				if err := stats.ingest(path, cfg, quality, prices, startTS, endTS); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func loadFromDirRange(rootDir string, startMs, endMs int64, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, startTS, endTS *int64, stats *loadStats) error {
+	dateDirs, err := listDateDirs(rootDir, cfg.ignoreDir)
+	if err != nil {
+		return err
+	}
+
+	for _, date := range dateDirs {
+		dateName, datePath := date.name, date.path
+		if dateDirOutsideRange(dateName, startMs, endMs) {
+			continue
+		}
+		symbolDirs, err := os.ReadDir(datePath)
+		if err != nil {
+			return err
+		}
+		for _, symbolEntry := range symbolDirs {
+			if !symbolEntry.IsDir() || cfg.ignoreSymbol(symbolEntry.Name()) {
+				continue
+			}
+			symbolPath := filepath.Join(datePath, symbolEntry.Name())
+			files, err := os.ReadDir(symbolPath)
+			if err != nil {
+				return err
+			}
+			for _, fileEntry := range files {
+				if fileEntry.IsDir() {
+					continue
+				}
+				name := fileEntry.Name()
+				if !strings.HasSuffix(name, ".csv") {
+					continue
+				}
+				ts, ok := parseDirFileTimestamp(dateName, name)
+				if !ok {
+					continue
+				}
+				if ts < startMs || ts > endMs {
+					continue
+				}
+				updateRangeFromPath(dateName, name, startTS, endTS)
+				path := filepath.Join(symbolPath, name)
+				if err := stats.ingest(path, cfg, quality, prices, startTS, endTS); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// previewRange counts the minute files that fall in [start, end] using only
+// directory listings, so clients can check a range before loading it.
+func (s *dataStore) previewRange(rootDirs []string, start, end time.Time) (rangePreviewResponse, error) {
+	startMs := start.UTC().UnixMilli()
+	endMs := end.UTC().UnixMilli()
+	symbols := make(map[string]struct{})
+	fileCount := 0
+
+	for _, rootDir := range rootDirs {
+		if strings.TrimSpace(rootDir) == "" {
+			continue
+		}
+		dateDirs, err := listDateDirs(rootDir, s.ingest.ignoreDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return rangePreviewResponse{}, err
+		}
+		for _, date := range dateDirs {
+			dateName, datePath := date.name, date.path
+			if dateDirOutsideRange(dateName, startMs, endMs) {
+				continue
+			}
+			symbolDirs, err := os.ReadDir(datePath)
+			if err != nil {
+				return rangePreviewResponse{}, err
+			}
+			for _, symbolEntry := range symbolDirs {
+				if !symbolEntry.IsDir() || s.ingest.ignoreSymbol(symbolEntry.Name()) {
+					continue
+				}
+				files, err := os.ReadDir(filepath.Join(datePath, symbolEntry.Name()))
+				if err != nil {
+					return rangePreviewResponse{}, err
+				}
+				for _, fileEntry := range files {
+					if fileEntry.IsDir() || !strings.HasSuffix(fileEntry.Name(), ".csv") {
+						continue
+					}
+					ts, ok := parseDirFileTimestamp(dateName, fileEntry.Name())
+					if !ok || ts < startMs || ts > endMs {
+						continue
+					}
+					fileCount++
+					symbols[s.ingest.canonicalSymbol(symbolEntry.Name())] = struct{}{}
+				}
+			}
+		}
+	}
+
+	return rangePreviewResponse{
+		Start:       start.UTC().Format(time.RFC3339),
+		End:         end.UTC().Format(time.RFC3339),
+		HasData:     fileCount > 0,
+		SymbolCount: len(symbols),
+		FileCount:   fileCount,
+	}, nil
+}
+
+func updateRangeFromPath(dateName, fileName string, minTS, maxTS *int64) {
+	ts, ok := parseDirFileTimestamp(dateName, fileName)
+	if !ok {
+		return
+	}
+	if *minTS == 0 || ts < *minTS {
+		*minTS = ts
+	}
+	if *maxTS == 0 || ts > *maxTS {
+		*maxTS = ts
+	}
+}
+
+func parseDirDate(dateName string) (time.Time, bool) {
+	dateParts := strings.Split(dateName, "-")
+	if len(dateParts) != 3 {
+		return time.Time{}, false
+	}
+	year, err := strconv.Atoi(dateParts[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	month, err := strconv.Atoi(dateParts[1])
+	if err != nil || month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	day, err := strconv.Atoi(dateParts[2])
+	if err != nil || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC), true
+}
+
+// dateDirOutsideRange reports whether a date directory cannot contain any
+// minute file in [startMs, endMs]. Unparseable names are not skipped.
+func dateDirOutsideRange(dateName string, startMs, endMs int64) bool {
+	day, ok := parseDirDate(dateName)
+	if !ok {
+		return false
+	}
+	firstMs := day.UnixMilli()
+	lastMs := day.Add(24*time.Hour - time.Minute).UnixMilli()
+	return lastMs < startMs || firstMs > endMs
+}
+
+func parseDirFileTimestamp(dateName, fileName string) (int64, bool) {
+	day, ok := parseDirDate(dateName)
+	if !ok {
+		return 0, false
+	}
+
+	baseName := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	timeParts := strings.Split(baseName, "_")
+	if len(timeParts) != 2 {
+		return 0, false
+	}
+	hour, err := strconv.Atoi(timeParts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, false
+	}
+	minute, err := strconv.Atoi(timeParts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, false
+	}
+
+	t := day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	return t.UnixMilli(), true
+}
+
+// generationToken names the loaded data for ETags and generation checks.
+// The generation counter restarts at 0 with the process, so it is prefixed
+// with a per-boot nonce: a token from before a restart never matches.
+func (s *dataStore) generationToken() string {
+	_, _, generation := s.bounds()
+	return generation
+}
+
+// timeframeGrid is the bucket layout of the timeframe response: the data's
+// minute bounds split at a resolution picked from their span.
+type timeframeGrid struct {
+	startMinute       time.Time
+	resolutionMinutes int
+	resolutionLabel   string
+	bucketCount       int
+}
+
+func newTimeframeGrid(startTS, endTS int64) timeframeGrid {
+	grid := timeframeGrid{
+		startMinute:       time.UnixMilli(startTS).UTC().Truncate(time.Minute),
+		resolutionMinutes: 1,
+		resolutionLabel:   "1m",
+	}
+	endMinute := time.UnixMilli(endTS).UTC().Truncate(time.Minute)
+	totalMinutes := int(endMinute.Sub(grid.startMinute).Minutes())
+	if totalMinutes < 0 {
+		totalMinutes = 0
+	}
+	switch {
+	case totalMinutes > 7*24*60:
+		grid.resolutionMinutes = 12 * 60
+		grid.resolutionLabel = "12h"
+	case totalMinutes > 24*60:
+		grid.resolutionMinutes = 60
+		grid.resolutionLabel = "1h"
+	case totalMinutes > 6*60:
+		grid.resolutionMinutes = 10
+		grid.resolutionLabel = "10m"
+	case totalMinutes > 2*60:
+		grid.resolutionMinutes = 5
+		grid.resolutionLabel = "5m"
+	}
+	grid.bucketCount = totalMinutes/grid.resolutionMinutes + 1
+	return grid
+}
+
+// indexRange maps inclusive timeframe bucket indices, as kept in
+// computeState.RangeStart/RangeEnd, to the time span they cover.
+func (g timeframeGrid) indexRange(first, last int) (time.Time, time.Time, error) {
+	if first < 0 || last < first || last >= g.bucketCount {
+		return time.Time{}, time.Time{}, fmt.Errorf("bucket indices must satisfy 0 <= range_start <= range_end < %d", g.bucketCount)
+	}
+	resolution := time.Duration(g.resolutionMinutes) * time.Minute
+	start := g.startMinute.Add(time.Duration(first) * resolution)
+	end := g.startMinute.Add(time.Duration(last+1)*resolution - time.Second)
+	return start, end, nil
+}
+
+// buildTimeframeResponse reports per-symbol coverage over the loaded bounds,
+// rows ordered by order. With bySource each symbol gets one row per root dir
+// that contributed to it instead of a single merged row.
+func (s *dataStore) buildTimeframeResponse(ctx context.Context, minCoverage int, bySource bool, order string) (timeframeResponse, error) {
+	defer startSpan(ctx, "timeframe")()
+	data := s.data.Load()
+	startTS, endTS, generation := data.bounds(s.boot)
+	qualityBySymbol := data.qualitySnapshot()
+	for symbol, minutes := range qualityBySymbol {
+		if len(minutes) < minCoverage {
+			delete(qualityBySymbol, symbol)
+		}
+	}
+
+	if startTS <= 0 || endTS <= 0 || len(qualityBySymbol) == 0 {
+		now := time.Now().UTC()
+		return timeframeResponse{
+			Start:        now.Add(-s.emptyRange).Format(time.RFC3339),
+			End:          now.Format(time.RFC3339),
+			Resolution:   "1m",
+			FrameQuality: []symbolFrameQuality{},
+			Generation:   generation,
+			NoData:       true,
+		}, nil
+	}
+
+	startTime := time.UnixMilli(startTS).UTC()
+	endTime := time.UnixMilli(endTS).UTC()
+	grid := newTimeframeGrid(startTS, endTS)
+	startMinute := grid.startMinute
+	resolutionMinutes, resolutionLabel, bucketCount := grid.resolutionMinutes, grid.resolutionLabel, grid.bucketCount
+
+	symbols := make([]string, 0, len(qualityBySymbol))
+	for symbol := range qualityBySymbol {
+		symbols = append(symbols, symbol)
+	}
+	s.sortSymbols(symbols, order)
+
+	s.mu.RLock()
+	sources := s.sourceDirs
+	s.mu.RUnlock()
+	if len(sources) > maxSourceDirs {
+		sources = sources[:maxSourceDirs]
+	}
+
+	quality := make([]symbolFrameQuality, 0, len(symbols))
+	for _, symbol := range symbols {
+		if err := ctx.Err(); err != nil {
+			return timeframeResponse{}, err
+		}
+		if bySource {
+			rows := make([][]int, len(sources))
+			for minute, point := range data.points(symbol) {
+				index := int(time.Unix(minute, 0).UTC().Sub(startMinute).Minutes()) / resolutionMinutes
+				if index < 0 || index >= bucketCount {
+					continue
+				}
+				for i := range sources {
+					if point.sources&(1<<uint(i)) == 0 {
+						continue
+					}
+					if rows[i] == nil {
+						rows[i] = make([]int, bucketCount)
+					}
+					rows[i][index] = 1
+				}
+			}
+			for i, flags := range rows {
+				if flags != nil {
+					quality = append(quality, symbolFrameQuality{Symbol: symbol, Source: sources[i], Quality: flags})
+				}
+			}
+			continue
+		}
+		flags := make([]int, bucketCount)
+		for minute := range qualityBySymbol[symbol] {
+			tsTime := time.Unix(minute, 0).UTC().Truncate(time.Minute)
+			index := int(tsTime.Sub(startMinute).Minutes()) / resolutionMinutes
+			if index >= 0 && index < bucketCount {
+				flags[index] = 1
+			}
+		}
+		quality = append(quality, symbolFrameQuality{
+			Symbol:  symbol,
+			Quality: flags,
+		})
+	}
+
+	return timeframeResponse{
+		Start:        startTime.Format(time.RFC3339),
+		End:          endTime.Format(time.RFC3339),
+		Resolution:   resolutionLabel,
+		FrameQuality: quality,
+		ClosedDates:  s.calendar.closedBetween(startTime, endTime),
+		Generation:   generation,
+	}, nil
+}
+
+// buildPriceOverview buckets symbol's minutes over [start, end]. With
+// includeExtremes the highest and lowest tick of each bucket are returned
+// alongside the representative price. Minutes priced at or below a non-nil
+// minPrice are treated as missing.
+func (s *dataStore) buildPriceOverview(ctx context.Context, symbol string, start, end time.Time, resolutionSeconds int, includeExtremes, withSecondary bool, minPrice *float64) (priceOverviewResponse, bool, error) {
+	defer startSpan(ctx, "price_overview")()
+	start = start.UTC().Truncate(time.Second)
+	end = end.UTC().Truncate(time.Second)
+	if resolutionSeconds <= 0 {
+		resolutionSeconds = defaultResolutionSeconds
+	}
+	resolutionDuration := time.Duration(resolutionSeconds) * time.Second
+	if end.Before(start) {
+		end = start
+	}
+	totalSeconds := int(end.Sub(start).Seconds())
+	if totalSeconds < 0 {
+		totalSeconds = 0
+	}
+	buckets := totalSeconds/resolutionSeconds + 1
+
+	datetimes := make([]string, 0, buckets)
+	prices := make([]*float64, 0, buckets)
+	var highs, lows, secondaries []*float64
+	if includeExtremes {
+		highs = make([]*float64, 0, buckets)
+		lows = make([]*float64, 0, buckets)
+	}
+	if withSecondary {
+		secondaries = make([]*float64, 0, buckets)
+	}
+
+	points := s.symbolPoints(symbol)
+	if len(points) == 0 {
+		return priceOverviewResponse{}, false, nil
+	}
+	volumesSeen := volumeCounter{points: points}
+	volumes := make([]*int64, 0, buckets)
+	hasVolume := false
+
+	hasAny := false
+	for i := 0; i < buckets; i++ {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return priceOverviewResponse{}, false, err
+			}
+		}
+		bucketStart := start.Add(time.Duration(i) * resolutionDuration)
+		if bucketStart.After(end) {
+			break
+		}
+		bucketEnd := bucketStart.Add(resolutionDuration - time.Second)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+		datetimes = append(datetimes, formatDateTime(bucketStart))
+
+		var latest, high, low, secondary *float64
+		var volume *int64
+		observe := func(point minutePrice) {
+			if !abovePriceFloor(point.price, minPrice) {
+				return
+			}
+			if amount, ok := volumesSeen.take(point); ok {
+				if volume == nil {
+					volume = new(int64)
+				}
+				*volume += amount
+				hasVolume = hasVolume || point.volume > 0
+			}
+			value := point.price
+			latest = &value
+			secondary = nil
+			if point.hasSecondary {
+				other := point.secondary
+				secondary = &other
+			}
+			if !includeExtremes {
+				return
+			}
+			if high == nil || point.high > *high {
+				h := point.high
+				high = &h
+			}
+			// A bad print can drag the minute's low under the floor even
+			// when its last price is fine.
+			pointLow := point.low
+			if !abovePriceFloor(pointLow, minPrice) {
+				pointLow = point.price
+			}
+			if low == nil || pointLow < *low {
+				low = &pointLow
+			}
+		}
+		if resolutionSeconds < 60 {
+			// A minute holds one price, stamped with its latest tick. Only
+			// the bucket that tick falls in gets it, so the minute is not
+			// repeated across all of its sub-minute buckets.
+			firstMs, lastMs := bucketStart.UnixMilli(), bucketEnd.UnixMilli()+999
+			for t := bucketStart.Truncate(time.Minute); !t.After(bucketEnd); t = t.Add(time.Minute) {
+				point, ok := points[t.Unix()]
+				if ok && point.ts >= firstMs && point.ts <= lastMs {
+					observe(point)
+				}
+			}
+		} else {
+			for t := bucketStart.Truncate(time.Minute); !t.After(bucketEnd); t = t.Add(time.Minute) {
+				key := t.Unix()
+				point, ok := points[key]
+				if !ok {
+					continue
+				}
+				observe(point)
+			}
+		}
+		if includeExtremes {
+			highs = append(highs, high)
+			lows = append(lows, low)
+		}
+		if withSecondary {
+			secondaries = append(secondaries, secondary)
+		}
+		volumes = append(volumes, volume)
+		if latest == nil {
+			prices = append(prices, nil)
+			continue
+		}
+		prices = append(prices, latest)
+		hasAny = true
+	}
+
+	if !hasAny {
+		return priceOverviewResponse{}, false, nil
+	}
+
+	resp := priceOverviewResponse{
+		Resolution:        strconv.Itoa(resolutionSeconds) + "s",
+		ResolutionLabel:   secondsToLabel(resolutionSeconds),
+		ResolutionSeconds: resolutionSeconds,
+		FirstBucketEpoch:  start.Unix(),
+		BucketCount:       len(datetimes),
+		Start:             formatDateTime(start),
+		End:               formatDateTime(end),
+		Prices:            prices,
+		Highs:             highs,
+		Lows:              lows,
+		Datetimes:         datetimes,
+	}
+	if withSecondary {
+		resp.SecondaryField = s.ingest.secondaryField
+		resp.Secondary = secondaries
+	}
+	if hasVolume {
+		resp.Volumes = volumes
+	}
+	return resp, true, nil
+}
+
+// volumeCounter hands out each minute's volume once, to the first bucket
+// that observes it; overlapping buckets can see the same minute. A
+// cumulative reading counts as its increase over the previous reading of
+// the same UTC day, or in full when there is none or the total went down.
+type volumeCounter struct {
+	points  map[int64]minutePrice
+	lastKey int64
+	prevKey int64
+	prevCum int64
+}
+
+func (c *volumeCounter) take(point minutePrice) (int64, bool) {
+	key := time.UnixMilli(point.ts).UTC().Truncate(time.Minute).Unix()
+	if key <= c.lastKey {
+		return 0, false
+	}
+	c.lastKey = key
+	if !point.cumulative {
+		return point.volume, true
+	}
+	volume := point.volume
+	if prev, ok := c.previousTotal(key); ok && prev <= point.volume {
+		volume = point.volume - prev
+	}
+	c.prevKey, c.prevCum = key, point.volume
+	return volume, true
+}
+
+func (c *volumeCounter) previousTotal(key int64) (int64, bool) {
+	day := key - key%86400
+	if c.prevKey >= day {
+		return c.prevCum, true
+	}
+	for k := key - 60; k >= day; k -= 60 {
+		if point, ok := c.points[k]; ok && point.cumulative {
+			return point.volume, true
+		}
+	}
+	return 0, false
+}
+
+// buildTWAP is buildPriceOverview with each bucket's price replaced by the
+// unweighted mean of its minute prices. Sub-minute buckets follow the same
+// latest-tick rule, so they hold at most one minute and match the overview.
+func (s *dataStore) buildTWAP(ctx context.Context, symbol string, start, end time.Time, resolutionSeconds int, minPrice *float64) (priceOverviewResponse, bool, error) {
+	defer startSpan(ctx, "twap_overview")()
+	start = start.UTC().Truncate(time.Second)
+	end = end.UTC().Truncate(time.Second)
+	if resolutionSeconds <= 0 {
+		resolutionSeconds = defaultResolutionSeconds
+	}
+	if end.Before(start) {
+		end = start
+	}
+	points := s.symbolPoints(symbol)
+	if len(points) == 0 {
+		return priceOverviewResponse{}, false, nil
+	}
+	resolutionDuration := time.Duration(resolutionSeconds) * time.Second
+	buckets := int(end.Sub(start).Seconds())/resolutionSeconds + 1
+
+	datetimes := make([]string, 0, buckets)
+	prices := make([]*float64, 0, buckets)
+	hasAny := false
+	for i := 0; i < buckets; i++ {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return priceOverviewResponse{}, false, err
+			}
+		}
+		bucketStart := start.Add(time.Duration(i) * resolutionDuration)
+		bucketEnd := bucketStart.Add(resolutionDuration - time.Second)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+		datetimes = append(datetimes, formatDateTime(bucketStart))
+
+		firstMs, lastMs := bucketStart.UnixMilli(), bucketEnd.UnixMilli()+999
+		var sum float64
+		count := 0
+		for t := bucketStart.Truncate(time.Minute); !t.After(bucketEnd); t = t.Add(time.Minute) {
+			point, ok := points[t.Unix()]
+			if !ok || !abovePriceFloor(point.price, minPrice) {
+				continue
+			}
+			if resolutionSeconds < 60 && (point.ts < firstMs || point.ts > lastMs) {
+				continue
+			}
+			sum += point.price
+			count++
+		}
+		if count == 0 {
+			prices = append(prices, nil)
+			continue
+		}
+		mean := sum / float64(count)
+		prices = append(prices, &mean)
+		hasAny = true
+	}
+	if !hasAny {
+		return priceOverviewResponse{}, false, nil
+	}
+
+	return priceOverviewResponse{
+		Resolution:        strconv.Itoa(resolutionSeconds) + "s",
+		ResolutionLabel:   secondsToLabel(resolutionSeconds),
+		ResolutionSeconds: resolutionSeconds,
+		FirstBucketEpoch:  start.Unix(),
+		BucketCount:       len(datetimes),
+		Start:             formatDateTime(start),
+		End:               formatDateTime(end),
+		Prices:            prices,
+		Datetimes:         datetimes,
+	}, true, nil
+}
+
+// streamPriceOverview builds the overview chunk buckets at a time and passes
+// each chunk that has data to emit, so the first part can be sent before the
+// rest is built. It returns the total bucket count and the chunks emitted.
+func (s *dataStore) streamPriceOverview(ctx context.Context, symbol string, start, end time.Time, resolutionSeconds, chunk int, minPrice *float64, emit func(priceOverviewResponse) error) (int, int, error) {
+	start = start.UTC().Truncate(time.Second)
+	end = end.UTC().Truncate(time.Second)
+	if resolutionSeconds <= 0 {
+		resolutionSeconds = defaultResolutionSeconds
+	}
+	if end.Before(start) {
+		end = start
+	}
+	resolution := time.Duration(resolutionSeconds) * time.Second
+	buckets := int(end.Sub(start).Seconds())/resolutionSeconds + 1
+	sent := 0
+	for first := 0; first < buckets; first += chunk {
+		if err := ctx.Err(); err != nil {
+			return buckets, sent, err
+		}
+		chunkStart := start.Add(time.Duration(first) * resolution)
+		chunkEnd := chunkStart.Add(time.Duration(chunk)*resolution - time.Second)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		resp, ok, err := s.buildPriceOverview(ctx, symbol, chunkStart, chunkEnd, resolutionSeconds, false, false, minPrice)
+		if err != nil {
+			return buckets, sent, err
+		}
+		if !ok {
+			continue
+		}
+		if err := emit(resp); err != nil {
+			return buckets, sent, err
+		}
+		sent++
+	}
+	return buckets, sent, nil
+}
+
+// downsamplePreview counts the buckets buildPriceOverview would return for
+// the same arguments, and how many of them hold a price, by walking the
+// symbol's minutes once instead of every bucket.
+func (s *dataStore) downsamplePreview(symbol string, start, end time.Time, resolutionSeconds int, minPrice *float64) downsamplePreviewResponse {
+	start = start.UTC().Truncate(time.Second)
+	end = end.UTC().Truncate(time.Second)
+	if resolutionSeconds <= 0 {
+		resolutionSeconds = defaultResolutionSeconds
+	}
+	if end.Before(start) {
+		end = start
+	}
+	startSec, endSec := start.Unix(), end.Unix()
+	res := int64(resolutionSeconds)
+	buckets := (endSec-startSec)/res + 1
+
+	// A bucket covers a minute when its seconds overlap it (resolution of a
+	// minute or more), or when the minute's latest tick falls in it
+	// (sub-minute).
+	nonNull := make(map[int64]struct{})
+	for minute, point := range s.symbolPoints(symbol) {
+		if !abovePriceFloor(point.price, minPrice) {
+			continue
+		}
+		if resolutionSeconds < 60 {
+			if tickSec := point.ts / 1000; tickSec >= startSec && tickSec <= endSec {
+				nonNull[(tickSec-startSec)/res] = struct{}{}
+			}
+			continue
+		}
+		lo, hi := max(minute, startSec), min(minute+59, endSec)
+		if lo > hi {
+			continue
+		}
+		for i := (lo - startSec) / res; i <= (hi-startSec)/res; i++ {
+			nonNull[i] = struct{}{}
+		}
 	}
-	if seconds < 0 {
-		return 0, errors.New("resolution must be a positive integer in seconds")
+
+	return downsamplePreviewResponse{
+		Symbol:            symbol,
+		ResolutionSeconds: resolutionSeconds,
+		Start:             formatDateTime(start),
+		End:               formatDateTime(end),
+		BucketCount:       int(buckets),
+		NonNullCount:      len(nonNull),
 	}
-	return seconds, nil
 }
 
-func computeResolutionSecondsForTicks(start, end time.Time, ticks int) int {
-	if ticks <= 1 {
-		return 60
-	}
+// buildCandles aggregates symbol's minutes into OHLC candles over [start,
+// end]. A minute keeps only its last, high and low ticks, so a candle opens
+// at the last price of its first minute. resolutionSeconds must be at least
+// a minute.
+func (s *dataStore) buildCandles(ctx context.Context, symbol string, start, end time.Time, resolutionSeconds int, minPrice *float64) (candleResponse, bool, error) {
+	defer startSpan(ctx, "candles")()
+	start = start.UTC().Truncate(time.Second)
+	end = end.UTC().Truncate(time.Second)
 	if end.Before(start) {
-		return 60
+		end = start
 	}
-	totalSeconds := int(end.Sub(start).Seconds())
-	if totalSeconds <= 0 {
-		return 60
+	points := s.symbolPoints(symbol)
+	if len(points) == 0 {
+		return candleResponse{}, false, nil
 	}
-	steps := ticks - 1
-	seconds := totalSeconds / steps
-	if totalSeconds%steps != 0 {
-		seconds += 1
+	resolutionDuration := time.Duration(resolutionSeconds) * time.Second
+	buckets := int(end.Sub(start).Seconds())/resolutionSeconds + 1
+
+	resp := candleResponse{
+		ResolutionSeconds: resolutionSeconds,
+		FirstBucketEpoch:  start.Unix(),
+		BucketCount:       buckets,
+		Start:             formatDateTime(start),
+		End:               formatDateTime(end),
+		Opens:             make([]*float64, 0, buckets),
+		Highs:             make([]*float64, 0, buckets),
+		Lows:              make([]*float64, 0, buckets),
+		Closes:            make([]*float64, 0, buckets),
+		Datetimes:         make([]string, 0, buckets),
 	}
-	if seconds < 1 {
-		return 1
+	hasAny := false
+	for i := 0; i < buckets; i++ {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return candleResponse{}, false, err
+			}
+		}
+		bucketStart := start.Add(time.Duration(i) * resolutionDuration)
+		bucketEnd := bucketStart.Add(resolutionDuration - time.Second)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+		var open, high, low, closePrice *float64
+		for t := bucketStart.Truncate(time.Minute); !t.After(bucketEnd); t = t.Add(time.Minute) {
+			point, ok := points[t.Unix()]
+			if !ok || !abovePriceFloor(point.price, minPrice) {
+				continue
+			}
+			price, pointHigh, pointLow := point.price, point.high, point.low
+			if !abovePriceFloor(pointLow, minPrice) {
+				pointLow = price
+			}
+			if open == nil {
+				open = &price
+			}
+			if high == nil || pointHigh > *high {
+				high = &pointHigh
+			}
+			if low == nil || pointLow < *low {
+				low = &pointLow
+			}
+			closePrice = &price
+		}
+		resp.Opens = append(resp.Opens, open)
+		resp.Highs = append(resp.Highs, high)
+		resp.Lows = append(resp.Lows, low)
+		resp.Closes = append(resp.Closes, closePrice)
+		resp.Datetimes = append(resp.Datetimes, formatDateTime(bucketStart))
+		if open != nil {
+			hasAny = true
+		}
 	}
-	return seconds
-}
-
-func newSessionManager() *sessionManager {
-	return &sessionManager{
-		sessions: make(map[string]*computeState),
+	if !hasAny {
+		return candleResponse{}, false, nil
 	}
+	return resp, true, nil
 }
 
-func (m *sessionManager) getOrCreateID(r *http.Request) (string, bool) {
-	if cookie, err := r.Cookie("mvr_session"); err == nil && cookie.Value != "" {
-		return cookie.Value, false
+// trimEdges drops the leading and trailing null buckets. Start, End and the
+// alignment fields are moved to the remaining buckets.
+func (r priceOverviewResponse) trimEdges() priceOverviewResponse {
+	first, last := 0, len(r.Prices)-1
+	for first <= last && r.Prices[first] == nil {
+		first++
 	}
-	return newSessionID(), true
-}
-
-func (m *sessionManager) getState(id string) *computeState {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	if state, ok := m.sessions[id]; ok {
-		return state
+	for last >= first && r.Prices[last] == nil {
+		last--
 	}
-	return nil
+	if first > last || (first == 0 && last == len(r.Prices)-1) {
+		return r
+	}
+	step := int64(r.ResolutionSeconds)
+	if last < len(r.Prices)-1 {
+		r.End = formatDateTime(time.Unix(r.FirstBucketEpoch+int64(last+1)*step-1, 0))
+	}
+	r.FirstBucketEpoch += int64(first) * step
+	r.Start = r.Datetimes[first]
+	r.Prices = r.Prices[first : last+1]
+	r.Datetimes = r.Datetimes[first : last+1]
+	if r.Highs != nil {
+		r.Highs = r.Highs[first : last+1]
+		r.Lows = r.Lows[first : last+1]
+	}
+	if r.Secondary != nil {
+		r.Secondary = r.Secondary[first : last+1]
+	}
+	if r.Volumes != nil {
+		r.Volumes = r.Volumes[first : last+1]
+	}
+	r.BucketCount = len(r.Prices)
+	return r
 }
 
-func (m *sessionManager) setState(id string, state *computeState) {
-	if id == "" || state == nil {
-		return
+// withStringPrices renders prices as fixed-decimal strings. A negative
+// decimals value uses the shortest representation that round-trips.
+func (r priceOverviewResponse) withStringPrices(decimals int) priceOverviewStringResponse {
+	return priceOverviewStringResponse{
+		Resolution:        r.Resolution,
+		ResolutionLabel:   r.ResolutionLabel,
+		ResolutionSeconds: r.ResolutionSeconds,
+		FirstBucketEpoch:  r.FirstBucketEpoch,
+		BucketCount:       r.BucketCount,
+		Start:             r.Start,
+		End:               r.End,
+		Prices:            formatPrices(r.Prices, decimals),
+		Highs:             formatPrices(r.Highs, decimals),
+		Lows:              formatPrices(r.Lows, decimals),
+		SecondaryField:    r.SecondaryField,
+		Secondary:         formatPrices(r.Secondary, decimals),
+		Datetimes:         r.Datetimes,
+		Volumes:           r.Volumes,
+		FirstPrice:        r.FirstPrice,
+		LastPrice:         r.LastPrice,
+		Truncated:         r.Truncated,
 	}
-	state.UpdatedAt = time.Now().UTC()
-	m.mu.Lock()
-	m.sessions[id] = state
-	m.mu.Unlock()
 }
 
-func (m *sessionManager) updateRange(id string, start, end time.Time, rangeStart, rangeEnd int, computeMode *bool) {
-	if id == "" {
-		return
+// withRunLengthPrices run-length encodes the price series. With asStrings the
+// prices are formatted first, so values that round alike share a run.
+func (r priceOverviewResponse) withRunLengthPrices(asStrings bool, decimals int) priceOverviewRunsResponse {
+	encode := encodeRuns[float64]
+	if asStrings {
+		encode = func(values []*float64) [][2]any {
+			return encodeRuns(formatPrices(values, decimals))
+		}
 	}
-	m.mu.Lock()
-	state, ok := m.sessions[id]
-	if !ok || state == nil {
-		state = &computeState{}
-		m.sessions[id] = state
+	resp := priceOverviewRunsResponse{
+		Resolution:        r.Resolution,
+		ResolutionLabel:   r.ResolutionLabel,
+		ResolutionSeconds: r.ResolutionSeconds,
+		FirstBucketEpoch:  r.FirstBucketEpoch,
+		BucketCount:       r.BucketCount,
+		Start:             r.Start,
+		End:               r.End,
+		Encoding:          "rle",
+		Prices:            encode(r.Prices),
+		FirstPrice:        r.FirstPrice,
+		LastPrice:         r.LastPrice,
+		Truncated:         r.Truncated,
 	}
-	state.RangeStart = rangeStart
-	state.RangeEnd = rangeEnd
-	state.RangeStartTime = start.UTC().Format(time.RFC3339Nano)
-	state.RangeEndTime = end.UTC().Format(time.RFC3339Nano)
-	if computeMode != nil {
-		state.ComputeMode = *computeMode
+	if r.Highs != nil {
+		resp.Highs = encode(r.Highs)
+		resp.Lows = encode(r.Lows)
 	}
-	state.UpdatedAt = time.Now().UTC()
-	m.mu.Unlock()
-}
-
-func (m *sessionManager) resetState(id string) *computeState {
-	if id == "" {
-		return nil
+	if r.Secondary != nil {
+		resp.SecondaryField = r.SecondaryField
+		resp.Secondary = encode(r.Secondary)
 	}
-	m.mu.Lock()
-	state := &computeState{
-		ComputeMode: false,
-		RangeStart:  0,
-		RangeEnd:    0,
-		Markers:     nil,
-		TicksRequested: 0,
-		LastSymbol:     "",
-		RangeStartTime: "",
-		RangeEndTime:   "",
-		Resolution:     "",
-		CustomResolutionSeconds: 0,
-		UpdatedAt:      time.Now().UTC(),
+	if r.Volumes != nil {
+		resp.Volumes = encodeRuns(r.Volumes)
 	}
-	m.sessions[id] = state
-	m.mu.Unlock()
-	return state
+	return resp
 }
 
-func newSessionID() string {
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		return strconv.FormatInt(time.Now().UnixNano(), 10)
+// encodeRuns collapses consecutive equal values, nil included, into
+// [value, count] pairs.
+func encodeRuns[T comparable](values []*T) [][2]any {
+	runs := make([][2]any, 0)
+	for i, value := range values {
+		if i > 0 {
+			prev := values[i-1]
+			if (prev == nil && value == nil) || (prev != nil && value != nil && *prev == *value) {
+				runs[len(runs)-1][1] = runs[len(runs)-1][1].(int) + 1
+				continue
+			}
+		}
+		var price any
+		if value != nil {
+			price = *value
+		}
+		runs = append(runs, [2]any{price, 1})
 	}
-	return hex.EncodeToString(b)
-}
-
-func buildSessionCookie(id string) string {
-	return (&http.Cookie{
-		Name:     "mvr_session",
-		Value:    id,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	}).String()
+	return runs
 }
 
-func (p *computeStatePayload) toComputeState() *computeState {
-	if p == nil {
+func formatPrices(values []*float64, decimals int) []*string {
+	if values == nil {
 		return nil
 	}
-	state := &computeState{
-		ComputeMode: p.ComputeMode,
-		RangeStart:  p.RangeStart,
-		RangeEnd:    p.RangeEnd,
-		TicksRequested: p.TicksRequested,
-		LastSymbol:     p.LastSymbol,
-		RangeStartTime: p.RangeStartTime,
-		RangeEndTime:   p.RangeEndTime,
-		Resolution:     p.Resolution,
-		CustomResolutionSeconds: p.CustomResolutionSeconds,
-	}
-	if len(p.Markers) > 0 {
-		state.Markers = make(map[string]int, len(p.Markers))
-		for k, v := range p.Markers {
-			state.Markers[k] = v
+	out := make([]*string, len(values))
+	for i, price := range values {
+		if price == nil {
+			continue
 		}
+		value := strconv.FormatFloat(*price, 'f', decimals, 64)
+		out[i] = &value
 	}
-	return state
+	return out
 }
 
-func parseDateTime(value string) (time.Time, error) {
-	if value == "" {
-		return time.Time{}, errors.New("invalid datetime")
+// clampToCoverage narrows [start, end] to the minutes symbol has data for.
+// Unknown symbols pass through unchanged; ranges that miss the data entirely
+// return an error naming the available bounds.
+func (s *dataStore) clampToCoverage(symbol string, start, end time.Time) (time.Time, time.Time, error) {
+	points := s.symbolPoints(symbol)
+	if len(points) == 0 {
+		return start, end, nil
 	}
-	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
-		if ts > 10_000_000_000 {
-			return time.UnixMilli(ts).UTC(), nil
+	first, last := int64(0), int64(0)
+	for minute := range points {
+		if first == 0 || minute < first {
+			first = minute
+		}
+		if minute > last {
+			last = minute
 		}
-		return time.Unix(ts, 0).UTC(), nil
 	}
-	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
-		return parsed.UTC(), nil
+	dataStart := time.Unix(first, 0).UTC()
+	dataEnd := time.Unix(last, 0).UTC().Add(time.Minute - time.Second)
+	if end.Before(dataStart) || start.After(dataEnd) {
+		return time.Time{}, time.Time{}, fmt.Errorf("range outside data: %s has data from %s to %s", symbol, formatDateTime(dataStart), formatDateTime(dataEnd))
 	}
-	if parsed, err := time.Parse("2006-01-02 15:04:05", value); err == nil {
-		return parsed.UTC(), nil
+	if start.Before(dataStart) {
+		start = dataStart
 	}
-	return time.Time{}, errors.New("invalid datetime format")
-}
-
-func formatDateTime(t time.Time) string {
-	return t.UTC().Format("2006-01-02 15:04:05")
+	if end.After(dataEnd) {
+		end = dataEnd
+	}
+	return start, end, nil
 }
 
-type minutePrice struct {
-	ts    int64
-	price float64
-}
+// priceAt returns the latest tick at or before at, if it is no older than
+// tolerance.
+func (s *dataStore) priceAt(symbol string, at time.Time, tolerance time.Duration) priceAtResponse {
+	resp := priceAtResponse{
+		Symbol:    symbol,
+		Timestamp: formatDateTime(at),
+		Status:    "no_data",
+	}
+	targetMs := at.UTC().UnixMilli()
+	earliestMs := targetMs - tolerance.Milliseconds()
 
-func parsePrice(record []string, idxLast, idxBid, idxAsk int) (float64, bool) {
-	if idxLast >= 0 && idxLast < len(record) {
-		if value, ok := parseFloat(record[idxLast]); ok {
-			return value, true
+	var best minutePrice
+	found := false
+	for _, point := range s.symbolPoints(symbol) {
+		if point.ts > targetMs || point.ts < earliestMs {
+			continue
 		}
-	}
-	if idxBid >= 0 && idxBid < len(record) {
-		if value, ok := parseFloat(record[idxBid]); ok {
-			return value, true
+		if !found || point.ts > best.ts {
+			best = point
+			found = true
 		}
 	}
-	if idxAsk >= 0 && idxAsk < len(record) {
-		if value, ok := parseFloat(record[idxAsk]); ok {
-			return value, true
-		}
+	if !found {
+		return resp
 	}
-	return 0, false
-}
 
-func parseFloat(value string) (float64, bool) {
-	value = strings.TrimSpace(value)
-	if value == "" {
-		return 0, false
-	}
-	number, err := strconv.ParseFloat(value, 64)
-	if err != nil {
-		return 0, false
-	}
-	return number, true
+	price := best.price
+	resp.Status = "ok"
+	resp.Price = &price
+	resp.Datetime = formatDateTime(time.UnixMilli(best.ts))
+	offset := float64(targetMs-best.ts) / 1000
+	resp.OffsetSeconds = &offset
+	return resp
 }
 
-func indexOf(values []string, key string) int {
-	for i, value := range values {
-		if strings.EqualFold(strings.TrimSpace(value), key) {
-			return i
+// rangeAnchors finds the first tick at or after start and the last one at or
+// before end (inclusive of end's second), skipping minutes under minPrice.
+func (s *dataStore) rangeAnchors(symbol string, start, end time.Time, minPrice *float64) (*priceAnchor, *priceAnchor) {
+	startMs := start.UTC().UnixMilli()
+	endMs := end.UTC().Truncate(time.Second).UnixMilli() + 999
+	var first, last minutePrice
+	found := false
+	for _, point := range s.symbolPoints(symbol) {
+		if point.ts < startMs || point.ts > endMs || !abovePriceFloor(point.price, minPrice) {
+			continue
+		}
+		if !found || point.ts < first.ts {
+			first = point
 		}
+		if !found || point.ts > last.ts {
+			last = point
+		}
+		found = true
 	}
-	return -1
-}
-
-func newDataStore() *dataStore {
-	return &dataStore{
-		qualityBySymbol: make(map[string]map[int64]bool),
-		priceBySymbol:   make(map[string]map[int64]minutePrice),
+	if !found {
+		return nil, nil
 	}
+	anchor := func(point minutePrice) *priceAnchor {
+		return &priceAnchor{Price: point.price, Ts: point.ts, Datetime: formatDateTime(time.UnixMilli(point.ts))}
+	}
+	return anchor(first), anchor(last)
 }
 
-func (s *dataStore) loadFromDirs(rootDirs []string) error {
-	startTS := int64(0)
-	endTS := int64(0)
-	quality := make(map[string]map[int64]bool)
-	prices := make(map[string]map[int64]minutePrice)
+// buildMultiRangeOverview builds one overview per window. Windows outside the
+// currently loaded bounds are read from disk into a throwaway store so the
+// shared store is left untouched.
+func (s *dataStore) buildMultiRangeOverview(ctx context.Context, dataDirs []string, symbol string, windows []wsRangeWindow, resolutionSeconds int, minPrice *float64) (multiRangeOverviewPayload, error) {
+	defer startSpan(ctx, "multi_range_overview")()
+	if len(windows) == 0 {
+		return multiRangeOverviewPayload{}, errors.New("missing windows")
+	}
+	if len(windows) > maxRangeWindows {
+		return multiRangeOverviewPayload{}, fmt.Errorf("at most %d windows allowed", maxRangeWindows)
+	}
 
-	for _, rootDir := range rootDirs {
-		if strings.TrimSpace(rootDir) == "" {
-			continue
+	type parsedWindow struct {
+		start time.Time
+		end   time.Time
+	}
+	parsed := make([]parsedWindow, 0, len(windows))
+	totalBuckets := 0
+	for _, window := range windows {
+		start, err := parseDateTime(strings.TrimSpace(window.Start))
+		if err != nil {
+			return multiRangeOverviewPayload{}, err
 		}
-		if _, err := os.Stat(rootDir); err != nil {
-			if os.IsNotExist(err) {
-				continue
+		end, err := parseDateTime(strings.TrimSpace(window.End))
+		if err != nil {
+			return multiRangeOverviewPayload{}, err
+		}
+		if end.Before(start) {
+			return multiRangeOverviewPayload{}, errors.New("end must be after start")
+		}
+		totalBuckets += int(end.Sub(start).Seconds())/resolutionSeconds + 1
+		if totalBuckets > maxMultiRangeBuckets {
+			return multiRangeOverviewPayload{}, fmt.Errorf("windows exceed %d buckets at this resolution", maxMultiRangeBuckets)
+		}
+		parsed = append(parsed, parsedWindow{start: start, end: end})
+	}
+
+	startTS, endTS, _ := s.bounds()
+	items := make([]multiRangeWindowItem, 0, len(parsed))
+	for _, window := range parsed {
+		source := s
+		startMs := window.start.UnixMilli()
+		endMs := window.end.UnixMilli()
+		if startTS <= 0 || startMs < startTS || endMs > endTS+time.Minute.Milliseconds() {
+			source = newDataStore(s.ingest)
+			if err := source.loadFromDirsRange(dataDirs, window.start, window.end); err != nil {
+				return multiRangeOverviewPayload{}, errors.New("could not load range")
 			}
-			return err
 		}
-		if err := loadFromDir(rootDir, quality, prices, &startTS, &endTS); err != nil {
-			return err
+		item := multiRangeWindowItem{
+			Start: formatDateTime(window.start),
+			End:   formatDateTime(window.end),
+		}
+		resp, ok, err := source.buildPriceOverview(ctx, symbol, window.start, window.end, resolutionSeconds, false, false, minPrice)
+		if err != nil {
+			return multiRangeOverviewPayload{}, errors.New(overviewErrorMessage(err))
+		}
+		if ok {
+			item.Data = resp
 		}
+		items = append(items, item)
 	}
 
-	s.mu.Lock()
-	s.startTS = startTS
-	s.endTS = endTS
-	s.qualityBySymbol = quality
-	s.priceBySymbol = prices
-	s.mu.Unlock()
+	return multiRangeOverviewPayload{
+		Symbol:            symbol,
+		ResolutionSeconds: resolutionSeconds,
+		Windows:           items,
+	}, nil
+}
 
-	return nil
+// recentPrices returns the last count minutes of symbol strictly before the
+// minute key before, oldest first. NextCursor is set when older minutes
+// remain and pages further back.
+func (s *dataStore) recentPrices(symbol string, count int, before int64) recentPricesResponse {
+	points := s.symbolPoints(symbol)
+	minutes := make([]int64, 0, len(points))
+	for minute := range points {
+		if minute < before {
+			minutes = append(minutes, minute)
+		}
+	}
+	sort.Slice(minutes, func(i, j int) bool {
+		return minutes[i] < minutes[j]
+	})
+	more := len(minutes) > count
+	if more {
+		minutes = minutes[len(minutes)-count:]
+	}
+
+	resp := recentPricesResponse{
+		Symbol:    symbol,
+		Prices:    make([]float64, 0, len(minutes)),
+		Datetimes: make([]string, 0, len(minutes)),
+	}
+	if more {
+		resp.NextCursor = encodeMinuteCursor(minutes[0])
+	}
+	for _, minute := range minutes {
+		resp.Prices = append(resp.Prices, points[minute].price)
+		resp.Datetimes = append(resp.Datetimes, formatDateTime(time.Unix(minute, 0)))
+	}
+	return resp
 }
 
-func (s *dataStore) loadFromDirsRange(rootDirs []string, start, end time.Time) error {
-	startTS := int64(0)
-	endTS := int64(0)
-	quality := make(map[string]map[int64]bool)
-	prices := make(map[string]map[int64]minutePrice)
+// encodeMinuteCursor makes an opaque page token from the oldest minute key
+// a page returned.
+func encodeMinuteCursor(minute int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("m:" + strconv.FormatInt(minute, 10)))
+}
 
-	startMs := start.UTC().UnixMilli()
-	endMs := end.UTC().UnixMilli()
+func decodeMinuteCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	value, ok := strings.CutPrefix(string(raw), "m:")
+	if !ok {
+		return 0, errors.New("invalid cursor")
+	}
+	minute, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	return minute, nil
+}
 
-	for _, rootDir := range rootDirs {
-		if strings.TrimSpace(rootDir) == "" {
-			continue
-		}
-		if _, err := os.Stat(rootDir); err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
-			return err
+func (s *dataStore) buildSnapshot(symbols []string) snapshotResponse {
+	_, _, generation := s.bounds()
+	resp := snapshotResponse{
+		Generation: generation,
+		Symbols:    make([]snapshotSymbol, 0, len(symbols)),
+	}
+	for _, symbol := range symbols {
+		points := s.symbolPoints(symbol)
+		item := snapshotSymbol{
+			Symbol:  symbol,
+			Minutes: make([]snapshotPoint, 0, len(points)),
 		}
-		if err := loadFromDirRange(rootDir, startMs, endMs, quality, prices, &startTS, &endTS); err != nil {
-			return err
+		for minute, point := range points {
+			item.Minutes = append(item.Minutes, snapshotPoint{Minute: minute, TS: point.ts, Price: point.price})
 		}
+		sort.Slice(item.Minutes, func(i, j int) bool {
+			return item.Minutes[i].Minute < item.Minutes[j].Minute
+		})
+		resp.Symbols = append(resp.Symbols, item)
 	}
+	return resp
+}
 
-	s.mu.Lock()
-	s.startTS = startTS
-	s.endTS = endTS
-	s.qualityBySymbol = quality
-	s.priceBySymbol = prices
-	s.mu.Unlock()
+// replayFile runs body through ingestFile as if it were a file under a
+// symbol dir of the first root, using a throwaway store, and returns what
+// was parsed. The live store is not touched.
+func replayFile(cfg ingestConfig, symbol string, body io.Reader) (snapshotResponse, error) {
+	dir, err := os.MkdirTemp("", "bff-replay-")
+	if err != nil {
+		return snapshotResponse{}, err
+	}
+	defer os.RemoveAll(dir)
+	symbolDir := filepath.Join(dir, symbol)
+	if err := os.Mkdir(symbolDir, 0o755); err != nil {
+		return snapshotResponse{}, err
+	}
+	path := filepath.Join(symbolDir, "replay.csv")
+	file, err := os.Create(path)
+	if err != nil {
+		return snapshotResponse{}, err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		_ = file.Close()
+		return snapshotResponse{}, err
+	}
+	if err := file.Close(); err != nil {
+		return snapshotResponse{}, err
+	}
 
-	return nil
+	cfg = cfg.forSource(0)
+	quality := make(map[string]map[int64]bool)
+	prices := make(map[string]map[int64]minutePrice)
+	var startTS, endTS int64
+	if err := ingestFile(path, cfg, quality, prices, &startTS, &endTS); err != nil {
+		return snapshotResponse{}, err
+	}
+	replay := newDataStore(cfg)
+	replay.swap(nil, startTS, endTS, quality, prices)
+	return replay.buildSnapshot(replay.listSymbols()), nil
 }
 
-func loadFromDir(rootDir string, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, startTS, endTS *int64) error {
-	dateDirs, err := os.ReadDir(rootDir)
-	if err != nil {
-		return err
+// sourceCoverage reports, for each symbol, how many minutes in [start, end]
+// each loaded root dir contributed. An empty symbols list means all symbols.
+func (s *dataStore) sourceCoverage(symbols []string, start, end time.Time) sourceCoverageResponse {
+	startKey := start.UTC().Truncate(time.Minute).Unix()
+	endKey := end.UTC().Truncate(time.Minute).Unix()
+
+	s.mu.RLock()
+	sources := s.sourceDirs
+	s.mu.RUnlock()
+	if len(sources) > maxSourceDirs {
+		sources = sources[:maxSourceDirs]
+	}
+	allMask := uint32(1)<<uint(len(sources)) - 1
+	if len(sources) == maxSourceDirs {
+		allMask = ^uint32(0)
 	}
 
-	for _, dateEntry := range dateDirs {
-		if !dateEntry.IsDir() {
-			continue
-		}
-		dateName := dateEntry.Name()
-		datePath := filepath.Join(rootDir, dateName)
-		symbolDirs, err := os.ReadDir(datePath)
-		if err != nil {
-			return err
-		}
-		for _, symbolEntry := range symbolDirs {
-			if !symbolEntry.IsDir() {
+	if len(symbols) == 0 {
+		symbols = s.listSymbols()
+	}
+
+	resp := sourceCoverageResponse{
+		Start:   start.UTC().Format(time.RFC3339),
+		End:     end.UTC().Format(time.RFC3339),
+		Sources: sources,
+		Symbols: make([]sourceCoverageItem, 0, len(symbols)),
+	}
+	for _, symbol := range symbols {
+		item := sourceCoverageItem{Symbol: symbol, Minutes: make([]int, len(sources)), Won: make([]int, len(sources))}
+		for minute, point := range s.symbolPoints(symbol) {
+			if minute < startKey || minute > endKey {
 				continue
 			}
-			symbol := symbolEntry.Name()
-			symbolPath := filepath.Join(datePath, symbol)
-			files, err := os.ReadDir(symbolPath)
-			if err != nil {
-				return err
+			item.TotalMinutes++
+			if len(sources) > 0 && point.sources&allMask == allMask {
+				item.AllSources++
 			}
-			for _, fileEntry := range files {
-				if fileEntry.IsDir() {
-					continue
-				}
-				name := fileEntry.Name()
-				if !strings.HasSuffix(name, ".csv") {
-					continue
+			for i := range sources {
+				if point.sources&(1<<uint(i)) != 0 {
+					item.Minutes[i]++
 				}
-				updateRangeFromPath(dateName, name, startTS, endTS)
-				path := filepath.Join(symbolPath, name)
-				if err := ingestFile(path, quality, prices, startTS, endTS); err != nil {
-					return err
+				if point.priceSource == 1<<uint(i) {
+					item.Won[i]++
 				}
 			}
 		}
+		resp.Symbols = append(resp.Symbols, item)
 	}
-
-	return nil
+	return resp
 }
 
-func loadFromDirRange(rootDir string, startMs, endMs int64, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, startTS, endTS *int64) error {
-	dateDirs, err := os.ReadDir(rootDir)
-	if err != nil {
-		return err
-	}
+// symbolStats summarizes the raw minute prices of symbol in [start, end].
+// StdDev is the population standard deviation.
+func (s *dataStore) symbolStats(symbol string, start, end time.Time) (symbolStatsResponse, bool) {
+	startKey := start.UTC().Truncate(time.Minute).Unix()
+	endKey := end.UTC().Truncate(time.Minute).Unix()
 
-	for _, dateEntry := range dateDirs {
-		if !dateEntry.IsDir() {
+	stats := symbolStatsResponse{Symbol: symbol}
+	var sum, sumSquares float64
+	var firstMinute, lastMinute int64
+	for minute, point := range s.symbolPoints(symbol) {
+		if minute < startKey || minute > endKey {
 			continue
 		}
-		dateName := dateEntry.Name()
-		datePath := filepath.Join(rootDir, dateName)
-		symbolDirs, err := os.ReadDir(datePath)
-		if err != nil {
-			return err
+		if stats.Count == 0 || minute < firstMinute {
+			firstMinute = minute
+			stats.First = point.price
 		}
-		for _, symbolEntry := range symbolDirs {
-			if !symbolEntry.IsDir() {
-				continue
-			}
-			symbolPath := filepath.Join(datePath, symbolEntry.Name())
-			files, err := os.ReadDir(symbolPath)
-			if err != nil {
-				return err
-			}
-			for _, fileEntry := range files {
-				if fileEntry.IsDir() {
-					continue
-				}
-				name := fileEntry.Name()
-				if !strings.HasSuffix(name, ".csv") {
-					continue
-				}
-				ts, ok := parseDirFileTimestamp(dateName, name)
-				if !ok {
-					continue
-				}
-				if ts < startMs || ts > endMs {
-					continue
-				}
-				updateRangeFromPath(dateName, name, startTS, endTS)
-				path := filepath.Join(symbolPath, name)
-				if err := ingestFile(path, quality, prices, startTS, endTS); err != nil {
-					return err
-				}
-			}
+		if stats.Count == 0 || point.price < stats.Min {
+			stats.Min = point.price
+		}
+		if stats.Count == 0 || point.price > stats.Max {
+			stats.Max = point.price
 		}
+		if stats.Count == 0 || minute > lastMinute {
+			lastMinute = minute
+			stats.Last = point.price
+		}
+		sum += point.price
+		sumSquares += point.price * point.price
+		stats.Count++
+	}
+	if stats.Count == 0 {
+		return symbolStatsResponse{}, false
 	}
 
-	return nil
+	n := float64(stats.Count)
+	stats.Mean = sum / n
+	stats.StdDev = math.Sqrt(math.Max(0, sumSquares/n-stats.Mean*stats.Mean))
+	stats.LastDatetime = formatDateTime(time.Unix(lastMinute, 0))
+	return stats, true
 }
 
-func updateRangeFromPath(dateName, fileName string, minTS, maxTS *int64) {
-	ts, ok := parseDirFileTimestamp(dateName, fileName)
-	if !ok {
-		return
+// topMovers ranks every listed symbol by its percent change from first to
+// last price in [start, end] and keeps the n biggest gainers and losers.
+// Symbols starting at zero have no defined change and are skipped.
+func (s *dataStore) topMovers(ctx context.Context, start, end time.Time, n int) (topMoversResponse, error) {
+	defer startSpan(ctx, "top_movers")()
+	moves := make([]symbolMove, 0)
+	for i, symbol := range s.listSymbols() {
+		if i%64 == 0 {
+			if err := ctx.Err(); err != nil {
+				return topMoversResponse{}, err
+			}
+		}
+		stats, ok := s.symbolStats(symbol, start, end)
+		if !ok || stats.First == 0 {
+			continue
+		}
+		moves = append(moves, symbolMove{
+			Symbol:        symbol,
+			First:         stats.First,
+			Last:          stats.Last,
+			ChangePercent: (stats.Last - stats.First) / math.Abs(stats.First) * 100,
+		})
 	}
-	if *minTS == 0 || ts < *minTS {
-		*minTS = ts
+	sort.Slice(moves, func(i, j int) bool {
+		if moves[i].ChangePercent != moves[j].ChangePercent {
+			return moves[i].ChangePercent > moves[j].ChangePercent
+		}
+		return moves[i].Symbol < moves[j].Symbol
+	})
+
+	resp := topMoversResponse{
+		Start:   formatDateTime(start),
+		End:     formatDateTime(end),
+		Gainers: make([]symbolMove, 0, n),
+		Losers:  make([]symbolMove, 0, n),
 	}
-	if *maxTS == 0 || ts > *maxTS {
-		*maxTS = ts
+	for _, move := range moves {
+		if move.ChangePercent <= 0 || len(resp.Gainers) == n {
+			break
+		}
+		resp.Gainers = append(resp.Gainers, move)
+	}
+	for i := len(moves) - 1; i >= 0; i-- {
+		if moves[i].ChangePercent >= 0 || len(resp.Losers) == n {
+			break
+		}
+		resp.Losers = append(resp.Losers, moves[i])
 	}
+	return resp, nil
 }
 
-func parseDirFileTimestamp(dateName, fileName string) (int64, bool) {
-	dateParts := strings.Split(dateName, "-")
-	if len(dateParts) != 3 {
-		return 0, false
+func priceRange(prices []*float64) (float64, float64, bool) {
+	var low, high float64
+	found := false
+	for _, price := range prices {
+		if price == nil {
+			continue
+		}
+		if !found || *price < low {
+			low = *price
+		}
+		if !found || *price > high {
+			high = *price
+		}
+		found = true
 	}
-	year, err := strconv.Atoi(dateParts[0])
-	if err != nil {
-		return 0, false
+	return low, high, found
+}
+
+// buildChartHints rounds [low, high] out to a "nice" axis (steps of 1, 2 or
+// 5 times a power of ten) with roughly the requested number of gridlines,
+// which is clamped to maxGridlines.
+func buildChartHints(symbol string, low, high float64, gridlines int) chartHintsResponse {
+	if gridlines < 2 {
+		gridlines = 5
 	}
-	month, err := strconv.Atoi(dateParts[1])
-	if err != nil || month < 1 || month > 12 {
-		return 0, false
+	if gridlines > maxGridlines {
+		gridlines = maxGridlines
 	}
-	day, err := strconv.Atoi(dateParts[2])
-	if err != nil || day < 1 || day > 31 {
-		return 0, false
+	span := high - low
+	if span == 0 {
+		span = math.Abs(high)
+		if span == 0 {
+			span = 1
+		}
+		span *= 0.02
 	}
-
-	baseName := strings.TrimSuffix(fileName, filepath.Ext(fileName))
-	timeParts := strings.Split(baseName, "_")
-	if len(timeParts) != 2 {
-		return 0, false
+	step := niceNumber(niceNumber(span, false)/float64(gridlines-1), true)
+	scale := math.Pow(10, math.Max(0, -math.Floor(math.Log10(step))))
+	axisMin := math.Round(math.Floor(low/step)*step*scale) / scale
+	axisMax := math.Round(math.Ceil(high/step)*step*scale) / scale
+	if axisMax == axisMin {
+		axisMax = math.Round((axisMin+step)*scale) / scale
 	}
-	hour, err := strconv.Atoi(timeParts[0])
-	if err != nil || hour < 0 || hour > 23 {
-		return 0, false
+
+	count := int(math.Round((axisMax-axisMin)/step)) + 1
+	lines := make([]float64, 0, count)
+	for i := 0; i < count; i++ {
+		lines = append(lines, math.Round((axisMin+float64(i)*step)*scale)/scale)
 	}
-	minute, err := strconv.Atoi(timeParts[1])
-	if err != nil || minute < 0 || minute > 59 {
-		return 0, false
+
+	return chartHintsResponse{
+		Symbol:    symbol,
+		Min:       low,
+		Max:       high,
+		AxisMin:   axisMin,
+		AxisMax:   axisMax,
+		Step:      step,
+		Gridlines: lines,
 	}
+}
 
-	t := time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.UTC)
-	return t.UnixMilli(), true
+func niceNumber(value float64, round bool) float64 {
+	exponent := math.Floor(math.Log10(value))
+	fraction := value / math.Pow(10, exponent)
+	var nice float64
+	switch {
+	case round && fraction < 1.5:
+		nice = 1
+	case round && fraction < 3:
+		nice = 2
+	case round && fraction < 7:
+		nice = 5
+	case round:
+		nice = 10
+	case fraction <= 1:
+		nice = 1
+	case fraction <= 2:
+		nice = 2
+	case fraction <= 5:
+		nice = 5
+	default:
+		nice = 10
+	}
+	return nice * math.Pow(10, exponent)
 }
 
-func (s *dataStore) buildTimeframeResponse() (timeframeResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// csvFormat is the delimiter and quoting policy used for CSV exports.
+type csvFormat struct {
+	delimiter rune
+	quoteAll  bool
+}
 
-	if s.startTS <= 0 || s.endTS <= 0 || len(s.qualityBySymbol) == 0 {
-		now := time.Now().UTC()
-		return timeframeResponse{
-			Start:            now.Format(time.RFC3339),
-			End:              now.Format(time.RFC3339),
-			Resolution:       "1m",
-			FrameQuality:     []symbolFrameQuality{},
-		}, nil
+// parseCSVFormat validates a delimiter (a single rune, "\t" accepted for tab)
+// and a quoting policy ("minimal" or "all"). Empty values keep the
+// encoding/csv defaults.
+func parseCSVFormat(delimiter, quote string) (csvFormat, error) {
+	format := csvFormat{delimiter: ','}
+	if delimiter == `\t` {
+		delimiter = "\t"
+	}
+	if delimiter != "" {
+		r, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+			return format, fmt.Errorf("delimiter must be a single rune other than a quote or newline, got %q", delimiter)
+		}
+		format.delimiter = r
+	}
+	switch strings.ToLower(strings.TrimSpace(quote)) {
+	case "", "minimal":
+	case "all":
+		format.quoteAll = true
+	default:
+		return format, fmt.Errorf("quote policy must be minimal or all, got %q", quote)
 	}
+	return format, nil
+}
 
-	startTime := time.UnixMilli(s.startTS).UTC()
-	endTime := time.UnixMilli(s.endTS).UTC()
-	startMinute := startTime.Truncate(time.Minute)
-	endMinute := endTime.Truncate(time.Minute)
-	totalMinutes := int(endMinute.Sub(startMinute).Minutes())
-	if totalMinutes < 0 {
-		totalMinutes = 0
+// quotePolicy names f's quoting in BFF_EXPORT_CSV_QUOTE terms.
+func (f csvFormat) quotePolicy() string {
+	if f.quoteAll {
+		return "all"
 	}
-	resolutionMinutes := 1
-	resolutionLabel := "1m"
-	switch {
-	case totalMinutes > 7*24*60:
-		resolutionMinutes = 12 * 60
-		resolutionLabel = "12h"
-	case totalMinutes > 24*60:
-		resolutionMinutes = 60
-		resolutionLabel = "1h"
-	case totalMinutes > 6*60:
-		resolutionMinutes = 10
-		resolutionLabel = "10m"
-	case totalMinutes > 2*60:
-		resolutionMinutes = 5
-		resolutionLabel = "5m"
+	return "minimal"
+}
+
+// csvWriter writes records in a csvFormat. encoding/csv only quotes fields
+// that need it, so the quote-all policy is written by hand.
+type csvWriter struct {
+	format csvFormat
+	csv    *csv.Writer
+	buf    *bufio.Writer
+}
+
+func (f csvFormat) newWriter(w io.Writer) *csvWriter {
+	if !f.quoteAll {
+		writer := csv.NewWriter(w)
+		writer.Comma = f.delimiter
+		return &csvWriter{format: f, csv: writer}
 	}
-	bucketCount := totalMinutes/resolutionMinutes + 1
+	return &csvWriter{format: f, buf: bufio.NewWriter(w)}
+}
 
-	symbols := make([]string, 0, len(s.qualityBySymbol))
-	qualityCounts := make(map[string]int, len(s.qualityBySymbol))
-	for symbol, minutes := range s.qualityBySymbol {
-		symbols = append(symbols, symbol)
-		qualityCounts[symbol] = len(minutes)
+func (c *csvWriter) Write(record []string) error {
+	if c.csv != nil {
+		return c.csv.Write(record)
 	}
-	sort.Slice(symbols, func(i, j int) bool {
-		ci := qualityCounts[symbols[i]]
-		cj := qualityCounts[symbols[j]]
-		if ci == cj {
-			return symbols[i] < symbols[j]
+	for i, field := range record {
+		if i > 0 {
+			c.buf.WriteRune(c.format.delimiter)
 		}
-		return ci > cj
-	})
+		c.buf.WriteByte('"')
+		c.buf.WriteString(strings.ReplaceAll(field, `"`, `""`))
+		c.buf.WriteByte('"')
+	}
+	_, err := c.buf.WriteString("\n")
+	return err
+}
 
-	quality := make([]symbolFrameQuality, 0, len(symbols))
-	for _, symbol := range symbols {
-		flags := make([]int, bucketCount)
-		for minute := range s.qualityBySymbol[symbol] {
-			tsTime := time.Unix(minute, 0).UTC().Truncate(time.Minute)
-			index := int(tsTime.Sub(startMinute).Minutes()) / resolutionMinutes
-			if index >= 0 && index < bucketCount {
-				flags[index] = 1
+func (c *csvWriter) Flush() {
+	if c.csv != nil {
+		c.csv.Flush()
+		return
+	}
+	_ = c.buf.Flush()
+}
+
+func (c *csvWriter) Error() error {
+	if c.csv != nil {
+		return c.csv.Error()
+	}
+	_, err := c.buf.Write(nil)
+	return err
+}
+
+// tradingCalendar is the set of exchange-closed dates (YYYY-MM-DD, UTC).
+// Missing data on those days is expected, not a gap. The zero value is an
+// empty calendar.
+type tradingCalendar map[string]bool
+
+// loadTradingCalendar reads closed dates from path, one per line with '#'
+// comments, plus the comma-separated dates in extra. Both may be empty.
+func loadTradingCalendar(path, extra string) (tradingCalendar, error) {
+	calendar := make(tradingCalendar)
+	add := func(value string) error {
+		value = strings.TrimSpace(value)
+		if value == "" || strings.HasPrefix(value, "#") {
+			return nil
+		}
+		if _, ok := parseDirDate(value); !ok {
+			return fmt.Errorf("closed date %q must be YYYY-MM-DD", value)
+		}
+		calendar[value] = true
+		return nil
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if err := add(line); err != nil {
+				return nil, err
 			}
 		}
-		quality = append(quality, symbolFrameQuality{
-			Symbol:  symbol,
-			Quality: flags,
-		})
 	}
+	for _, value := range strings.Split(extra, ",") {
+		if err := add(value); err != nil {
+			return nil, err
+		}
+	}
+	return calendar, nil
+}
 
-	return timeframeResponse{
-		Start:            startTime.Format(time.RFC3339),
-		End:              endTime.Format(time.RFC3339),
-		Resolution:       resolutionLabel,
-		FrameQuality:     quality,
-	}, nil
+func (c tradingCalendar) isClosed(t time.Time) bool {
+	return c[t.UTC().Format("2006-01-02")]
 }
 
-func (s *dataStore) buildPriceOverview(symbol string, start, end time.Time, resolutionSeconds int) (priceOverviewResponse, bool, error) {
-	start = start.UTC().Truncate(time.Second)
-	end = end.UTC().Truncate(time.Second)
-	if resolutionSeconds <= 0 {
-		resolutionSeconds = 300
+// dates lists every closed date, sorted.
+func (c tradingCalendar) dates() []string {
+	dates := make([]string, 0, len(c))
+	for date := range c {
+		dates = append(dates, date)
 	}
-	resolutionDuration := time.Duration(resolutionSeconds) * time.Second
-	if end.Before(start) {
-		end = start
+	sort.Strings(dates)
+	return dates
+}
+
+// closedBetween lists the closed dates from start's day through end's day.
+func (c tradingCalendar) closedBetween(start, end time.Time) []string {
+	if len(c) == 0 {
+		return nil
 	}
-	totalSeconds := int(end.Sub(start).Seconds())
-	if totalSeconds < 0 {
-		totalSeconds = 0
+	var closed []string
+	for day := start.UTC().Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		if c.isClosed(day) {
+			closed = append(closed, day.Format("2006-01-02"))
+		}
 	}
-	buckets := totalSeconds/resolutionSeconds + 1
+	return closed
+}
 
-	datetimes := make([]string, 0, buckets)
-	prices := make([]*float64, 0, buckets)
+// buildDailyGrid returns one row per minute of day for symbol, from the first
+// to the last minute any symbol has data on that day. Minutes without a price
+// for symbol get an empty price cell; the trading column marks minutes where
+// at least one symbol was covered.
+func (s *dataStore) buildDailyGrid(symbol string, day time.Time) [][]string {
+	dayStart := day.UTC().Truncate(24 * time.Hour).Unix()
+	dayEnd := dayStart + 24*60*60 - 60
 
-	s.mu.RLock()
-	points := s.priceBySymbol[symbol]
-	s.mu.RUnlock()
-	if len(points) == 0 {
-		return priceOverviewResponse{}, false, nil
+	trading := make(map[int64]bool)
+	first, last := int64(0), int64(0)
+	for _, minutes := range s.qualitySnapshot() {
+		for minute := range minutes {
+			if minute < dayStart || minute > dayEnd {
+				continue
+			}
+			trading[minute] = true
+			if first == 0 || minute < first {
+				first = minute
+			}
+			if minute > last {
+				last = minute
+			}
+		}
+	}
+	if len(trading) == 0 {
+		return nil
 	}
 
-	hasAny := false
-	for i := 0; i < buckets; i++ {
-		bucketStart := start.Add(time.Duration(i) * resolutionDuration)
-		if bucketStart.After(end) {
-			break
+	points := s.symbolPoints(symbol)
+	rows := make([][]string, 0, (last-first)/60+1)
+	for minute := first; minute <= last; minute += 60 {
+		price := ""
+		if point, ok := points[minute]; ok {
+			price = strconv.FormatFloat(point.price, 'f', -1, 64)
 		}
-		bucketEnd := bucketStart.Add(resolutionDuration - time.Second)
-		if bucketEnd.After(end) {
-			bucketEnd = end
+		flag := "0"
+		if trading[minute] {
+			flag = "1"
+		}
+		rows = append(rows, []string{formatDateTime(time.Unix(minute, 0)), price, flag})
+	}
+	return rows
+}
+
+// coverageFor returns the per-request minimum coverage override, or the
+// BFF_MIN_COVERAGE_MINUTES default when none is given.
+func (s *dataStore) coverageFor(override *int) int {
+	if override != nil && *override >= 0 {
+		return *override
+	}
+	return s.minCoverage
+}
+
+// Symbol orders accepted by the timeframe and symbols messages.
+const (
+	symbolOrderCoverage = "coverage"
+	symbolOrderName     = "name"
+	symbolOrderRecent   = "recent"
+)
+
+func parseSymbolOrder(value string) (string, error) {
+	switch value {
+	case "", symbolOrderCoverage:
+		return symbolOrderCoverage, nil
+	case symbolOrderName, symbolOrderRecent:
+		return value, nil
+	}
+	return "", errors.New("sort must be coverage, name or recent")
+}
+
+// sortSymbols orders symbols in place: by covered minutes, or by latest tick
+// for "recent", both descending, or by name. Ties fall back to the name.
+func (s *dataStore) sortSymbols(symbols []string, order string) {
+	keys := make(map[string]int64, len(symbols))
+	for _, symbol := range symbols {
+		points := s.symbolPoints(symbol)
+		switch order {
+		case symbolOrderName:
+		case symbolOrderRecent:
+			for _, point := range points {
+				if point.ts > keys[symbol] {
+					keys[symbol] = point.ts
+				}
+			}
+		default:
+			keys[symbol] = int64(len(points))
 		}
-		datetimes = append(datetimes, formatDateTime(bucketStart))
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		ki, kj := keys[symbols[i]], keys[symbols[j]]
+		if ki == kj {
+			return symbols[i] < symbols[j]
+		}
+		return ki > kj
+	})
+}
 
-		var latest *float64
-		if resolutionSeconds < 60 {
-			key := bucketEnd.Truncate(time.Minute).Unix()
-			if point, ok := points[key]; ok {
-				value := point.price
-				latest = &value
+// symbolsResponse keeps the plain symbols list older clients read, and adds
+// per-symbol coverage in the same order plus the store's overall range.
+type symbolsResponse struct {
+	Symbols []string     `json:"symbols"`
+	Items   []symbolInfo `json:"items"`
+	Start   string       `json:"start,omitempty"`
+	End     string       `json:"end,omitempty"`
+}
+
+type symbolInfo struct {
+	Symbol  string `json:"symbol"`
+	Minutes int    `json:"minutes"`
+	First   string `json:"first,omitempty"`
+	Last    string `json:"last,omitempty"`
+	FirstTs int64  `json:"first_ts,omitempty"`
+	LastTs  int64  `json:"last_ts,omitempty"`
+}
+
+func (s *dataStore) describeSymbols(symbols []string) symbolsResponse {
+	resp := symbolsResponse{Symbols: symbols, Items: make([]symbolInfo, 0, len(symbols))}
+	if startTS, endTS, _ := s.bounds(); startTS > 0 && endTS > 0 {
+		resp.Start = formatDateTime(time.UnixMilli(startTS))
+		resp.End = formatDateTime(time.UnixMilli(endTS))
+	}
+	for _, symbol := range symbols {
+		points := s.symbolPoints(symbol)
+		info := symbolInfo{Symbol: symbol, Minutes: len(points)}
+		for _, point := range points {
+			if info.FirstTs == 0 || point.ts < info.FirstTs {
+				info.FirstTs = point.ts
 			}
-		} else {
-			for t := bucketStart.Truncate(time.Minute); !t.After(bucketEnd); t = t.Add(time.Minute) {
-				key := t.Unix()
-				point, ok := points[key]
-				if !ok {
-					continue
-				}
-				value := point.price
-				latest = &value
+			if point.ts > info.LastTs {
+				info.LastTs = point.ts
 			}
 		}
-		if latest == nil {
-			prices = append(prices, nil)
-			continue
+		if info.Minutes > 0 {
+			info.First = formatDateTime(time.UnixMilli(info.FirstTs))
+			info.Last = formatDateTime(time.UnixMilli(info.LastTs))
 		}
-		prices = append(prices, latest)
-		hasAny = true
-	}
-
-	if !hasAny {
-		return priceOverviewResponse{}, false, nil
+		resp.Items = append(resp.Items, info)
 	}
-
-	return priceOverviewResponse{
-		Resolution: strconv.Itoa(resolutionSeconds) + "s",
-		Prices:     prices,
-		Datetimes:  datetimes,
-	}, true, nil
+	return resp
 }
 
 func (s *dataStore) listSymbols() []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	if len(s.qualityBySymbol) == 0 {
-		return nil
+	return s.listSymbolsWithCoverage(s.minCoverage)
+}
+
+// listSymbolsWithCoverage lists symbols with at least minCoverage minutes of
+// data. Sparser symbols stay queryable by name.
+func (s *dataStore) listSymbolsWithCoverage(minCoverage int) []string {
+	symbols := make([]string, 0)
+	for _, shard := range s.data.Load().shards {
+		for symbol, minutes := range shard.qualityBySymbol {
+			if len(minutes) < minCoverage {
+				continue
+			}
+			symbols = append(symbols, symbol)
+		}
 	}
-	symbols := make([]string, 0, len(s.qualityBySymbol))
-	for symbol := range s.qualityBySymbol {
-		symbols = append(symbols, symbol)
+	if len(symbols) == 0 {
+		return nil
 	}
 	sort.Strings(symbols)
 	return symbols
 }
 
-func ingestFile(path string, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
+// ingestFile adds the minutes of the file at path to quality and prices.
+// The file is parsed into maps of its own and merged only once it has been
+// read without error, so a file that fails partway adds nothing.
+func ingestFile(path string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
+	fileQuality := make(map[string]map[int64]bool)
+	filePrices := make(map[string]map[int64]minutePrice)
+	fileMinTS, fileMaxTS := *minTS, *maxTS
+	if err := parseTickFile(path, cfg, fileQuality, filePrices, &fileMinTS, &fileMaxTS); err != nil {
+		return err
+	}
+	for symbol, minutes := range fileQuality {
+		if quality[symbol] == nil {
+			quality[symbol] = minutes
+			prices[symbol] = filePrices[symbol]
+			continue
+		}
+		for minute := range minutes {
+			quality[symbol][minute] = true
+		}
+		for minute, point := range filePrices[symbol] {
+			current, exists := prices[symbol][minute]
+			prices[symbol][minute] = addMinutePrice(current, exists, point)
+		}
+	}
+	*minTS, *maxTS = fileMinTS, fileMaxTS
+	return nil
+}
+
+func parseTickFile(path string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	if !scanner.Scan() {
-		return scanner.Err()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if cfg.maxFileBytes > 0 && info.Size() > cfg.maxFileBytes {
+		return fmt.Errorf("%w: %d bytes, limit is %d", errFileTooLarge, info.Size(), cfg.maxFileBytes)
+	}
+
+	symbol := cfg.canonicalSymbol(filepath.Base(filepath.Dir(path)))
+	// The uploaders append to files while we read them: stop at the size seen
+	// at open, and below drop a trailing line that was only partly written.
+	reader := bufio.NewReader(io.LimitReader(file, info.Size()))
+	rawFirstLine, err := reader.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	firstLine := strings.TrimSpace(rawFirstLine)
+	if strings.HasPrefix(firstLine, "#") {
+		version, ok := parseCSVSchemaLine(firstLine)
+		if !ok || version > csvSchemaVersion {
+			log.Printf("skipping %s: unsupported schema line %q", path, firstLine)
+			return nil
+		}
+		rawFirstLine, err = reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		firstLine = strings.TrimSpace(rawFirstLine)
 	}
-	firstLine := strings.TrimSpace(scanner.Text())
 	if firstLine == "" {
 		return nil
 	}
 
+	if strings.HasPrefix(firstLine, "{") || strings.HasPrefix(firstLine, "[") {
+		array := strings.HasPrefix(firstLine, "[")
+		return ingestJSONTicks(io.MultiReader(strings.NewReader(rawFirstLine), reader), array, symbol, cfg, quality, prices, minTS, maxTS)
+	}
+
+	// Past this point the formats are line based. A first line without a
+	// newline is the whole file and may be cut short.
+	if !strings.HasSuffix(rawFirstLine, "\n") {
+		return nil
+	}
+	lines := &completeLinesReader{r: reader}
+
 	if strings.Contains(firstLine, "|") && !strings.Contains(firstLine, ",") {
-		if err := ingestCedroLine(firstLine, path, quality, prices, minTS, maxTS); err != nil {
+		if err := ingestCedroLine(firstLine, symbol, cfg, quality, prices, minTS, maxTS); err != nil {
 			return err
 		}
+		scanner := bufio.NewScanner(lines)
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
 			if line == "" {
 				continue
 			}
-			if err := ingestCedroLine(line, path, quality, prices, minTS, maxTS); err != nil {
+			if err := ingestCedroLine(line, symbol, cfg, quality, prices, minTS, maxTS); err != nil {
 				return err
 			}
 		}
 		return scanner.Err()
 	}
 
-	headers, err := parseCSVHeader(firstLine)
+	delimiter := sniffCSVDelimiter(firstLine)
+	headers, err := parseCSVHeader(firstLine, delimiter)
 	if err != nil {
 		return err
 	}
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1
-	return ingestCSVWithHeaders(reader, headers, path, quality, prices, minTS, maxTS)
+	csvReader := csv.NewReader(lines)
+	csvReader.Comma = delimiter
+	csvReader.FieldsPerRecord = -1
+	return ingestCSVWithHeaders(csvReader, headers, symbol, cfg, quality, prices, minTS, maxTS)
+}
+
+// ingestJSONTicks reads either a JSON array of tick objects or one tick
+// object per line. Timestamp and price are taken from the first present
+// field in cfg.jsonTimeFields and cfg.jsonPriceFields respectively.
+func ingestJSONTicks(r io.Reader, array bool, symbol string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if array {
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	}
+
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		timeKey, timeValue := jsonFieldWithKey(record, cfg.jsonTimeFields)
+		ts, ok := parseJSONTimestamp(record[timeKey], timeValue, cfg.timeUnitFor(timeKey))
+		if !ok {
+			continue
+		}
+		price, ok := parseFloat(jsonField(record, cfg.jsonPriceFields))
+		if !ok || !abovePriceFloor(price, cfg.minPrice) {
+			continue
+		}
+		volume := parseVolume(jsonField(record, cfg.jsonVolumeFields))
+		applyPoint(symbol, ts, price, nil, volume, false, cfg.source, cfg.sourceRank, quality, prices, minTS, maxTS)
+	}
+	return nil
+}
+
+// parseJSONTimestamp is parseTimestampUnit for the JSON tick field raw,
+// read as value. A number written with a fraction or an exponent, which
+// ParseInt rejects, is truncated to whole units.
+func parseJSONTimestamp(raw any, value string, unit timeUnit) (int64, bool) {
+	if ts, ok := parseTimestampUnit(value, unit); ok {
+		return ts, true
+	}
+	number, ok := raw.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := number.Float64()
+	if err != nil || math.Abs(f) >= math.MaxInt64 {
+		return 0, false
+	}
+	return parseTimestampUnit(strconv.FormatInt(int64(f), 10), unit)
+}
+
+func jsonField(record map[string]any, keys []string) string {
+	_, value := jsonFieldWithKey(record, keys)
+	return value
 }
 
-func parseCSVHeader(line string) ([]string, error) {
+// jsonFieldWithKey is jsonField that also reports which key matched.
+func jsonFieldWithKey(record map[string]any, keys []string) (string, string) {
+	for _, key := range keys {
+		switch value := record[key].(type) {
+		case json.Number:
+			return key, value.String()
+		case string:
+			if strings.TrimSpace(value) != "" {
+				return key, value
+			}
+		}
+	}
+	return "", ""
+}
+
+// completeLinesReader passes r through up to its last newline. Bytes after
+// it are held back until more input completes the line, and dropped at EOF,
+// so a line a writer is still appending is never parsed.
+type completeLinesReader struct {
+	r       io.Reader
+	buf     []byte
+	ready   []byte
+	pending []byte
+	err     error
+}
+
+func (c *completeLinesReader) Read(p []byte) (int, error) {
+	for len(c.ready) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.buf == nil {
+			c.buf = make([]byte, 32*1024)
+		}
+		n, err := c.r.Read(c.buf)
+		c.pending = append(c.pending, c.buf[:n]...)
+		if i := bytes.LastIndexByte(c.pending, '\n'); i >= 0 {
+			c.ready = append(c.ready[:0], c.pending[:i+1]...)
+			c.pending = append(c.pending[:0], c.pending[i+1:]...)
+		}
+		c.err = err
+	}
+	n := copy(p, c.ready)
+	c.ready = c.ready[n:]
+	return n, nil
+}
+
+// csvSchemaVersion is the newest CSV layout this reader understands. The
+// uploaders start each CSV file with a "#schema=N" line ahead of the header:
+//
+//	#schema=1
+//	time_msc,bid,ask,last,volume,flags
+//
+// Columns are still located by header name, so adding a column needs no
+// bump; renaming or removing one, or changing what a column means, does.
+// Files without the line predate versioning and are read as before; files
+// with a newer version are skipped rather than misread.
+const csvSchemaVersion = 1
+
+func parseCSVSchemaLine(line string) (int, bool) {
+	raw, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(line, "#")), "schema=")
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// sniffCSVDelimiter picks the delimiter of a header line. Files written with
+// a non-default uploader delimiter use ';' or a tab; anything else is comma.
+func sniffCSVDelimiter(header string) rune {
+	if strings.Contains(header, ",") {
+		return ','
+	}
+	for _, candidate := range []rune{';', '\t'} {
+		if strings.ContainsRune(header, candidate) {
+			return candidate
+		}
+	}
+	return ','
+}
+
+func parseCSVHeader(line string, delimiter rune) ([]string, error) {
 	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma = delimiter
 	reader.FieldsPerRecord = -1
 	headers, err := reader.Read()
 	if err != nil {
@@ -1204,7 +5921,7 @@ func parseCSVHeader(line string) ([]string, error) {
 	return headers, nil
 }
 
-func ingestCSVWithHeaders(reader *csv.Reader, headers []string, path string, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
+func ingestCSVWithHeaders(reader *csv.Reader, headers []string, symbol string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
 	idxTime := indexOf(headers, "time_msc")
 	if idxTime == -1 {
 		idxTime = indexOf(headers, "t")
@@ -1212,10 +5929,18 @@ func ingestCSVWithHeaders(reader *csv.Reader, headers []string, path string, qua
 	if idxTime == -1 {
 		return errors.New("missing time column")
 	}
+	unit := cfg.timeUnitFor(headers[idxTime])
 	idxLast := indexOf(headers, "last")
 	idxBid := indexOf(headers, "bid")
 	idxAsk := indexOf(headers, "ask")
 	idxPrice := indexOf(headers, "p")
+	// mt5 writes each tick's volume, massive its size as "s"; cedro's CSV
+	// (no flags column) carries the running session volume instead.
+	idxVolume := indexOf(headers, "volume")
+	cumulative := idxVolume >= 0 && indexOf(headers, "flags") == -1
+	if idxVolume == -1 {
+		idxVolume = indexOf(headers, "s")
+	}
 
 	for {
 		record, err := reader.Read()
@@ -1231,22 +5956,35 @@ func ingestCSVWithHeaders(reader *csv.Reader, headers []string, path string, qua
 		if idxTime >= len(record) {
 			continue
 		}
-		ts, ok := parseTimestamp(record[idxTime])
+		ts, ok := parseTimestampUnit(record[idxTime], unit)
 		if !ok {
 			continue
 		}
-		price, ok := parsePrice(record, idxLast, idxBid, idxAsk)
+		price, ok := cfg.priceFormulas[symbol].eval(record, idxLast, idxBid, idxAsk)
+		if !ok {
+			price, ok = parsePrice(record, cfg.priceFields, idxLast, idxBid, idxAsk)
+		}
 		if !ok && idxPrice >= 0 && idxPrice < len(record) {
 			price, ok = parseFloat(record[idxPrice])
 		}
-		if !ok {
+		if !ok || !abovePriceFloor(price, cfg.minPrice) {
 			continue
 		}
-		applyPoint(path, ts, price, quality, prices, minTS, maxTS)
+		var secondary *float64
+		if cfg.secondaryField != "" {
+			if value, ok := parsePrice(record, []string{cfg.secondaryField}, idxLast, idxBid, idxAsk); ok {
+				secondary = &value
+			}
+		}
+		var volume int64
+		if idxVolume >= 0 && idxVolume < len(record) {
+			volume = parseVolume(record[idxVolume])
+		}
+		applyPoint(symbol, ts, price, secondary, volume, cumulative, cfg.source, cfg.sourceRank, quality, prices, minTS, maxTS)
 	}
 }
 
-func ingestCedroLine(line, path string, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
+func ingestCedroLine(line, symbol string, cfg ingestConfig, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) error {
 	parts := strings.Split(line, "|")
 	if len(parts) < 2 {
 		return nil
@@ -1260,18 +5998,28 @@ func ingestCedroLine(line, path string, quality map[string]map[int64]bool, price
 		return nil
 	}
 	price, ok := parseFloat(fields[4])
-	if !ok {
+	if !ok || !abovePriceFloor(price, cfg.minPrice) {
 		return nil
 	}
-	applyPoint(path, ts, price, quality, prices, minTS, maxTS)
+	// After the symbol and time, a quote is index:value pairs; 9 is the
+	// running session volume. A quote without it counts as no volume.
+	var volume int64
+	for i := 3; i+1 < len(fields); i += 2 {
+		if strings.TrimSpace(fields[i]) == cedroVolumeField {
+			volume = parseVolume(strings.TrimRight(fields[i+1], "! "))
+			break
+		}
+	}
+	applyPoint(symbol, ts, price, nil, volume, true, cfg.source, cfg.sourceRank, quality, prices, minTS, maxTS)
 	return nil
 }
 
-func applyPoint(path string, ts int64, price float64, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) {
+const cedroVolumeField = "9"
+
+func applyPoint(symbol string, ts int64, price float64, secondary *float64, volume int64, cumulative bool, source uint32, rank uint8, quality map[string]map[int64]bool, prices map[string]map[int64]minutePrice, minTS, maxTS *int64) {
 	minute := time.UnixMilli(ts).UTC().Truncate(time.Minute)
 	key := minute.Unix()
 
-	symbol := filepath.Base(filepath.Dir(path))
 	if quality[symbol] == nil {
 		quality[symbol] = make(map[int64]bool)
 	}
@@ -1280,13 +6028,156 @@ func applyPoint(path string, ts int64, price float64, quality map[string]map[int
 	if prices[symbol] == nil {
 		prices[symbol] = make(map[int64]minutePrice)
 	}
+	point := minutePrice{ts: ts, price: price, high: price, low: price, sources: source, priceSource: source, rank: rank, volume: volume, cumulative: cumulative}
+	if secondary != nil {
+		point.secondary, point.hasSecondary = *secondary, true
+	}
 	current, exists := prices[symbol][key]
-	if !exists || ts > current.ts {
-		prices[symbol][key] = minutePrice{ts: ts, price: price}
+	prices[symbol][key] = addMinutePrice(current, exists, point)
+}
+
+// addMinutePrice folds point into a minute of the same root. It is
+// mergeMinutePrice except that per-tick volumes add up, as they are
+// different trades.
+func addMinutePrice(current minutePrice, exists bool, point minutePrice) minutePrice {
+	merged := mergeMinutePrice(current, exists, point)
+	if exists && !point.cumulative && !current.cumulative {
+		merged.volume = current.volume + point.volume
+	}
+	return merged
+}
+
+// parseVolume reads a volume field best-effort: fractional or exponent
+// forms are rounded, and anything missing, unparsable or negative is 0.
+func parseVolume(value string) int64 {
+	number, ok := parseFloat(value)
+	if !ok || number <= 0 || math.IsNaN(number) {
+		return 0
+	}
+	if number >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(math.Round(number))
+}
+
+// timeUnit is the unit of an integer timestamp column.
+type timeUnit int
+
+const (
+	timeUnitAuto timeUnit = iota
+	timeUnitSeconds
+	timeUnitMillis
+	timeUnitMicros
+)
+
+func (u timeUnit) String() string {
+	switch u {
+	case timeUnitSeconds:
+		return "seconds"
+	case timeUnitMillis:
+		return "millis"
+	case timeUnitMicros:
+		return "micros"
+	}
+	return "auto"
+}
+
+// formatTimeUnits renders units by name for /config.
+func formatTimeUnits(units map[string]timeUnit) map[string]string {
+	formatted := make(map[string]string, len(units))
+	for name, unit := range units {
+		formatted[name] = unit.String()
+	}
+	return formatted
+}
+
+// parseTimeUnits reads NAME:UNIT pairs where UNIT is seconds, millis,
+// micros or auto. Invalid pairs are logged and skipped.
+func parseTimeUnits(value string) map[string]timeUnit {
+	pairs := parseDirs(value)
+	if len(pairs) == 0 {
+		return nil
+	}
+	units := make(map[string]timeUnit, len(pairs))
+	for _, pair := range pairs {
+		idx := strings.LastIndex(pair, ":")
+		if idx <= 0 {
+			log.Printf("ignoring invalid time unit %q", pair)
+			continue
+		}
+		name := strings.TrimSpace(pair[:idx])
+		var unit timeUnit
+		switch strings.ToLower(strings.TrimSpace(pair[idx+1:])) {
+		case "auto":
+			unit = timeUnitAuto
+		case "s", "seconds":
+			unit = timeUnitSeconds
+		case "ms", "millis":
+			unit = timeUnitMillis
+		case "us", "micros":
+			unit = timeUnitMicros
+		default:
+			log.Printf("ignoring invalid time unit %q", pair)
+			continue
+		}
+		units[name] = unit
+	}
+	return units
+}
+
+// sourceRanks ranks root dirs by their position in priority. Roots left out
+// rank after every listed one; with no priority every root ranks the same.
+func sourceRanks(dataDirs []string, priority []string) map[int]uint8 {
+	if len(priority) == 0 {
+		return nil
+	}
+	position := make(map[string]int, len(priority))
+	for i, dir := range priority {
+		if _, seen := position[dir]; !seen {
+			position[dir] = i
+		}
+	}
+	ranks := make(map[int]uint8, len(dataDirs))
+	for i, dir := range dataDirs {
+		rank, ok := position[dir]
+		if !ok {
+			rank = len(priority)
+		}
+		if rank > math.MaxUint8 {
+			rank = math.MaxUint8
+		}
+		ranks[i] = uint8(rank)
+		delete(position, dir)
+	}
+	for dir := range position {
+		log.Printf("ignoring BFF_SOURCE_PRIORITY entry %q: not in DATA_DIRS", dir)
+	}
+	return ranks
+}
+
+// sourceTimeUnits maps per-directory units onto the root dir indexes used by
+// the loaders.
+func sourceTimeUnits(dataDirs []string, byDir map[string]timeUnit) map[int]timeUnit {
+	if len(byDir) == 0 {
+		return nil
+	}
+	units := make(map[int]timeUnit, len(byDir))
+	for i, dir := range dataDirs {
+		if unit, ok := byDir[dir]; ok {
+			units[i] = unit
+		}
 	}
+	return units
 }
 
 func parseTimestamp(value string) (int64, bool) {
+	return parseTimestampUnit(value, timeUnitAuto)
+}
+
+// parseTimestampUnit normalizes an integer timestamp to milliseconds. Auto
+// picks the unit by magnitude: below 1e10 seconds, below 1e13 milliseconds,
+// below 1e16 microseconds and nanoseconds above that.
+func parseTimestampUnit(value string, unit timeUnit) (int64, bool) {
 	trimmed := strings.TrimSpace(value)
 	if trimmed == "" {
 		return 0, false
@@ -1295,15 +6186,31 @@ func parseTimestamp(value string) (int64, bool) {
 	if err != nil {
 		return 0, false
 	}
-	if ts < 10_000_000_000 {
+	switch unit {
+	case timeUnitSeconds:
+		return ts * 1000, true
+	case timeUnitMillis:
+		return ts, true
+	case timeUnitMicros:
+		return ts / 1000, true
+	}
+	switch {
+	case ts < 10_000_000_000:
 		ts *= 1000
+	case ts >= 10_000_000_000_000_000:
+		ts /= 1_000_000
+	case ts >= 10_000_000_000_000:
+		ts /= 1000
 	}
 	return ts, true
 }
 
-func (c *timeframeCache) getOrBuild(ttl time.Duration, build func() (timeframeResponse, error)) (timeframeResponse, error) {
+// getOrBuild returns the cached payload while it is younger than ttl and
+// was built from generation, the store's current generationToken; otherwise
+// it builds and caches a new one.
+func (c *timeframeCache) getOrBuild(ttl time.Duration, generation string, build func() (timeframeResponse, error)) (timeframeResponse, error) {
 	c.mu.RLock()
-	if !c.updatedAt.IsZero() && time.Since(c.updatedAt) < ttl {
+	if c.freshLocked(ttl, generation) {
 		cached := c.payload
 		c.mu.RUnlock()
 		return cached, nil
@@ -1312,7 +6219,7 @@ func (c *timeframeCache) getOrBuild(ttl time.Duration, build func() (timeframeRe
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if !c.updatedAt.IsZero() && time.Since(c.updatedAt) < ttl {
+	if c.freshLocked(ttl, generation) {
 		return c.payload, nil
 	}
 
@@ -1325,6 +6232,19 @@ func (c *timeframeCache) getOrBuild(ttl time.Duration, build func() (timeframeRe
 	return payload, nil
 }
 
+// freshLocked reports whether the cached payload can be served; c.mu must be
+// held.
+func (c *timeframeCache) freshLocked(ttl time.Duration, generation string) bool {
+	return !c.updatedAt.IsZero() && time.Since(c.updatedAt) < ttl && c.payload.Generation == generation
+}
+
+func (c *timeframeCache) set(payload timeframeResponse) {
+	c.mu.Lock()
+	c.payload = payload
+	c.updatedAt = time.Now()
+	c.mu.Unlock()
+}
+
 func (c *timeframeCache) reset() {
 	c.mu.Lock()
 	c.payload = timeframeResponse{}
@@ -1332,6 +6252,9 @@ func (c *timeframeCache) reset() {
 	c.mu.Unlock()
 }
 
+// startDataReloader reloads the store every interval. A failed reload keeps
+// serving the previous data; consecutive failures are counted so /health can
+// report the service unhealthy once they reach maxFailures.
 func startDataReloader(interval time.Duration, dataDirs []string, store *dataStore, cache *timeframeCache) {
 	if interval <= 0 {
 		return
@@ -1340,9 +6263,161 @@ func startDataReloader(interval time.Duration, dataDirs []string, store *dataSto
 	defer ticker.Stop()
 	for range ticker.C {
 		if err := store.loadFromDirs(dataDirs); err != nil {
-			log.Printf("failed to reload data: %v", err)
+			failures := store.recordReloadFailure()
+			log.Printf("ERROR failed to reload data (%d consecutive failures, serving last good data): %v", failures, err)
+			continue
+		}
+		store.recordReloadSuccess()
+		warmTimeframeCache(store, cache)
+	}
+}
+
+// startDataWatcher watches dataDirs and merges new or changed minute files
+// into the store. Events are batched for debounce after the first one so a
+// bulk write becomes a single merge. It returns an error when no data dir
+// could be watched, in which case the caller should poll instead.
+func startDataWatcher(dataDirs []string, debounce time.Duration, store *dataStore, cache *timeframeCache) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watched := 0
+	for _, rootDir := range dataDirs {
+		if strings.TrimSpace(rootDir) == "" {
+			continue
+		}
+		if err := addWatchTree(watcher, rootDir, nil, nil); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			_ = watcher.Close()
+			return err
+		}
+		watched++
+	}
+	if watched == 0 {
+		_ = watcher.Close()
+		return errNoReadableDataDirs
+	}
+	go runDataWatcher(watcher, dataDirs, debounce, store, cache)
+	return nil
+}
+
+// addWatchTree watches dir and the date and symbol dirs below it; parts is
+// dir's path relative to its data root. Files already present in a newly
+// created dir are added to pending, since their create events may have been
+// missed.
+func addWatchTree(watcher *fsnotify.Watcher, dir string, parts []string, pending map[string]struct{}) error {
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			child := append(append([]string(nil), parts...), entry.Name())
+			if watchable(child) {
+				if err := addWatchTree(watcher, path, child, pending); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if pending != nil && strings.HasSuffix(entry.Name(), ".csv") {
+			pending[path] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// watchable reports whether a dir at parts under a data root is a date or
+// symbol dir (or a level of a nested date) and so needs watching.
+func watchable(parts []string) bool {
+	return len(parts) <= dateLevels(parts)+1
+}
+
+// watchPath returns dir's path relative to the data root holding it.
+func watchPath(dataDirs []string, dir string) ([]string, bool) {
+	for _, rootDir := range dataDirs {
+		if strings.TrimSpace(rootDir) == "" {
+			continue
+		}
+		rel, err := filepath.Rel(rootDir, dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
 			continue
 		}
-		cache.reset()
+		if rel == "." {
+			return nil, true
+		}
+		return strings.Split(filepath.ToSlash(rel), "/"), true
+	}
+	return nil, false
+}
+
+func runDataWatcher(watcher *fsnotify.Watcher, dataDirs []string, debounce time.Duration, store *dataStore, cache *timeframeCache) {
+	defer watcher.Close()
+	pending := make(map[string]struct{})
+	var flush <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if parts, ok := watchPath(dataDirs, event.Name); ok && watchable(parts) {
+						if err := addWatchTree(watcher, event.Name, parts, pending); err != nil {
+							log.Printf("could not watch %s: %v", event.Name, err)
+						}
+					}
+				}
+			}
+			if strings.HasSuffix(event.Name, ".csv") {
+				pending[event.Name] = struct{}{}
+			}
+			if len(pending) > 0 && flush == nil {
+				flush = time.After(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("data watcher error: %v", err)
+		case <-flush:
+			flush = nil
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			pending = make(map[string]struct{})
+			if err := store.mergeFiles(dataDirs, paths); err != nil {
+				log.Printf("ERROR failed to merge %d changed files: %v", len(paths), err)
+				continue
+			}
+			warmTimeframeCache(store, cache)
+		}
+	}
+}
+
+// warmTimeframeCache rebuilds the default timeframe payload right after a
+// load so the first client does not pay for it. An empty store is skipped
+// and leaves the cache cleared.
+func warmTimeframeCache(store *dataStore, cache *timeframeCache) {
+	cache.reset()
+	if len(store.listSymbolsWithCoverage(0)) == 0 {
+		return
+	}
+	payload, err := store.buildTimeframeResponse(context.Background(), store.minCoverage, false, symbolOrderCoverage)
+	if err != nil {
+		log.Printf("failed to warm timeframe cache: %v", err)
+		return
 	}
+	cache.set(payload)
 }
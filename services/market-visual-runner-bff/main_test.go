@@ -0,0 +1,650 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeDataFile writes body to <root>/<date>/<symbol>/<name> and returns
+// the path.
+func writeDataFile(t *testing.T, root, date, symbol, name, body string) string {
+	t.Helper()
+	dir := filepath.Join(root, date, symbol)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const mt5Header = "time_msc,bid,ask,last,volume,flags\n"
+
+func TestMergeFilesDoesNotSumVolumeAcrossRoots(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	var paths []string
+	for _, root := range roots {
+		paths = append(paths, writeDataFile(t, root, "2024-03-05", "EWZ", "10_00.csv", mt5Header+"1709632800000,1,2,1.5,3,0\n1709632810000,1,2,1.5,4,0\n"))
+	}
+
+	store := newDataStore(ingestConfig{priceFields: defaultPriceFields})
+	if err := store.mergeFiles(roots, paths); err != nil {
+		t.Fatal(err)
+	}
+	point, ok := store.symbolPoints("EWZ")[1709632800]
+	if !ok {
+		t.Fatal("minute not loaded")
+	}
+	if point.volume != 7 {
+		t.Fatalf("volume = %d, want 7", point.volume)
+	}
+}
+
+func TestGenerationTokenDiffersAcrossBoots(t *testing.T) {
+	first := newDataStore(ingestConfig{})
+	second := newDataStore(ingestConfig{})
+	if first.generationToken() == second.generationToken() {
+		t.Fatalf("two stores share generation token %q", first.generationToken())
+	}
+}
+
+func TestTimeframeReportsGenerationToken(t *testing.T) {
+	store := newDataStore(ingestConfig{})
+	resp, err := store.buildTimeframeResponse(context.Background(), 0, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Generation != store.generationToken() {
+		t.Fatalf("timeframe generation %q, want %q", resp.Generation, store.generationToken())
+	}
+}
+
+func TestMergeFilesLeavesPublishedDataUntouched(t *testing.T) {
+	root := t.TempDir()
+	first := writeDataFile(t, root, "2024-03-05", "EWZ", "10_00.csv", mt5Header+"1709632800000,1,2,1.5,3,0\n")
+	store := newDataStore(ingestConfig{priceFields: defaultPriceFields})
+	if err := store.mergeFiles([]string{root}, []string{first}); err != nil {
+		t.Fatal(err)
+	}
+	before := store.data.Load()
+
+	second := writeDataFile(t, root, "2024-03-05", "EWZ", "10_01.csv", mt5Header+"1709632860000,1,2,1.5,3,0\n")
+	if err := store.mergeFiles([]string{root}, []string{second}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := before.points("EWZ")[1709632860]; ok {
+		t.Fatal("merge modified the previously published data")
+	}
+	if _, ok := store.symbolPoints("EWZ")[1709632860]; !ok {
+		t.Fatal("merged minute not published")
+	}
+	_, _, oldGeneration := before.bounds(store.boot)
+	if oldGeneration == store.generationToken() {
+		t.Fatal("merge did not bump the generation")
+	}
+}
+
+// BenchmarkSymbolPointsDuringReload reads while another goroutine swaps in
+// full reloads back to back; readers never wait on the swap.
+func BenchmarkSymbolPointsDuringReload(b *testing.B) {
+	quality := make(map[string]map[int64]bool)
+	prices := make(map[string]map[int64]minutePrice)
+	symbols := make([]string, 64)
+	for i := range symbols {
+		symbol := "SYM" + strconv.Itoa(i)
+		symbols[i] = symbol
+		quality[symbol] = make(map[int64]bool)
+		prices[symbol] = make(map[int64]minutePrice)
+		for minute := int64(0); minute < 1000; minute++ {
+			ts := 1709632800 + minute*60
+			quality[symbol][ts] = true
+			prices[symbol][ts] = minutePrice{ts: ts, price: float64(i)}
+		}
+	}
+	store := newDataStore(ingestConfig{})
+	store.swap(nil, 1709632800000, 1709692800000, quality, prices)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				store.swap(nil, 1709632800000, 1709692800000, quality, prices)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if len(store.symbolPoints(symbols[i%len(symbols)])) == 0 {
+				b.Fatal("symbol missing during reload")
+			}
+			i++
+		}
+	})
+}
+
+func TestReleasedMessagesEnabledWithoutFeatures(t *testing.T) {
+	features := parseFeatures("")
+	for _, msgType := range []string{"source_coverage", "multi_range_overview", "price_overview"} {
+		if !features.enabled(msgType) {
+			t.Errorf("%s disabled without BFF_FEATURES", msgType)
+		}
+	}
+}
+
+func TestExperimentalMessagesNeedFeatures(t *testing.T) {
+	if parseFeatures("").enabled("twap_overview") {
+		t.Fatal("twap_overview enabled without BFF_FEATURES")
+	}
+	features := parseFeatures("twap_overview")
+	if !features.enabled("twap_overview") || features.enabled("top_movers") {
+		t.Fatalf("BFF_FEATURES=twap_overview enabled %v", features.active())
+	}
+	if !parseFeatures("*").enabled("top_movers") {
+		t.Fatal("BFF_FEATURES=* did not enable top_movers")
+	}
+}
+
+func TestIngestFileSkipsOversizedFile(t *testing.T) {
+	body := mt5Header + "1709632800000,1,2,1.5,3,0\n"
+	path := writeDataFile(t, t.TempDir(), "2024-03-05", "EWZ", "10_00.csv", body)
+	for _, tc := range []struct {
+		limit  int64
+		loaded bool
+	}{
+		{int64(len(body)) - 1, false},
+		{int64(len(body)), true},
+		{0, true},
+	} {
+		cfg := ingestConfig{priceFields: defaultPriceFields, maxFileBytes: tc.limit}
+		quality := make(map[string]map[int64]bool)
+		prices := make(map[string]map[int64]minutePrice)
+		var startTS, endTS int64
+		err := ingestFile(path, cfg, quality, prices, &startTS, &endTS)
+		if tc.loaded != (err == nil) || (err != nil && !errors.Is(err, errFileTooLarge)) {
+			t.Fatalf("limit %d: err = %v", tc.limit, err)
+		}
+		if loaded := len(prices["EWZ"]) > 0; loaded != tc.loaded {
+			t.Errorf("limit %d: loaded = %v, want %v", tc.limit, loaded, tc.loaded)
+		}
+	}
+}
+
+func TestOversizedFileCountsAsSkipped(t *testing.T) {
+	body := mt5Header + "1709632800000,1,2,1.5,3,0\n"
+	path := writeDataFile(t, t.TempDir(), "2024-03-05", "EWZ", "10_00.csv", body)
+	cfg := ingestConfig{priceFields: defaultPriceFields, maxFileBytes: 1}
+	quality := make(map[string]map[int64]bool)
+	prices := make(map[string]map[int64]minutePrice)
+	var startTS, endTS int64
+	var stats loadStats
+	if err := stats.ingest(path, cfg, quality, prices, &startTS, &endTS); err != nil {
+		t.Fatal(err)
+	}
+	if stats.files != 0 || stats.skipped != 1 || !strings.Contains(stats.lastSkip, errFileTooLarge.Error()) {
+		t.Fatalf("stats = %+v", stats)
+	}
+	cfg.strict = true
+	if err := stats.ingest(path, cfg, quality, prices, &startTS, &endTS); !errors.Is(err, errFileTooLarge) {
+		t.Fatalf("strict ingest = %v, want errFileTooLarge", err)
+	}
+}
+
+func TestParseTimestampUnit(t *testing.T) {
+	const want = int64(1709632800123)
+	for _, tc := range []struct {
+		value string
+		unit  timeUnit
+		want  int64
+	}{
+		{"1709632800", timeUnitSeconds, 1709632800000},
+		{"1709632800123", timeUnitMillis, want},
+		{"1709632800123456", timeUnitMicros, want},
+		{"1709632800", timeUnitAuto, 1709632800000},
+		{"1709632800123", timeUnitAuto, want},
+		{"1709632800123456", timeUnitAuto, want},
+		{"1709632800123456789", timeUnitAuto, want},
+	} {
+		got, ok := parseTimestampUnit(tc.value, tc.unit)
+		if !ok || got != tc.want {
+			t.Errorf("parseTimestampUnit(%q, %d) = %d, %v; want %d", tc.value, tc.unit, got, ok, tc.want)
+		}
+	}
+}
+
+func TestParseTimeUnits(t *testing.T) {
+	units := parseTimeUnits("time_msc:ms, ts:micros, epoch:seconds, other:auto, bad:hours")
+	want := map[string]timeUnit{"time_msc": timeUnitMillis, "ts": timeUnitMicros, "epoch": timeUnitSeconds, "other": timeUnitAuto}
+	if len(units) != len(want) {
+		t.Fatalf("parseTimeUnits = %v, want %v", units, want)
+	}
+	for name, unit := range want {
+		if units[name] != unit {
+			t.Errorf("unit of %s = %d, want %d", name, units[name], unit)
+		}
+	}
+}
+
+func TestSymbolPointsFoldsRequestedCase(t *testing.T) {
+	for _, tc := range []struct {
+		symbolCase string
+		stored     string
+	}{
+		{"upper", "EWZ"},
+		{"lower", "ewz"},
+	} {
+		root := t.TempDir()
+		path := writeDataFile(t, root, "2024-03-05", "Ewz", "10_00.csv", mt5Header+"1709632800000,1,2,1.5,3,0\n")
+		store := newDataStore(ingestConfig{priceFields: defaultPriceFields, symbolCase: tc.symbolCase})
+		if err := store.mergeFiles([]string{root}, []string{path}); err != nil {
+			t.Fatal(err)
+		}
+		if symbols := store.listSymbolsWithCoverage(0); len(symbols) != 1 || symbols[0] != tc.stored {
+			t.Fatalf("%s: stored symbols %v, want [%s]", tc.symbolCase, symbols, tc.stored)
+		}
+		for _, requested := range []string{"EWZ", "ewz", "eWz"} {
+			if len(store.symbolPoints(requested)) == 0 {
+				t.Errorf("%s: no points for %q", tc.symbolCase, requested)
+			}
+		}
+	}
+}
+
+func TestClampIncreaseTicks(t *testing.T) {
+	const limit = 1000
+	for _, tc := range []struct {
+		ticks   int
+		want    int
+		clamped bool
+		reject  bool
+	}{
+		{0, limit, true, false},
+		{500, 500, false, false},
+		{limit, limit, false, false},
+		{limit + 1, limit, true, false},
+		{limit * rejectIncreaseFactor, limit, true, false},
+		{limit*rejectIncreaseFactor + 1, 0, false, true},
+	} {
+		got, clamped, err := clampIncreaseTicks(tc.ticks, limit)
+		if (err != nil) != tc.reject {
+			t.Errorf("clampIncreaseTicks(%d) error = %v, want reject %v", tc.ticks, err, tc.reject)
+			continue
+		}
+		if got != tc.want || clamped != tc.clamped {
+			t.Errorf("clampIncreaseTicks(%d) = %d, %v; want %d, %v", tc.ticks, got, clamped, tc.want, tc.clamped)
+		}
+	}
+	if _, _, err := clampIncreaseTicks(limit*rejectIncreaseFactor+1, limit); err == nil || !strings.Contains(err.Error(), strconv.Itoa(limit*rejectIncreaseFactor)) {
+		t.Errorf("rejection %v does not name the limit %d", err, limit*rejectIncreaseFactor)
+	}
+}
+
+func TestComputeResolutionSecondsForTicksBoundsBuckets(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(365 * 24 * time.Hour)
+	seconds, clamped := computeResolutionSecondsForTicks(start, end, maxIncreaseBuckets*10)
+	if !clamped {
+		t.Fatal("resolution not clamped")
+	}
+	if buckets := int(end.Sub(start).Seconds())/seconds + 1; buckets > maxIncreaseBuckets {
+		t.Fatalf("%d buckets, want at most %d", buckets, maxIncreaseBuckets)
+	}
+}
+
+func TestLoadFromDirsSkipsIgnoredDirs(t *testing.T) {
+	root := t.TempDir()
+	line := mt5Header + "1709632800000,1,2,1.5,3,0\n"
+	for _, symbol := range []string{"EWZ", ".trash", "_tmp", "logs", "tmp_2"} {
+		writeDataFile(t, root, "2024-03-05", symbol, "10_00.csv", line)
+	}
+	writeDataFile(t, root, ".snapshot", "SPY", "10_00.csv", line)
+
+	store := newDataStore(ingestConfig{priceFields: defaultPriceFields, ignoreDirs: []string{"logs", "_tmp", "tmp_*"}})
+	if err := store.loadFromDirs([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+	if symbols := store.listSymbolsWithCoverage(0); len(symbols) != 1 || symbols[0] != "EWZ" {
+		t.Fatalf("symbols = %v, want [EWZ]", symbols)
+	}
+}
+
+// ingestOne runs ingestFile on path and returns the minutes it produced for
+// symbol.
+func ingestOne(t *testing.T, cfg ingestConfig, path, symbol string) map[int64]minutePrice {
+	t.Helper()
+	quality := make(map[string]map[int64]bool)
+	prices := make(map[string]map[int64]minutePrice)
+	var startTS, endTS int64
+	if err := ingestFile(path, cfg, quality, prices, &startTS, &endTS); err != nil {
+		t.Fatal(err)
+	}
+	return prices[symbol]
+}
+
+func TestIngestFileReadsJSONTicks(t *testing.T) {
+	cfg := ingestConfig{
+		priceFields:     defaultPriceFields,
+		jsonTimeFields:  []string{"t", "time_msc"},
+		jsonPriceFields: []string{"p", "price"},
+	}
+	root := t.TempDir()
+	for name, body := range map[string]string{
+		"lines": "{\"t\":1709632800000,\"p\":10.5}\n{\"time_msc\":1709632860000,\"price\":\"11.25\"}\n",
+		"array": "[{\"t\":1709632800000,\"p\":10.5},\n{\"time_msc\":1709632860000,\"price\":\"11.25\"}]\n",
+		// Fractions and exponents are valid JSON numbers but not ParseInt input.
+		"floats": "{\"t\":1709632800000.0,\"p\":10.5}\n{\"t\":1.70963286e12,\"price\":\"11.25\"}\n",
+	} {
+		path := writeDataFile(t, root, "2024-03-05", "EWZ", name+".json", body)
+		points := ingestOne(t, cfg, path, "EWZ")
+		if len(points) != 2 || points[1709632800].price != 10.5 || points[1709632860].price != 11.25 {
+			t.Errorf("%s: points = %+v", name, points)
+		}
+	}
+}
+
+func TestComputeResolutionSecondsForTicksExtremes(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name  string
+		end   time.Time
+		ticks int
+	}{
+		{"max ticks over a year", start.Add(365 * 24 * time.Hour), math.MaxInt},
+		{"max ticks over a second", start.Add(time.Second), math.MaxInt},
+		{"empty range", start, 1000},
+		{"reversed range", start.Add(-time.Hour), 1000},
+		{"one tick", start.Add(time.Hour), 1},
+		{"negative ticks", start.Add(time.Hour), -5},
+	} {
+		seconds, _ := computeResolutionSecondsForTicks(start, tc.end, tc.ticks)
+		if seconds < 1 {
+			t.Errorf("%s: resolution %d", tc.name, seconds)
+			continue
+		}
+		if tc.end.After(start) {
+			if buckets := int(tc.end.Sub(start).Seconds())/seconds + 1; buckets > maxIncreaseBuckets {
+				t.Errorf("%s: %d buckets, want at most %d", tc.name, buckets, maxIncreaseBuckets)
+			}
+		}
+	}
+}
+
+func TestIngestFileSkipsPartialFinalLine(t *testing.T) {
+	cfg := ingestConfig{priceFields: defaultPriceFields}
+	body := mt5Header + "1709632800000,1,2,1.5,3,0\n1709632860000,1,2,1."
+	path := writeDataFile(t, t.TempDir(), "2024-03-05", "EWZ", "10_00.csv", body)
+	points := ingestOne(t, cfg, path, "EWZ")
+	if len(points) != 1 {
+		t.Fatalf("points = %+v, want only the complete line", points)
+	}
+	if _, ok := points[1709632800]; !ok {
+		t.Fatal("complete line not loaded")
+	}
+
+	// Once the writer finishes the line it is picked up.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString("5,3,0\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if points := ingestOne(t, cfg, path, "EWZ"); len(points) != 2 {
+		t.Fatalf("points = %+v after the line completed", points)
+	}
+}
+
+func TestSubMinuteOverviewPlacesEachMinuteOnce(t *testing.T) {
+	const first = int64(1709632800) // 2024-03-05 10:00:00 UTC
+	prices := map[string]map[int64]minutePrice{"EWZ": {
+		first:      {ts: (first + 25) * 1000, price: 1.5},
+		first + 60: {ts: (first + 65) * 1000, price: 2.5},
+	}}
+	quality := map[string]map[int64]bool{"EWZ": {first: true, first + 60: true}}
+	store := newDataStore(ingestConfig{})
+	store.swap(nil, first*1000, (first+119)*1000, quality, prices)
+
+	start := time.Unix(first, 0).UTC()
+	resp, ok, err := store.buildPriceOverview(context.Background(), "EWZ", start, start.Add(119*time.Second), 10, false, false, nil)
+	if err != nil || !ok {
+		t.Fatalf("buildPriceOverview: ok %v, err %v", ok, err)
+	}
+	if len(resp.Prices) != 12 {
+		t.Fatalf("%d buckets, want 12", len(resp.Prices))
+	}
+	want := map[int]float64{2: 1.5, 6: 2.5}
+	for i, price := range resp.Prices {
+		expected, set := want[i]
+		switch {
+		case set && (price == nil || *price != expected):
+			t.Errorf("bucket %d = %v, want %v", i, price, expected)
+		case !set && price != nil:
+			t.Errorf("bucket %d = %v, want null", i, *price)
+		}
+	}
+}
+
+func TestPriceFormulaStringRoundTrips(t *testing.T) {
+	formula, err := parsePriceFormula("0.5*bid + 0.5*ask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formula.String(); got != "0.5*bid+0.5*ask" {
+		t.Fatalf("String() = %q", got)
+	}
+	again, err := parsePriceFormula(formula.String())
+	if err != nil || len(again) != len(formula) {
+		t.Fatalf("reparsed %v, %v", again, err)
+	}
+}
+
+func TestSwapAndMergeFilesDoNotLoseGenerations(t *testing.T) {
+	root := t.TempDir()
+	path := writeDataFile(t, root, "2024-03-05", "EWZ", "10_00.csv", mt5Header+"1709632800000,1,2,1.5,3,0\n")
+	store := newDataStore(ingestConfig{priceFields: defaultPriceFields})
+	const rounds = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			store.swap(nil, 0, 0, nil, nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if err := store.mergeFiles([]string{root}, []string{path}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+	if got := store.data.Load().generation; got != 2*rounds {
+		t.Fatalf("generation %d after %d publishes", got, 2*rounds)
+	}
+}
+
+func TestTimeframeCacheRebuildsForNewGeneration(t *testing.T) {
+	cache := &timeframeCache{}
+	cache.set(timeframeResponse{Generation: "boot-1"})
+	builds := 0
+	build := func() (timeframeResponse, error) {
+		builds++
+		return timeframeResponse{Generation: "boot-2"}, nil
+	}
+
+	resp, err := cache.getOrBuild(time.Minute, "boot-1", build)
+	if err != nil || resp.Generation != "boot-1" || builds != 0 {
+		t.Fatalf("same generation: %+v, %v, %d builds", resp, err, builds)
+	}
+	resp, err = cache.getOrBuild(time.Minute, "boot-2", build)
+	if err != nil || resp.Generation != "boot-2" || builds != 1 {
+		t.Fatalf("new generation: %+v, %v, %d builds", resp, err, builds)
+	}
+}
+
+func TestFailedFileLeavesNoPartialPoints(t *testing.T) {
+	root := t.TempDir()
+	writeDataFile(t, root, "2024-03-05", "EWZ", "10_00.csv", "{\"t\":1709632800000,\"p\":10.5}\n{\"t\":\n")
+	writeDataFile(t, root, "2024-03-05", "SPY", "10_00.csv", mt5Header+"1709632800000,1,2,1.5,3,0\n")
+
+	store := newDataStore(ingestConfig{priceFields: defaultPriceFields, jsonTimeFields: []string{"t"}, jsonPriceFields: []string{"p"}})
+	if err := store.loadFromDirs([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+	if points := store.symbolPoints("EWZ"); len(points) != 0 {
+		t.Fatalf("failed file left points %+v", points)
+	}
+	if len(store.symbolPoints("SPY")) == 0 {
+		t.Fatal("good file not loaded")
+	}
+}
+
+func TestFitResolutionCoarsensThenRejects(t *testing.T) {
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	out := wsResponse{Type: "price_overview", RequestID: "r1", Data: strings.Repeat("x", 500)}
+
+	next, shrink, err := fitResolution(out, 60, start, end, 100)
+	if err != nil || !shrink || next <= 60 {
+		t.Fatalf("fitResolution = %d, %v, %v; want a coarser resolution", next, shrink, err)
+	}
+	if _, shrink, err := fitResolution(out, 7200, start, end, 100); shrink || !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("fitResolution at one bucket = %v, %v; want errResponseTooLarge", shrink, err)
+	}
+	if _, shrink, err := fitResolution(out, 60, start, end, 0); shrink || err != nil {
+		t.Fatalf("fitResolution with no limit = %v, %v", shrink, err)
+	}
+}
+
+func TestCheckResponseSize(t *testing.T) {
+	out := wsResponse{Type: "price_overview_chunk", RequestID: "r1", Data: strings.Repeat("x", 500)}
+	if err := checkResponseSize(out, 100); !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("checkResponseSize = %v, want errResponseTooLarge", err)
+	}
+	if err := checkResponseSize(out, 1<<20); err != nil {
+		t.Fatalf("checkResponseSize under the limit = %v", err)
+	}
+}
+
+// dialTestServer serves store, loaded from dataDirs, on /ws and dials it.
+func dialTestServer(t *testing.T, store *dataStore, dataDirs []string, idleTimeout time.Duration, maxBatchSymbols int) *websocket.Conn {
+	t.Helper()
+	handler := handleWebsocket(store, &timeframeCache{}, time.Minute, time.Second, idleTimeout, maxBatchSymbols, maxIncreaseBuckets, 0, false, "", parseFeatures(""), nil, dataDirs, newSessionManager(), "")
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestIdleConnectionClosedWhileAnsweringPings(t *testing.T) {
+	conn := dialTestServer(t, newDataStore(ingestConfig{}), nil, 100*time.Millisecond, defaultMaxBatchSymbols)
+	// ReadMessage answers pings; it only returns once the server closes.
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection that answers pings was not closed")
+	}
+}
+
+func TestActiveConnectionStaysOpen(t *testing.T) {
+	conn := dialTestServer(t, newDataStore(ingestConfig{}), nil, 100*time.Millisecond, defaultMaxBatchSymbols)
+	for i := 0; i < 8; i++ {
+		if err := conn.WriteJSON(wsRequest{Type: "config", RequestID: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		var resp wsResponse
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+}
+
+func TestListedSymbolsCountAgainstBatchCap(t *testing.T) {
+	root := t.TempDir()
+	var paths []string
+	for _, symbol := range []string{"EWZ", "PETR4"} {
+		paths = append(paths, writeDataFile(t, root, "2024-03-05", symbol, "10_00.csv", mt5Header+"1709632800000,1,2,1.5,3,0\n"))
+	}
+	store := newDataStore(ingestConfig{priceFields: defaultPriceFields})
+	if err := store.mergeFiles([]string{root}, paths); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialTestServer(t, store, []string{root}, time.Minute, 1)
+
+	for _, msg := range []wsRequest{
+		{Type: "source_coverage", RequestID: "coverage", Start: "2024-03-05T00:00:00Z", End: "2024-03-06T00:00:00Z"},
+		{Type: "increase_resolution", RequestID: "increase", Start: "2024-03-05T10:00:00Z", End: "2024-03-05T11:00:00Z"},
+	} {
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		var resp wsResponse
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Type != "error" || !strings.Contains(resp.Message, "at most 1 symbols") {
+			t.Fatalf("%s: got %s %q, want the batch cap error", msg.Type, resp.Type, resp.Message)
+		}
+	}
+}
+
+func TestClampOverviewResolution(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(365 * 24 * time.Hour)
+	resolution, clamped := clampOverviewResolution(start, end, 1)
+	if !clamped {
+		t.Fatal("a year at 1s was not clamped")
+	}
+	if buckets := int(end.Sub(start).Seconds())/resolution + 1; buckets > maxOverviewBuckets {
+		t.Fatalf("resolution %d gives %d buckets, cap is %d", resolution, buckets, maxOverviewBuckets)
+	}
+	if resolution, clamped := clampOverviewResolution(start, start.Add(time.Hour), 60); clamped || resolution != 60 {
+		t.Fatalf("an hour at 60s = %d, %v; want it unchanged", resolution, clamped)
+	}
+}
+
+func TestParseResolutionValueRejectsPastLargestAllowed(t *testing.T) {
+	largest := allowedResolutions[len(allowedResolutions)-1]
+	if _, err := parseResolutionValue(largest); err != nil {
+		t.Fatalf("parseResolutionValue(%d) = %v", largest, err)
+	}
+	if _, err := parseResolutionValue(largest + 1); err == nil {
+		t.Fatalf("parseResolutionValue(%d) accepted", largest+1)
+	}
+}
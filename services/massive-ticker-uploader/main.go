@@ -1,42 +1,101 @@
 package main
 
 import (
+	"bufio"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
 )
 
 const uploadDir = "/data/massive-ticker-uploader"
 
+// csvSchemaLine is written before the header of each new minute file; bump
+// the version when a column is renamed, removed or changes meaning.
+const csvSchemaLine = "#schema=1\n"
+
 type massiveTick struct {
-	Ev  string  `json:"ev"`
-	Sym string  `json:"sym"`
-	I   string  `json:"i"`
-	X   int64   `json:"x"`
-	P   float64 `json:"p"`
-	S   int64   `json:"s"`
-	C   []int   `json:"c"`
-	T   int64   `json:"t"`
-	Q   int64   `json:"q"`
-	Z   int64   `json:"z"`
-	DS  string  `json:"ds"`
+	Ev  string      `json:"ev"`
+	Sym string      `json:"sym"`
+	I   string      `json:"i"`
+	X   int64       `json:"x"`
+	P   float64     `json:"p"`
+	S   tolerantInt `json:"s"`
+	C   []int       `json:"c"`
+	T   int64       `json:"t"`
+	Q   tolerantInt `json:"q"`
+	Z   tolerantInt `json:"z"`
+	DS  string      `json:"ds"`
+}
+
+// tolerantInt is an int64 that also accepts floats and exponent notation
+// ("1.5e3"), rounding to the nearest integer and clamping values past the
+// int64 range. Anything that isn't a number becomes 0. Either way one odd
+// field is logged instead of failing the whole tick array.
+type tolerantInt int64
+
+func (n *tolerantInt) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if value, err := strconv.ParseInt(text, 10, 64); err == nil {
+		*n = tolerantInt(value)
+		return nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		log.Printf("ignoring non-numeric tick field %s", truncateForLog(data, 100))
+		*n = 0
+		return nil
+	}
+	switch {
+	case value >= math.MaxInt64:
+		log.Printf("clamping oversized tick field %s", truncateForLog(data, 100))
+		*n = math.MaxInt64
+	case value <= math.MinInt64:
+		log.Printf("clamping oversized tick field %s", truncateForLog(data, 100))
+		*n = math.MinInt64
+	default:
+		*n = tolerantInt(math.Round(value))
+	}
+	return nil
 }
 
+// subscribeParamPattern matches one Massive subscription: a channel prefix
+// followed by a ticker or "*", e.g. "T.EWZ", "AM.*".
+var subscribeParamPattern = regexp.MustCompile(`^(T|Q|A|AM|LULD|FMV|NOI)\.([A-Za-z0-9.:\-]+|\*)$`)
+
 type actionMessage struct {
 	Action string `json:"action"`
 	Params string `json:"params"`
 }
 
+// errStatusTimeout means the feed stayed connected but never sent the status
+// we were waiting for; for auth_success that usually points at credentials
+// or the provider rather than the network.
+var errStatusTimeout = errors.New("timed out waiting for status")
+
+// authAttempts is how many times run sends the auth action on one connection
+// before giving up and reconnecting.
+const authAttempts = 2
+
 type statusMessage struct {
 	Ev      string `json:"ev"`
 	Status  string `json:"status"`
@@ -58,23 +117,107 @@ func main() {
 	if subscribe == "" {
 		subscribe = "T.EWZ"
 	}
+	if err := validateSubscribe(subscribe); err != nil {
+		log.Fatalf("invalid MASSIVE_SUBSCRIBE: %v", err)
+	}
+
+	flushGrace := 10 * time.Second
+	if value := strings.TrimSpace(os.Getenv("MASSIVE_FLUSH_GRACE_SECONDS")); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			log.Fatalf("invalid MASSIVE_FLUSH_GRACE_SECONDS: %q", value)
+		}
+		flushGrace = time.Duration(seconds) * time.Second
+	}
+
+	format, err := parseCSVFormat(os.Getenv("MASSIVE_CSV_DELIMITER"), os.Getenv("MASSIVE_CSV_QUOTE"))
+	if err != nil {
+		log.Fatalf("invalid CSV format: %v", err)
+	}
+	format.priceDecimals, err = parsePriceDecimals(os.Getenv("MASSIVE_PRICE_DECIMALS"))
+	if err != nil {
+		log.Fatalf("invalid MASSIVE_PRICE_DECIMALS: %v", err)
+	}
+
+	// MASSIVE_DIR_LAYOUT=nested writes YYYY/MM/DD/<symbol>/ instead of the
+	// flat YYYY-MM-DD/<symbol>/ day directories.
+	layout, err := parseDateLayout(os.Getenv("MASSIVE_DIR_LAYOUT"))
+	if err != nil {
+		log.Fatalf("invalid MASSIVE_DIR_LAYOUT: %v", err)
+	}
+
+	authTimeout := 20 * time.Second
+	if value := strings.TrimSpace(os.Getenv("MASSIVE_AUTH_TIMEOUT_SECONDS")); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			log.Fatalf("invalid MASSIVE_AUTH_TIMEOUT_SECONDS: %q", value)
+		}
+		authTimeout = time.Duration(seconds) * time.Second
+	}
+
+	// MASSIVE_MAX_BUFFERED_TICKS bounds the ticks held between flushes; see
+	// bufferLimit.
+	limit := bufferLimit{}
+	if value := strings.TrimSpace(os.Getenv("MASSIVE_MAX_BUFFERED_TICKS")); value != "" {
+		maxTicks, err := strconv.Atoi(value)
+		if err != nil || maxTicks < 0 {
+			log.Fatalf("invalid MASSIVE_MAX_BUFFERED_TICKS: %q", value)
+		}
+		limit.maxTicks = maxTicks
+	}
+	switch overflow := strings.ToLower(strings.TrimSpace(os.Getenv("MASSIVE_BUFFER_OVERFLOW"))); overflow {
+	case "", "flush":
+	case "drop":
+		limit.drop = true
+	default:
+		log.Fatalf("invalid MASSIVE_BUFFER_OVERFLOW: %q", overflow)
+	}
+
+	metricsAddr := strings.TrimSpace(os.Getenv("MASSIVE_METRICS_ADDR"))
+	if metricsAddr == "" {
+		metricsAddr = ":9090"
+	}
+
+	// MASSIVE_DEBUG_RECENT enables /debug/recent with that many raw events
+	// kept per symbol.
+	debugRecent := 0
+	if value := strings.TrimSpace(os.Getenv("MASSIVE_DEBUG_RECENT")); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			log.Fatalf("invalid MASSIVE_DEBUG_RECENT: %q", value)
+		}
+		debugRecent = size
+	}
+
+	log.Printf("starting massive-ticker-uploader wss_url=%s subscribe=%s metrics_addr=%s debug_recent=%d auth_timeout=%s", wssURL, subscribe, metricsAddr, debugRecent, authTimeout)
 
-	log.Printf("starting massive-ticker-uploader wss_url=%s subscribe=%s", wssURL, subscribe)
+	latency := newLatencyTracker(10000)
+	status := newConnectionStatus()
+	recent := newRecentMessages(debugRecent)
+	go latency.reportLoop(1 * time.Minute)
+	go serveMetrics(metricsAddr, latency, status, recent)
 
 	backoff := 2 * time.Second
 	for {
-		if err := run(wssURL, apiKey, subscribe); err != nil {
+		status.set("connecting")
+		err := run(wssURL, apiKey, subscribe, flushGrace, authTimeout, limit, format, layout, latency, status, recent)
+		switch {
+		case errors.Is(err, errStatusTimeout):
+			log.Printf("auth error: %v", err)
+		case err != nil:
 			log.Printf("websocket error: %v", err)
 		}
 
+		status.backingOff(backoff, err)
 		time.Sleep(backoff)
+		status.reconnecting()
 		if backoff < 30*time.Second {
 			backoff *= 2
 		}
 	}
 }
 
-func run(wssURL, apiKey, subscribe string) error {
+func run(wssURL, apiKey, subscribe string, flushGrace, authTimeout time.Duration, limit bufferLimit, format csvFormat, layout dateLayout, latency *latencyTracker, status *connectionStatus, recent *recentMessages) error {
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
 	}
@@ -90,11 +233,38 @@ func run(wssURL, apiKey, subscribe string) error {
 	if err := conn.WriteJSON(actionMessage{Action: "auth", Params: apiKey}); err != nil {
 		return err
 	}
-
 	log.Printf("auth sent")
 
-	if err := waitForStatus(conn, "auth_success"); err != nil {
-		return err
+	// A missed auth_success on a healthy socket is retried in place before
+	// falling back to a full reconnect. The resend runs off a timer because a
+	// timed-out read leaves the websocket unusable.
+	authDone := make(chan struct{})
+	resendDone := make(chan struct{})
+	go func() {
+		defer close(resendDone)
+		for attempt := 2; attempt <= authAttempts; attempt++ {
+			select {
+			case <-authDone:
+				return
+			case <-time.After(authTimeout):
+			}
+			status.authTimeout()
+			log.Printf("auth timeout after %s, resending (attempt %d/%d)", authTimeout, attempt, authAttempts)
+			if err := conn.WriteJSON(actionMessage{Action: "auth", Params: apiKey}); err != nil {
+				log.Printf("auth resend failed: %v", err)
+				return
+			}
+		}
+	}()
+	err = waitForStatus(conn, "auth_success", authTimeout*authAttempts)
+	close(authDone)
+	<-resendDone
+	if err != nil {
+		if !errors.Is(err, errStatusTimeout) {
+			return err
+		}
+		status.authTimeout()
+		return fmt.Errorf("auth: %w", err)
 	}
 
 	if err := conn.WriteJSON(actionMessage{Action: "subscribe", Params: subscribe}); err != nil {
@@ -102,10 +272,13 @@ func run(wssURL, apiKey, subscribe string) error {
 	}
 
 	log.Printf("subscribe sent: %s", subscribe)
+	status.set("connected")
+	defer status.set("disconnected")
 
 	flushInterval := 1 * time.Minute
-	acc := newTickAccumulator(flushInterval, func(symbol string, entries []massiveTick) error {
-		return writeCSV(symbol, entries)
+	limit.onDrop = status.droppedTick
+	acc := newTickAccumulator(flushInterval, flushGrace, limit, func(symbol string, entries []massiveTick) error {
+		return writeCSV(uploadDir, format, layout, symbol, entries)
 	})
 	defer acc.Stop()
 
@@ -132,6 +305,27 @@ func run(wssURL, apiKey, subscribe string) error {
 				continue
 			}
 
+			if err := checkStatusError(data, ticks); err != nil {
+				return err
+			}
+
+			received := time.Now().UTC()
+			receivedAt := received.UnixMilli()
+			for _, tick := range ticks {
+				if tick.T > 0 {
+					latency.Observe(receivedAt - tick.T)
+				}
+			}
+
+			if recent != nil {
+				var raws []json.RawMessage
+				if err := json.Unmarshal(data, &raws); err == nil && len(raws) == len(ticks) {
+					for i, tick := range ticks {
+						recent.add(tick.Sym, string(raws[i]), received)
+					}
+				}
+			}
+
 			acc.Add(ticks)
 			continue
 		}
@@ -148,18 +342,41 @@ func run(wssURL, apiKey, subscribe string) error {
 	}
 }
 
+// tickAccumulator buffers ticks per symbol and flushes them on every tick of
+// its ticker. Ticks whose minute ended less than grace ago are held back to
+// the next flush so late arrivals land in the same write as the rest of
+// their minute; Stop flushes everything.
 type tickAccumulator struct {
 	mu       sync.Mutex
 	bySymbol map[string][]massiveTick
+	buffered int
+	limit    bufferLimit
+	grace    time.Duration
 	ticker   *time.Ticker
+	flushNow chan struct{}
 	stopCh   chan struct{}
 	flushFn  func(symbol string, entries []massiveTick) error
 }
 
-func newTickAccumulator(interval time.Duration, flushFn func(symbol string, entries []massiveTick) error) *tickAccumulator {
+// bufferLimit caps the ticks a tickAccumulator holds across all symbols
+// (MASSIVE_MAX_BUFFERED_TICKS, 0 for no cap). Past the cap it either drops
+// the oldest ticks (MASSIVE_BUFFER_OVERFLOW=drop) or asks for an early flush
+// (flush, the default); a flush that can't keep up, e.g. on a hung disk,
+// falls back to dropping at twice the cap. onDrop counts each dropped tick
+// and returns the running total.
+type bufferLimit struct {
+	maxTicks int
+	drop     bool
+	onDrop   func() int64
+}
+
+func newTickAccumulator(interval, grace time.Duration, limit bufferLimit, flushFn func(symbol string, entries []massiveTick) error) *tickAccumulator {
 	acc := &tickAccumulator{
 		bySymbol: make(map[string][]massiveTick),
+		limit:    limit,
+		grace:    grace,
 		ticker:   time.NewTicker(interval),
+		flushNow: make(chan struct{}, 1),
 		stopCh:   make(chan struct{}),
 		flushFn:  flushFn,
 	}
@@ -178,28 +395,75 @@ func (a *tickAccumulator) Add(ticks []massiveTick) {
 			continue
 		}
 		a.bySymbol[tick.Sym] = append(a.bySymbol[tick.Sym], tick)
+		a.buffered++
+		a.enforceLimit()
 	}
 	a.mu.Unlock()
 }
 
+// enforceLimit applies a.limit after an Add; a.mu must be held.
+func (a *tickAccumulator) enforceLimit() {
+	max := a.limit.maxTicks
+	if max <= 0 || a.buffered <= max {
+		return
+	}
+	if !a.limit.drop {
+		select {
+		case a.flushNow <- struct{}{}:
+		default:
+		}
+		max *= 2
+	}
+	for a.buffered > max {
+		a.dropOldest()
+	}
+}
+
+// dropOldest removes the oldest buffered tick; a.mu must be held.
+func (a *tickAccumulator) dropOldest() {
+	oldest := ""
+	for symbol, entries := range a.bySymbol {
+		if oldest == "" || entries[0].T < a.bySymbol[oldest][0].T {
+			oldest = symbol
+		}
+	}
+	if oldest == "" {
+		return
+	}
+	if entries := a.bySymbol[oldest][1:]; len(entries) > 0 {
+		a.bySymbol[oldest] = entries
+	} else {
+		delete(a.bySymbol, oldest)
+	}
+	a.buffered--
+	if a.limit.onDrop == nil {
+		return
+	}
+	if total := a.limit.onDrop(); total == 1 || total%1000 == 0 {
+		log.Printf("tick buffer over %d ticks, dropped %d so far", a.limit.maxTicks, total)
+	}
+}
+
 func (a *tickAccumulator) Stop() {
 	close(a.stopCh)
 	a.ticker.Stop()
-	a.flush()
+	a.flush(true)
 }
 
 func (a *tickAccumulator) loop() {
 	for {
 		select {
 		case <-a.ticker.C:
-			a.flush()
+			a.flush(false)
+		case <-a.flushNow:
+			a.flush(true)
 		case <-a.stopCh:
 			return
 		}
 	}
 }
 
-func (a *tickAccumulator) flush() {
+func (a *tickAccumulator) flush(force bool) {
 	a.mu.Lock()
 	if len(a.bySymbol) == 0 {
 		a.mu.Unlock()
@@ -207,6 +471,22 @@ func (a *tickAccumulator) flush() {
 	}
 	pending := a.bySymbol
 	a.bySymbol = make(map[string][]massiveTick)
+	a.buffered = 0
+	if !force {
+		cutoff := time.Now().UTC().Add(-time.Minute - a.grace).Truncate(time.Minute).Add(time.Minute).UnixMilli()
+		for symbol, entries := range pending {
+			ready := entries[:0:0]
+			for _, entry := range entries {
+				if entry.T >= cutoff {
+					a.bySymbol[symbol] = append(a.bySymbol[symbol], entry)
+					a.buffered++
+					continue
+				}
+				ready = append(ready, entry)
+			}
+			pending[symbol] = ready
+		}
+	}
 	a.mu.Unlock()
 
 	for symbol, entries := range pending {
@@ -219,7 +499,327 @@ func (a *tickAccumulator) flush() {
 	}
 }
 
-func writeCSV(symbol string, ticks []massiveTick) error {
+// latencyTracker keeps a bounded window of feed latency samples (local
+// receive time minus the tick's exchange timestamp, in milliseconds) and
+// publishes percentiles for the last completed window.
+type latencyTracker struct {
+	mu       sync.Mutex
+	samples  []int64
+	seen     int
+	limit    int
+	total    int64
+	p50      int64
+	p95      int64
+	reported int
+}
+
+func newLatencyTracker(limit int) *latencyTracker {
+	return &latencyTracker{
+		samples: make([]int64, 0, limit),
+		limit:   limit,
+	}
+}
+
+func (l *latencyTracker) Observe(ms int64) {
+	l.mu.Lock()
+	if len(l.samples) < l.limit {
+		l.samples = append(l.samples, ms)
+	} else {
+		l.samples[l.seen%l.limit] = ms
+	}
+	l.seen++
+	l.total++
+	l.mu.Unlock()
+}
+
+func (l *latencyTracker) reportLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.report()
+	}
+}
+
+func (l *latencyTracker) report() {
+	l.mu.Lock()
+	if len(l.samples) == 0 {
+		l.mu.Unlock()
+		return
+	}
+	window := append([]int64(nil), l.samples...)
+	count := l.seen
+	l.samples = l.samples[:0]
+	l.seen = 0
+	l.mu.Unlock()
+
+	sort.Slice(window, func(i, j int) bool {
+		return window[i] < window[j]
+	})
+	p50 := percentile(window, 0.50)
+	p95 := percentile(window, 0.95)
+
+	l.mu.Lock()
+	l.p50 = p50
+	l.p95 = p95
+	l.reported = count
+	l.mu.Unlock()
+
+	log.Printf("feed latency ticks=%d p50=%dms p95=%dms", count, p50, p95)
+}
+
+func (l *latencyTracker) snapshot() (p50, p95 int64, window int, total int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.p50, l.p95, l.reported, l.total
+}
+
+func percentile(sorted []int64, q float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(q * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+// connectionStatus tracks the upstream connection lifecycle for /status.
+type connectionStatus struct {
+	mu         sync.Mutex
+	state      string
+	since      time.Time
+	reconnects int
+	backoff    time.Duration
+	lastError  string
+	// droppedTicks counts ticks the accumulator shed to stay under its cap.
+	droppedTicks int64
+	// authTimeouts counts auth attempts that got no auth_success in time,
+	// kept apart from network errors so credential trouble can be alerted on.
+	authTimeouts int64
+}
+
+type connectionStatusResponse struct {
+	State        string `json:"state"`
+	Since        string `json:"since"`
+	Reconnects   int    `json:"reconnects"`
+	Backoff      string `json:"backoff,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	AuthTimeouts int64  `json:"auth_timeouts"`
+	DroppedTicks int64  `json:"dropped_ticks"`
+}
+
+func newConnectionStatus() *connectionStatus {
+	return &connectionStatus{state: "starting", since: time.Now().UTC()}
+}
+
+func (c *connectionStatus) set(state string) {
+	c.mu.Lock()
+	c.state = state
+	c.since = time.Now().UTC()
+	if state == "connected" {
+		c.backoff = 0
+	}
+	c.mu.Unlock()
+}
+
+func (c *connectionStatus) backingOff(backoff time.Duration, err error) {
+	c.mu.Lock()
+	c.state = "backing-off"
+	c.since = time.Now().UTC()
+	c.backoff = backoff
+	if err != nil {
+		c.lastError = err.Error()
+	}
+	c.mu.Unlock()
+}
+
+func (c *connectionStatus) authTimeout() {
+	c.mu.Lock()
+	c.authTimeouts++
+	c.mu.Unlock()
+}
+
+func (c *connectionStatus) droppedTick() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.droppedTicks++
+	return c.droppedTicks
+}
+
+func (c *connectionStatus) reconnecting() {
+	c.mu.Lock()
+	c.reconnects++
+	c.mu.Unlock()
+}
+
+func (c *connectionStatus) snapshot() connectionStatusResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := connectionStatusResponse{
+		State:        c.state,
+		Since:        c.since.Format(time.RFC3339),
+		Reconnects:   c.reconnects,
+		LastError:    c.lastError,
+		AuthTimeouts: c.authTimeouts,
+		DroppedTicks: c.droppedTicks,
+	}
+	if c.backoff > 0 {
+		resp.Backoff = c.backoff.String()
+	}
+	return resp
+}
+
+func serveMetrics(addr string, latency *latencyTracker, status *connectionStatus, recent *recentMessages) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(status.snapshot())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		p50, p95, window, total := latency.snapshot()
+		connection := status.snapshot()
+		var b strings.Builder
+		b.WriteString("# HELP massive_feed_latency_ms Delay between tick exchange time and local receive time.\n")
+		b.WriteString("# TYPE massive_feed_latency_ms summary\n")
+		b.WriteString(`massive_feed_latency_ms{quantile="0.5"} ` + strconv.FormatInt(p50, 10) + "\n")
+		b.WriteString(`massive_feed_latency_ms{quantile="0.95"} ` + strconv.FormatInt(p95, 10) + "\n")
+		b.WriteString("massive_feed_latency_ms_count " + strconv.FormatInt(total, 10) + "\n")
+		b.WriteString("# TYPE massive_feed_latency_window_ticks gauge\n")
+		b.WriteString("massive_feed_latency_window_ticks " + strconv.Itoa(window) + "\n")
+		b.WriteString("# HELP massive_auth_timeouts_total Auth attempts that got no auth_success before the timeout.\n")
+		b.WriteString("# TYPE massive_auth_timeouts_total counter\n")
+		b.WriteString("massive_auth_timeouts_total " + strconv.FormatInt(connection.AuthTimeouts, 10) + "\n")
+		b.WriteString("# HELP massive_ticks_dropped_total Ticks dropped because the flush buffer hit MASSIVE_MAX_BUFFERED_TICKS.\n")
+		b.WriteString("# TYPE massive_ticks_dropped_total counter\n")
+		b.WriteString("massive_ticks_dropped_total " + strconv.FormatInt(connection.DroppedTicks, 10) + "\n")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(b.String()))
+	})
+	if recent != nil {
+		mux.HandleFunc("/debug/recent", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			symbol := strings.TrimSpace(r.URL.Query().Get("symbol"))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(recent.snapshot(symbol))
+		})
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("metrics server failed: %v", err)
+	}
+}
+
+// recentMessages keeps the last size raw messages per symbol so /debug/recent
+// can show what the feed sent without a packet capture. A nil
+// *recentMessages is disabled and ignores adds.
+type recentMessages struct {
+	mu       sync.Mutex
+	size     int
+	bySymbol map[string]*messageRing
+}
+
+// messageRing is a fixed-size ring; once full, each add overwrites the
+// oldest entry.
+type messageRing struct {
+	entries []recentMessage
+	next    int
+}
+
+type recentMessage struct {
+	Received string `json:"received"`
+	Raw      string `json:"raw"`
+}
+
+func newRecentMessages(size int) *recentMessages {
+	if size <= 0 {
+		return nil
+	}
+	return &recentMessages{size: size, bySymbol: make(map[string]*messageRing)}
+}
+
+func (r *recentMessages) add(symbol, raw string, received time.Time) {
+	if r == nil {
+		return
+	}
+	entry := recentMessage{Received: received.UTC().Format(time.RFC3339Nano), Raw: raw}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ring := r.bySymbol[symbol]
+	if ring == nil {
+		ring = &messageRing{entries: make([]recentMessage, 0, r.size)}
+		r.bySymbol[symbol] = ring
+	}
+	if len(ring.entries) < r.size {
+		ring.entries = append(ring.entries, entry)
+		return
+	}
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % r.size
+}
+
+// snapshot returns the buffered messages, oldest first, for symbol or for
+// every symbol when symbol is empty.
+func (r *recentMessages) snapshot(symbol string) map[string][]recentMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string][]recentMessage)
+	for name, ring := range r.bySymbol {
+		if symbol != "" && name != symbol {
+			continue
+		}
+		ordered := make([]recentMessage, 0, len(ring.entries))
+		ordered = append(ordered, ring.entries[ring.next:]...)
+		ordered = append(ordered, ring.entries[:ring.next]...)
+		out[name] = ordered
+	}
+	return out
+}
+
+// dateLayout is how minute files are grouped by day under the upload dir.
+type dateLayout int
+
+const (
+	flatDates   dateLayout = iota // <date>/<symbol>/HH_MM.csv, date as 2006-01-02
+	nestedDates                   // 2006/01/02/<symbol>/HH_MM.csv
+)
+
+func parseDateLayout(value string) (dateLayout, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "flat":
+		return flatDates, nil
+	case "nested":
+		return nestedDates, nil
+	default:
+		return flatDates, fmt.Errorf("unknown layout %q", value)
+	}
+}
+
+// dir returns the day directory, relative to the upload dir, for tm.
+func (l dateLayout) dir(tm time.Time) string {
+	if l == nestedDates {
+		return filepath.Join(tm.Format("2006"), tm.Format("01"), tm.Format("02"))
+	}
+	return tm.Format("2006-01-02")
+}
+
+func writeCSV(uploadDir string, format csvFormat, layout dateLayout, symbol string, ticks []massiveTick) error {
 	type bucket struct {
 		dateDir string
 		minute  string
@@ -235,7 +835,7 @@ func writeCSV(symbol string, ticks []massiveTick) error {
 		}
 		tm := time.UnixMilli(ts).UTC()
 		key := bucket{
-			dateDir: tm.Format("2006-01-02"),
+			dateDir: layout.dir(tm),
 			minute:  tm.Format("15_04"),
 		}
 		if _, ok := groups[key]; !ok {
@@ -245,7 +845,7 @@ func writeCSV(symbol string, ticks []massiveTick) error {
 	}
 
 	for _, key := range order {
-		symbolDir := filepath.Join(uploadDir, key.dateDir, symbol)
+		symbolDir := filepath.Join(uploadDir, key.dateDir, sanitizeSymbol(symbol))
 		if err := os.MkdirAll(symbolDir, 0o755); err != nil {
 			return err
 		}
@@ -272,8 +872,12 @@ func writeCSV(symbol string, ticks []massiveTick) error {
 			return err
 		}
 
-		writer := csv.NewWriter(outFile)
+		writer := format.newWriter(outFile)
 		if needHeader {
+			if _, err := outFile.WriteString(csvSchemaLine); err != nil {
+				_ = outFile.Close()
+				return err
+			}
 			if err := writer.Write([]string{"ev", "sym", "i", "x", "p", "s", "c", "t", "q", "z", "ds"}); err != nil {
 				_ = outFile.Close()
 				return err
@@ -286,7 +890,7 @@ func writeCSV(symbol string, ticks []massiveTick) error {
 				tick.Sym,
 				tick.I,
 				fmt.Sprintf("%d", tick.X),
-				fmt.Sprintf("%g", tick.P),
+				format.price(tick.P),
 				fmt.Sprintf("%d", tick.S),
 				joinInts(tick.C),
 				fmt.Sprintf("%d", tick.T),
@@ -314,17 +918,137 @@ func writeCSV(symbol string, ticks []massiveTick) error {
 	return nil
 }
 
+// sanitizeSymbol keeps tick.Sym from escaping uploadDir: separators and
+// control characters are replaced and dot-only names are renamed.
+func sanitizeSymbol(symbol string) string {
+	symbol = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(symbol))
+	if strings.Trim(symbol, ".") == "" {
+		return "UNKNOWN"
+	}
+	return symbol
+}
+
+// csvFormat is the delimiter and quoting policy for the minute files.
+type csvFormat struct {
+	delimiter rune
+	quoteAll  bool
+	// priceDecimals fixes the decimals written for prices; -1 writes the
+	// shortest exact form. Either way there is no exponent.
+	priceDecimals int
+}
+
+func (f csvFormat) price(value float64) string {
+	return strconv.FormatFloat(value, 'f', f.priceDecimals, 64)
+}
+
+// parsePriceDecimals validates MASSIVE_PRICE_DECIMALS; empty keeps the
+// shortest exact form.
+func parsePriceDecimals(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return -1, nil
+	}
+	decimals, err := strconv.Atoi(value)
+	if err != nil || decimals < 0 || decimals > 17 {
+		return -1, fmt.Errorf("price decimals must be 0-17, got %q", value)
+	}
+	return decimals, nil
+}
+
+// parseCSVFormat validates MASSIVE_CSV_DELIMITER ("," ";" or "\t" for tab)
+// and MASSIVE_CSV_QUOTE ("minimal" or "all"). Empty values keep the
+// encoding/csv defaults. The delimiters are the ones the BFF sniffs from a
+// file's header; any other would be misread there.
+func parseCSVFormat(delimiter, quote string) (csvFormat, error) {
+	format := csvFormat{delimiter: ',', priceDecimals: -1}
+	switch delimiter {
+	case "", ",":
+	case ";":
+		format.delimiter = ';'
+	case "\t", `\t`:
+		format.delimiter = '\t'
+	default:
+		return format, fmt.Errorf("delimiter must be one of , ; or \\t, got %q", delimiter)
+	}
+	switch strings.ToLower(strings.TrimSpace(quote)) {
+	case "", "minimal":
+	case "all":
+		format.quoteAll = true
+	default:
+		return format, fmt.Errorf("quote policy must be minimal or all, got %q", quote)
+	}
+	return format, nil
+}
+
+// csvWriter writes records in a csvFormat. encoding/csv only quotes fields
+// that need it, so the quote-all policy is written by hand.
+type csvWriter struct {
+	format csvFormat
+	csv    *csv.Writer
+	buf    *bufio.Writer
+}
+
+func (f csvFormat) newWriter(w io.Writer) *csvWriter {
+	if !f.quoteAll {
+		writer := csv.NewWriter(w)
+		writer.Comma = f.delimiter
+		return &csvWriter{format: f, csv: writer}
+	}
+	return &csvWriter{format: f, buf: bufio.NewWriter(w)}
+}
+
+func (c *csvWriter) Write(record []string) error {
+	if c.csv != nil {
+		return c.csv.Write(record)
+	}
+	for i, field := range record {
+		if i > 0 {
+			c.buf.WriteRune(c.format.delimiter)
+		}
+		c.buf.WriteByte('"')
+		c.buf.WriteString(strings.ReplaceAll(field, `"`, `""`))
+		c.buf.WriteByte('"')
+	}
+	_, err := c.buf.WriteString("\n")
+	return err
+}
+
+func (c *csvWriter) Flush() {
+	if c.csv != nil {
+		c.csv.Flush()
+		return
+	}
+	_ = c.buf.Flush()
+}
+
+func (c *csvWriter) Error() error {
+	if c.csv != nil {
+		return c.csv.Error()
+	}
+	_, err := c.buf.Write(nil)
+	return err
+}
+
 func init() {
 	log.SetFlags(log.LstdFlags | log.LUTC)
 	log.SetOutput(os.Stdout)
 }
 
-func waitForStatus(conn *websocket.Conn, target string) error {
-	deadline := time.Now().Add(20 * time.Second)
+func waitForStatus(conn *websocket.Conn, target string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
 	_ = conn.SetReadDeadline(deadline)
 	for {
 		_, data, err := conn.ReadMessage()
 		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return fmt.Errorf("%w %s after %s", errStatusTimeout, target, timeout)
+			}
 			return err
 		}
 
@@ -345,6 +1069,47 @@ func waitForStatus(conn *websocket.Conn, target string) error {
 	}
 }
 
+func validateSubscribe(subscribe string) error {
+	for _, param := range strings.Split(subscribe, ",") {
+		param = strings.TrimSpace(param)
+		if !subscribeParamPattern.MatchString(param) {
+			return fmt.Errorf("%q does not match <channel>.<ticker> (channels: T, Q, A, AM, LULD, FMV, NOI)", param)
+		}
+	}
+	return nil
+}
+
+// checkStatusError looks for status events mixed into a tick array and turns
+// an error status (e.g. a rejected subscription) into an error so run exits
+// and the caller backs off instead of waiting on a silent connection.
+func checkStatusError(data []byte, ticks []massiveTick) error {
+	hasStatus := false
+	for _, tick := range ticks {
+		if tick.Ev == "status" {
+			hasStatus = true
+			break
+		}
+	}
+	if !hasStatus {
+		return nil
+	}
+
+	var statuses []statusMessage
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return nil
+	}
+	for _, status := range statuses {
+		if status.Ev != "status" {
+			continue
+		}
+		log.Printf("status: %s %s", status.Status, status.Message)
+		if status.Status == "error" || strings.HasSuffix(status.Status, "_failed") {
+			return fmt.Errorf("massive rejected request: %s (%s)", status.Message, status.Status)
+		}
+	}
+	return nil
+}
+
 func truncateForLog(data []byte, limit int) string {
 	text := strings.TrimSpace(string(data))
 	if len(text) <= limit {
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCSVFormatDelimiters(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  rune
+		ok    bool
+	}{
+		{"", ',', true},
+		{",", ',', true},
+		{";", ';', true},
+		{`\t`, '\t', true},
+		{"\t", '\t', true},
+		{"|", 0, false},
+		{":", 0, false},
+	} {
+		format, err := parseCSVFormat(tc.value, "")
+		if (err == nil) != tc.ok {
+			t.Errorf("parseCSVFormat(%q) error = %v, want ok %v", tc.value, err, tc.ok)
+			continue
+		}
+		if tc.ok && format.delimiter != tc.want {
+			t.Errorf("parseCSVFormat(%q) delimiter = %q, want %q", tc.value, format.delimiter, tc.want)
+		}
+	}
+}
+
+// newTestAccumulator returns an accumulator without its flush loop, so the
+// test sees exactly what enforceLimit did.
+func newTestAccumulator(limit bufferLimit) *tickAccumulator {
+	return &tickAccumulator{
+		bySymbol: make(map[string][]massiveTick),
+		limit:    limit,
+		flushNow: make(chan struct{}, 1),
+	}
+}
+
+func TestTickAccumulatorDropsOldestPastCap(t *testing.T) {
+	var dropped int64
+	acc := newTestAccumulator(bufferLimit{maxTicks: 3, drop: true, onDrop: func() int64 { dropped++; return dropped }})
+	var ticks []massiveTick
+	for i, symbol := range []string{"AAPL", "MSFT", "AAPL", "MSFT", "AAPL"} {
+		ticks = append(ticks, massiveTick{Sym: symbol, T: int64(i)})
+	}
+	acc.Add(ticks)
+	if acc.buffered != 3 || dropped != 2 {
+		t.Fatalf("buffered %d, dropped %d; want 3 and 2", acc.buffered, dropped)
+	}
+	for _, entries := range acc.bySymbol {
+		for _, tick := range entries {
+			if tick.T < 2 {
+				t.Errorf("tick %d kept, want the oldest dropped", tick.T)
+			}
+		}
+	}
+	select {
+	case <-acc.flushNow:
+		t.Error("drop mode asked for a flush")
+	default:
+	}
+}
+
+func TestTickAccumulatorFlushesEarlyPastCap(t *testing.T) {
+	var dropped int64
+	acc := newTestAccumulator(bufferLimit{maxTicks: 3, onDrop: func() int64 { dropped++; return dropped }})
+	acc.Add([]massiveTick{{Sym: "AAPL", T: 0}, {Sym: "AAPL", T: 1}, {Sym: "AAPL", T: 2}, {Sym: "AAPL", T: 3}})
+	select {
+	case <-acc.flushNow:
+	default:
+		t.Fatal("no early flush requested past the cap")
+	}
+	if dropped != 0 {
+		t.Fatalf("dropped %d ticks before twice the cap", dropped)
+	}
+	// With the flush stuck, ticks past twice the cap are dropped.
+	acc.Add([]massiveTick{{Sym: "AAPL", T: 4}, {Sym: "AAPL", T: 5}, {Sym: "AAPL", T: 6}, {Sym: "AAPL", T: 7}})
+	if acc.buffered != 6 || dropped != 2 {
+		t.Fatalf("buffered %d, dropped %d; want 6 and 2", acc.buffered, dropped)
+	}
+}
+
+func TestTolerantIntUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  tolerantInt
+	}{
+		{`1200`, 1200},
+		{`1.5e3`, 1500},
+		{`2E2`, 200},
+		{`12.6`, 13},
+		{`-3.5`, -4},
+		{`9223372036854775807`, math.MaxInt64},
+		{`92233720368547758070`, math.MaxInt64},
+		{`1e300`, math.MaxInt64},
+		{`-1e300`, math.MinInt64},
+		{`1e400`, math.MaxInt64},
+		{`"x"`, 0},
+		{`null`, 0},
+	} {
+		var got tolerantInt
+		if err := json.Unmarshal([]byte(tc.input), &got); err != nil {
+			t.Errorf("unmarshal %s: %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("unmarshal %s = %d, want %d", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestOversizedVolumeKeepsTheBatch(t *testing.T) {
+	var ticks []massiveTick
+	data := `[{"ev":"T","sym":"AAPL","p":190.5,"s":1e30,"t":1709632800000},{"ev":"T","sym":"MSFT","p":410.1,"s":100,"t":1709632800001}]`
+	if err := json.Unmarshal([]byte(data), &ticks); err != nil {
+		t.Fatal(err)
+	}
+	if len(ticks) != 2 || ticks[0].S != math.MaxInt64 || ticks[1].S != 100 {
+		t.Fatalf("ticks = %+v", ticks)
+	}
+}
+
+func TestCSVFormatPriceHasNoExponent(t *testing.T) {
+	for _, decimals := range []int{-1, 0, 5} {
+		format := csvFormat{delimiter: ',', priceDecimals: decimals}
+		for _, value := range []float64{1e6, 1.5e21, 1e-7, 123.456} {
+			if got := format.price(value); strings.ContainsAny(got, "eE") {
+				t.Errorf("decimals %d: price(%g) = %q", decimals, value, got)
+			}
+		}
+	}
+}
+
+func TestSanitizeSymbolStaysInOneDir(t *testing.T) {
+	for _, symbol := range []string{"../etc", "..", ".", "a/b", `..\..\win`, "/abs", "x\x00y", "  ", ""} {
+		got := sanitizeSymbol(symbol)
+		if got == "" || strings.ContainsAny(got, `/\`) || strings.Trim(got, ".") == "" {
+			t.Errorf("sanitizeSymbol(%q) = %q", symbol, got)
+		}
+		if dir := filepath.Join("/upload", got); filepath.Dir(dir) != "/upload" {
+			t.Errorf("sanitizeSymbol(%q) = %q escapes the upload dir", symbol, got)
+		}
+	}
+	if got := sanitizeSymbol("PETR4"); got != "PETR4" {
+		t.Errorf("sanitizeSymbol(PETR4) = %q", got)
+	}
+}
+
+func TestWriteCSVAppendsFlushesInTheSameMinute(t *testing.T) {
+	dir := t.TempDir()
+	format := csvFormat{delimiter: ',', priceDecimals: -1}
+	for _, tick := range []massiveTick{
+		{Ev: "T", Sym: "AAPL", P: 190.5, S: 10, T: 1709632800100},
+		{Ev: "T", Sym: "AAPL", P: 190.75, S: 20, T: 1709632800900},
+	} {
+		if err := writeCSV(dir, format, flatDates, "AAPL", []massiveTick{tick}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "2024-03-05", "AAPL", "10_00.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 || lines[0] != strings.TrimSpace(csvSchemaLine) || !strings.HasPrefix(lines[1], "ev,") {
+		t.Fatalf("file = %q, want schema, header and two ticks", data)
+	}
+	if !strings.Contains(lines[2], "190.5,") || !strings.Contains(lines[3], "190.75,") {
+		t.Fatalf("ticks = %q, want both flushes in order", lines[2:])
+	}
+}
@@ -1,24 +1,45 @@
 package main
 
 import (
+	"bytes"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 const (
 	maxUploadSize = 20 << 20 // 20 MB
 	uploadDir     = "/data/mt5-ticker-uploader"
+	// csvSchemaLine is the first line of every upload file, ahead of
+	// the header.
+	csvSchemaLine = "#schema=1\n"
+)
+
+// MT5 tick flag bits (MqlTick.flags).
+const (
+	tickFlagBid    = 2  // bid price changed
+	tickFlagAsk    = 4  // ask price changed
+	tickFlagLast   = 8  // last deal price changed (trade tick)
+	tickFlagVolume = 16 // volume changed
+	tickFlagBuy    = 32 // last deal was a buy
+	tickFlagSell   = 64 // last deal was a sell
 )
 
 type uploadRequest struct {
-	Symbol string `json:"symbol"`
-	Ticks  []tick `json:"ticks"`
+	Symbol    string `json:"symbol"`
+	Ticks     []tick `json:"ticks"`
+	FlagsMask *int64 `json:"flags_mask,omitempty"`
 }
 
 type tick struct {
@@ -30,12 +51,101 @@ type tick struct {
 	Flags   int64   `json:"flags"`
 }
 
+// defaultFlagsMask is read from MT5_FLAGS_MASK. Zero keeps every tick;
+// any other value keeps only ticks whose flags share a bit with the mask
+// (e.g. 8 keeps trade ticks and drops pure bid/ask quote updates).
+var defaultFlagsMask int64
+
+// strictJSON rejects upload payloads with fields the server doesn't know.
+// MT5_STRICT_JSON=false accepts them (and logs them) so newer EA versions
+// can be rolled out before the server.
+var strictJSON = true
+
+// sniffContent rejects upload bodies whose first bytes don't look like text
+// (http.DetectContentType), so a binary blob can't pass as JSON. Enabled by
+// MT5_SNIFF_CONTENT.
+var sniffContent bool
+
+// maxTicksPerRequest caps len(ticks) in one upload; larger requests get a
+// 413 before anything is written. Set by MT5_MAX_TICKS_PER_REQUEST, 0
+// disables the cap. The default stays under maxUploadSize for typical ticks.
+var maxTicksPerRequest = 200000
+
+// readyWriteCheck makes /health/ready create and remove a file in uploadDir,
+// so an unwritable volume shows up before an upload fails. Disabled with
+// MT5_READY_WRITE_CHECK=false, e.g. when testing against a read-only mount.
+var readyWriteCheck = true
+
+// nestedDateDirs writes uploads under YYYY/MM/DD/<symbol>/ instead of the
+// flat YYYY-MM-DD/<symbol>/ day directories. Set by MT5_DIR_LAYOUT=nested.
+var nestedDateDirs bool
+
+// priceDecimals fixes the decimals written for bid/ask/last; -1 (the
+// default) writes the shortest exact form. Neither uses exponents, which
+// "%g" did for large or tiny prices. Set by MT5_PRICE_DECIMALS.
+var priceDecimals = -1
+
 func main() {
+	mask, err := parseFlagsMask(os.Getenv("MT5_FLAGS_MASK"))
+	if err != nil {
+		panic(fmt.Sprintf("invalid MT5_FLAGS_MASK: %v", err))
+	}
+	defaultFlagsMask = mask
+	if value := strings.TrimSpace(os.Getenv("MT5_STRICT_JSON")); value != "" {
+		strict, err := strconv.ParseBool(value)
+		if err != nil {
+			panic(fmt.Sprintf("invalid MT5_STRICT_JSON: %q", value))
+		}
+		strictJSON = strict
+	}
+	if value := strings.TrimSpace(os.Getenv("MT5_SNIFF_CONTENT")); value != "" {
+		sniff, err := strconv.ParseBool(value)
+		if err != nil {
+			panic(fmt.Sprintf("invalid MT5_SNIFF_CONTENT: %q", value))
+		}
+		sniffContent = sniff
+	}
+	if value := strings.TrimSpace(os.Getenv("MT5_MAX_TICKS_PER_REQUEST")); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			panic(fmt.Sprintf("invalid MT5_MAX_TICKS_PER_REQUEST: %q", value))
+		}
+		maxTicksPerRequest = limit
+	}
+	if value := strings.TrimSpace(os.Getenv("MT5_READY_WRITE_CHECK")); value != "" {
+		check, err := strconv.ParseBool(value)
+		if err != nil {
+			panic(fmt.Sprintf("invalid MT5_READY_WRITE_CHECK: %q", value))
+		}
+		readyWriteCheck = check
+	}
+	switch layout := strings.ToLower(strings.TrimSpace(os.Getenv("MT5_DIR_LAYOUT"))); layout {
+	case "", "flat":
+	case "nested":
+		nestedDateDirs = true
+	default:
+		panic(fmt.Sprintf("invalid MT5_DIR_LAYOUT: %q", layout))
+	}
+	if value := strings.TrimSpace(os.Getenv("MT5_PRICE_DECIMALS")); value != "" {
+		decimals, err := strconv.Atoi(value)
+		if err != nil || decimals < 0 || decimals > 17 {
+			panic(fmt.Sprintf("invalid MT5_PRICE_DECIMALS: %q", value))
+		}
+		priceDecimals = decimals
+	}
+
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/health/ready", readyHandler)
 	http.HandleFunc("/upload", uploadHandler)
 
+	port := strings.TrimSpace(os.Getenv("PORT"))
+	if port == "" {
+		port = "8080"
+	}
+	bindAddr := strings.TrimSpace(os.Getenv("BIND_ADDR"))
+
 	server := &http.Server{
-		Addr:              ":8080",
+		Addr:              net.JoinHostPort(bindAddr, port),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
@@ -55,6 +165,42 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("ok"))
 }
 
+// readyHandler reports 503 when uploadDir can't be written; /health only
+// says the process is up.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if readyWriteCheck {
+		if err := checkWritable(uploadDir); err != nil {
+			log.Printf("ready check failed: %v", err)
+			http.Error(w, "upload dir not writable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// checkWritable creates, writes and removes a scratch file in dir.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".ready-*")
+	if err != nil {
+		return err
+	}
+	_, writeErr := file.WriteString("ok")
+	closeErr := file.Close()
+	removeErr := os.Remove(file.Name())
+	return errors.Join(writeErr, closeErr, removeErr)
+}
+
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -64,10 +210,19 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
 	defer r.Body.Close()
 
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if sniffContent && !strings.HasPrefix(http.DetectContentType(body), "text/plain") {
+		http.Error(w, "body must be JSON text", http.StatusUnsupportedMediaType)
+		return
+	}
+
 	var payload uploadRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-	if err := decoder.Decode(&payload); err != nil {
+	if err := decodeUpload(body, &payload); err != nil {
 		http.Error(w, "invalid JSON body", http.StatusBadRequest)
 		return
 	}
@@ -82,13 +237,34 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if maxTicksPerRequest > 0 && len(payload.Ticks) > maxTicksPerRequest {
+		http.Error(w, fmt.Sprintf("too many ticks: %d exceeds the limit of %d per request", len(payload.Ticks), maxTicksPerRequest), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	mask := defaultFlagsMask
+	if payload.FlagsMask != nil {
+		mask = *payload.FlagsMask
+	}
+	payload.Ticks = filterTicksByFlags(payload.Ticks, mask)
+	if len(payload.Ticks) == 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+
 	timestamp := payload.Ticks[0].TimeMSC
 	if timestamp <= 0 {
 		timestamp = time.Now().UTC().UnixMilli()
 	}
 
-	dateDir := time.UnixMilli(timestamp).UTC().Format("2006-01-02")
-	symbolDir := filepath.Join(uploadDir, dateDir, payload.Symbol)
+	dateTime := time.UnixMilli(timestamp).UTC()
+	dateDir := dateTime.Format("2006-01-02")
+	if nestedDateDirs {
+		dateDir = filepath.Join(dateTime.Format("2006"), dateTime.Format("01"), dateTime.Format("02"))
+	}
+	symbolDir := filepath.Join(uploadDir, dateDir, sanitizeSymbol(payload.Symbol))
 	if err := os.MkdirAll(symbolDir, 0o755); err != nil {
 		http.Error(w, "could not create upload directory", http.StatusInternalServerError)
 		return
@@ -102,6 +278,10 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer outFile.Close()
 
+	if _, err := outFile.WriteString(csvSchemaLine); err != nil {
+		http.Error(w, "could not write file", http.StatusInternalServerError)
+		return
+	}
 	writer := csv.NewWriter(outFile)
 	if err := writer.Write([]string{"time_msc", "bid", "ask", "last", "volume", "flags"}); err != nil {
 		http.Error(w, "could not write file", http.StatusInternalServerError)
@@ -111,9 +291,9 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	for _, tick := range payload.Ticks {
 		row := []string{
 			fmt.Sprintf("%d", tick.TimeMSC),
-			fmt.Sprintf("%g", tick.Bid),
-			fmt.Sprintf("%g", tick.Ask),
-			fmt.Sprintf("%g", tick.Last),
+			formatPrice(tick.Bid),
+			formatPrice(tick.Ask),
+			formatPrice(tick.Last),
 			fmt.Sprintf("%d", tick.Volume),
 			fmt.Sprintf("%d", tick.Flags),
 		}
@@ -133,3 +313,64 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("ok"))
 }
+
+// decodeUpload decodes body into payload. Unknown fields are an error in
+// strict mode; otherwise they are logged and ignored.
+func decodeUpload(body []byte, payload *uploadRequest) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(payload)
+	if err == nil || strictJSON || !strings.HasPrefix(err.Error(), "json: unknown field ") {
+		return err
+	}
+	log.Printf("ignoring unknown fields in upload: %v", err)
+	*payload = uploadRequest{}
+	return json.Unmarshal(body, payload)
+}
+
+// formatPrice writes a bid/ask/last value with priceDecimals decimals.
+func formatPrice(value float64) string {
+	return strconv.FormatFloat(value, 'f', priceDecimals, 64)
+}
+
+// sanitizeSymbol turns the client-supplied symbol into one path element, so
+// "../x" or "a/b" cannot write outside uploadDir.
+func sanitizeSymbol(symbol string) string {
+	symbol = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(symbol))
+	if strings.Trim(symbol, ".") == "" {
+		return "UNKNOWN"
+	}
+	return symbol
+}
+
+func filterTicksByFlags(ticks []tick, mask int64) []tick {
+	if mask == 0 {
+		return ticks
+	}
+	kept := ticks[:0]
+	for _, t := range ticks {
+		if t.Flags&mask != 0 {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// parseFlagsMask reads MT5_FLAGS_MASK; empty means 0, which keeps every
+// tick.
+func parseFlagsMask(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	mask, err := strconv.ParseInt(value, 0, 64)
+	if err != nil || mask < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative integer", value)
+	}
+	return mask, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatPriceHasNoExponent(t *testing.T) {
+	defer func(saved int) { priceDecimals = saved }(priceDecimals)
+	for _, decimals := range []int{-1, 0, 5} {
+		priceDecimals = decimals
+		for _, value := range []float64{1e6, 1.5e21, 1e-7, 123.456} {
+			if got := formatPrice(value); strings.ContainsAny(got, "eE") {
+				t.Errorf("decimals %d: formatPrice(%g) = %q", decimals, value, got)
+			}
+		}
+	}
+}
+
+func TestSanitizeSymbolStaysInOneDir(t *testing.T) {
+	for _, symbol := range []string{"../etc", "..", ".", "a/b", `..\..\win`, "/abs", "x\x00y", "  ", ""} {
+		got := sanitizeSymbol(symbol)
+		if got == "" || strings.ContainsAny(got, `/\`) || strings.Trim(got, ".") == "" {
+			t.Errorf("sanitizeSymbol(%q) = %q", symbol, got)
+		}
+		if dir := filepath.Join("/upload", got); filepath.Dir(dir) != "/upload" {
+			t.Errorf("sanitizeSymbol(%q) = %q escapes the upload dir", symbol, got)
+		}
+	}
+	if got := sanitizeSymbol("PETR4"); got != "PETR4" {
+		t.Errorf("sanitizeSymbol(PETR4) = %q", got)
+	}
+}
+
+func TestParseFlagsMask(t *testing.T) {
+	for value, want := range map[string]int64{"": 0, "6": 6, "0x6": 6} {
+		if got, err := parseFlagsMask(value); err != nil || got != want {
+			t.Errorf("parseFlagsMask(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"-1", "six"} {
+		if _, err := parseFlagsMask(value); err == nil {
+			t.Errorf("parseFlagsMask(%q) accepted", value)
+		}
+	}
+}